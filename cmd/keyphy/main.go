@@ -29,6 +29,14 @@ func init() {
 		app.NewListCommand(),
 		app.NewDeviceCommand(),
 		app.NewServiceCommand(),
+		app.NewScheduleCommand(),
+		app.NewProfileCommand(),
+		app.NewQuotaCommand(),
+		app.NewUsageCommand(),
+		app.NewImportCommand(),
+		app.NewExportCommand(),
+		app.NewNetworkCommand(),
+		app.NewCheckCommand(),
 	)
 }
 
@@ -2,13 +2,16 @@ package app
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"strings"
+	"time"
 	"github.com/spf13/cobra"
 	"github.com/gajzzs/keyphy/internal/blocker"
 	"github.com/gajzzs/keyphy/internal/config"
 	"github.com/gajzzs/keyphy/internal/crypto"
 	"github.com/gajzzs/keyphy/internal/device"
+	"github.com/gajzzs/keyphy/internal/matcher"
 	"github.com/gajzzs/keyphy/internal/service"
 )
 
@@ -25,6 +28,10 @@ func NewAddCommand() *cobra.Command {
 		Args:  cobra.ExactArgs(1),
 		DisableFlagsInUseLine: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			meta, err := ruleMetaFromFlags(cmd)
+			if err != nil {
+				return err
+			}
 			if !validateDeviceAuth() {
 				return fmt.Errorf("authentication device not connected or invalid")
 			}
@@ -35,11 +42,11 @@ func NewAddCommand() *cobra.Command {
 			fmt.Printf("Adding application to blocking list: %s\n", appName)
 			if customPath != "" {
 				fmt.Printf("Using custom path: %s\n", customPath)
-				if err := config.AddBlockedAppWithPath(appName, customPath); err != nil {
+				if err := config.AddBlockedAppWithPath(appName, customPath, meta); err != nil {
 					return err
 				}
 			} else {
-				if err := config.AddBlockedApp(appName); err != nil {
+				if err := config.AddBlockedApp(appName, meta); err != nil {
 					return err
 				}
 			}
@@ -49,43 +56,83 @@ func NewAddCommand() *cobra.Command {
 	}
 	appCmd.Flags().String("path", "", "Custom path to executable (e.g. /opt/app/bin/myapp)")
 
-	cmd.AddCommand(
-		appCmd,
-		&cobra.Command{
-			Use:   "website [domain]",
-			Short: "Add a website to blocking list (enter domain without www, e.g. youtube.com)",
-			Args:  cobra.ExactArgs(1),
-			DisableFlagsInUseLine: true,
-			RunE: func(cmd *cobra.Command, args []string) error {
-				if !validateDeviceAuth() {
-					return fmt.Errorf("authentication device not connected or invalid")
-				}
-				fmt.Printf("Adding website to blocking list: %s\n", args[0])
-				if err := config.AddBlockedWebsite(args[0]); err != nil {
-					return err
+	websiteCmd := &cobra.Command{
+		Use:   "website [domain]",
+		Short: "Add a website to blocking list (youtube.com, *.youtube.com, =youtu.be or /regex/)",
+		Args:  cobra.ExactArgs(1),
+		DisableFlagsInUseLine: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if _, err := matcher.Parse(args[0]); err != nil {
+				return err
+			}
+			meta, err := ruleMetaFromFlags(cmd)
+			if err != nil {
+				return err
+			}
+			ranges, _ := cmd.Flags().GetStringSlice("range")
+			for _, cidr := range ranges {
+				if _, _, err := net.ParseCIDR(cidr); err != nil {
+					return fmt.Errorf("invalid range %s: %v", cidr, err)
 				}
-				fmt.Printf("Website '%s' added to blocking list successfully\n", args[0])
-				return nil
-			},
-		},
-		&cobra.Command{
-			Use:   "path [file-or-folder-path]",
-			Short: "Add file or folder to blocking list",
-			Args:  cobra.ExactArgs(1),
-			DisableFlagsInUseLine: true,
-			RunE: func(cmd *cobra.Command, args []string) error {
-				if !validateDeviceAuth() {
-					return fmt.Errorf("authentication device not connected or invalid")
+			}
+			meta.Ranges = ranges
+			meta.Users, _ = cmd.Flags().GetStringSlice("user")
+			meta.Groups, _ = cmd.Flags().GetStringSlice("group")
+			for _, name := range meta.Users {
+				if _, err := config.LookupUser(name); err != nil {
+					return fmt.Errorf("unknown user %s", name)
 				}
-				fmt.Printf("Adding path to blocking list: %s\n", args[0])
-				if err := config.AddBlockedPath(args[0]); err != nil {
-					return err
+			}
+			for _, name := range meta.Groups {
+				if _, err := config.LookupGroup(name); err != nil {
+					return fmt.Errorf("unknown group %s", name)
 				}
-				fmt.Printf("Path '%s' added to blocking list successfully\n", args[0])
-				return nil
-			},
+			}
+			if len(meta.Groups) > 0 && resolvedBackend(config.GetConfig()) == blocker.BackendNftables {
+				return fmt.Errorf("--group needs the %s firewall backend, nftables only matches a user's primary group", blocker.BackendIptables)
+			}
+			if !validateDeviceAuth() {
+				return fmt.Errorf("authentication device not connected or invalid")
+			}
+			fmt.Printf("Adding website to blocking list: %s\n", args[0])
+			if err := config.AddBlockedWebsite(args[0], meta); err != nil {
+				return err
+			}
+			fmt.Printf("Website '%s' added to blocking list successfully\n", args[0])
+			return nil
 		},
-	)
+	}
+
+	pathCmd := &cobra.Command{
+		Use:   "path [file-or-folder-path]",
+		Short: "Add file or folder to blocking list",
+		Args:  cobra.ExactArgs(1),
+		DisableFlagsInUseLine: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			meta, err := ruleMetaFromFlags(cmd)
+			if err != nil {
+				return err
+			}
+			if !validateDeviceAuth() {
+				return fmt.Errorf("authentication device not connected or invalid")
+			}
+			fmt.Printf("Adding path to blocking list: %s\n", args[0])
+			if err := config.AddBlockedPath(args[0], meta); err != nil {
+				return err
+			}
+			fmt.Printf("Path '%s' added to blocking list successfully\n", args[0])
+			return nil
+		},
+	}
+
+	websiteCmd.Flags().StringSlice("range", nil, "CIDR owned by the site, blocked along with its resolved addresses (repeatable)")
+	websiteCmd.Flags().StringSlice("user", nil, "Only block the site for this user, by name or UID (repeatable)")
+	websiteCmd.Flags().StringSlice("group", nil, "Only block the site for members of this group, by name or GID (repeatable)")
+
+	for _, sub := range []*cobra.Command{appCmd, websiteCmd, pathCmd} {
+		addRuleMetaFlags(sub)
+	}
+	cmd.AddCommand(appCmd, websiteCmd, pathCmd)
 
 	return cmd
 }
@@ -97,12 +144,15 @@ func NewUnblockCommand() *cobra.Command {
 		Args:  cobra.ExactArgs(1),
 		DisableFlagsInUseLine: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if source, managed := config.ManagedBy(args[0]); managed {
+				return fmt.Errorf("'%s' is managed by %s and cannot be unblocked here", args[0], source)
+			}
 			if !validateDeviceAuth() {
 				return fmt.Errorf("authentication device not connected or invalid")
 			}
 			// Remove specific item from active rules and config
 			fmt.Printf("Unblocking: %s\n", args[0])
-			networkBlocker := blocker.NewNetworkBlocker()
+			networkBlocker := blocker.NewNetworkBlocker(blocker.NewFirewall(config.GetConfig().FirewallBackend))
 			if err := networkBlocker.UnblockWebsite(args[0]); err != nil {
 				fmt.Printf("Warning: Failed to remove iptables rules for %s: %v\n", args[0], err)
 			}
@@ -135,7 +185,7 @@ func NewResetCommand() *cobra.Command {
 			
 			// Remove all blocking rules
 			fmt.Println("Removing all blocking rules...")
-			networkBlocker := blocker.NewNetworkBlocker()
+			networkBlocker := blocker.NewNetworkBlocker(blocker.NewFirewall(config.GetConfig().FirewallBackend))
 			if err := networkBlocker.UnblockAll(); err != nil {
 				fmt.Printf("Warning: Failed to remove network rules: %v\n", err)
 			}
@@ -164,6 +214,9 @@ func NewResetCommand() *cobra.Command {
 			if err := config.SaveConfig(); err != nil {
 				fmt.Printf("Warning: Failed to clear config: %v\n", err)
 			}
+			if fragments := config.Fragments(); len(fragments) > 0 {
+				fmt.Printf("Note: rules from %d fragment(s) in %s are managed externally and will be loaded again\n", len(fragments), config.FragmentDir)
+			}
 			
 			fmt.Println("Keyphy system reset complete - all blocks removed and service stopped")
 			return nil
@@ -172,26 +225,26 @@ func NewResetCommand() *cobra.Command {
 }
 
 func NewListCommand() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "list",
 		Short: "List all blocked items",
 		DisableFlagsInUseLine: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			cfg := config.GetConfig()
+			tag, _ := cmd.Flags().GetString("tag")
 			
 			fmt.Println("Blocked Applications:")
-			for _, app := range cfg.BlockedApps {
-				fmt.Printf("  - %s\n", app)
-			}
+			printRules("app", cfg.BlockedApps, tag)
 			
 			fmt.Println("\nBlocked Websites:")
-			for _, website := range cfg.BlockedWebsites {
-				fmt.Printf("  - %s\n", website)
-			}
+			printRules("website", cfg.BlockedWebsites, tag)
 			
 			fmt.Println("\nBlocked Paths:")
-			for _, path := range cfg.BlockedPaths {
-				fmt.Printf("  - %s\n", path)
+			printRules("path", cfg.BlockedPaths, tag)
+			
+			if tag != "" {
+				// Device and service details are not tag specific
+				return nil
 			}
 			
 			fmt.Printf("\nAuth Device: %s\n", cfg.AuthDevice)
@@ -216,11 +269,15 @@ func NewListCommand() *cobra.Command {
 			} else {
 				fmt.Println("Service Status: Stopped")
 			}
+			printTimedUnlocks()
 			fmt.Printf("Systemd Status: %s", serviceStatus)
 			
 			return nil
 		},
 	}
+	cmd.Flags().String("tag", "", "Only list rules carrying this tag")
+
+	return cmd
 }
 
 func NewDeviceCommand() *cobra.Command {
@@ -365,6 +422,18 @@ func NewServiceCommand() *cobra.Command {
 				select {}
 			},
 		},
+		&cobra.Command{
+			Use:    "run-exec-guard",
+			Short:  "Internal command that denies blocked apps for the daemon (do not use directly)",
+			Hidden: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				if os.Geteuid() != 0 {
+					return fmt.Errorf("exec guard must be run as root")
+				}
+				// The daemon passes the target list as fd 3 and reads fd 4
+				return blocker.RunExecGuard(os.NewFile(3, "targets"), os.NewFile(4, "events"))
+			},
+		},
 		&cobra.Command{
 			Use:   "stop",
 			Short: "Stop keyphy daemon",
@@ -405,10 +474,40 @@ func NewServiceCommand() *cobra.Command {
 				} else {
 					fmt.Println("Daemon status: Stopped")
 				}
+				printTimedUnlocks()
+				backend := config.GetConfig().AppBackend
+				if backend == "" {
+					backend = blocker.AppBackendAuto
+				}
+				fmt.Printf("App blocking backend: %s\n", backend)
 				fmt.Printf("Service status: %s", service.GetServiceStatus())
 				return nil
 			},
 		},
+		&cobra.Command{
+			Use:   "app-backend [auto|fanotify|wrapper]",
+			Short: "Select how the daemon blocks applications",
+			Long: `Select how the daemon blocks applications.
+
+fanotify denies executing blocked binaries, their hard links and copies
+without changing any file. It needs Linux 5.0 or later. wrapper replaces
+blocked binaries with a script and is used when fanotify is unavailable.`,
+			Args:  cobra.ExactArgs(1),
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				backend, err := blocker.ResolveAppBackend(args[0])
+				if err != nil {
+					return err
+				}
+				if !validateDeviceAuth() {
+					return fmt.Errorf("authentication device not connected or invalid")
+				}
+				if args[0] == blocker.AppBackendAuto {
+					fmt.Printf("Detected %s on this host\n", backend)
+				}
+				return config.SetAppBackend(args[0])
+			},
+		},
 	)
 
 	return cmd
@@ -434,22 +533,82 @@ func NewLockCommand() *cobra.Command {
 }
 
 func NewUnlockCommand() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "unlock",
 		Short: "Unlock all blocks (requires auth device)",
+		Long:  "Unlock all blocks (requires auth device). With --for the blocks are reapplied automatically once the duration has passed.",
 		DisableFlagsInUseLine: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if os.Geteuid() != 0 {
 				return fmt.Errorf("unlock requires root privileges")
 			}
-			fmt.Println("Sending unlock signal to daemon...")
-			if err := service.SendUnlockSignal(); err != nil {
-				return fmt.Errorf("failed to send unlock signal: %v", err)
+
+			duration, _ := cmd.Flags().GetDuration("for")
+			profile, _ := cmd.Flags().GetString("profile")
+			item, _ := cmd.Flags().GetString("item")
+
+			if duration == 0 {
+				if profile != "" || item != "" {
+					return fmt.Errorf("--profile and --item require --for")
+				}
+				fmt.Println("Sending unlock signal to daemon...")
+				if err := service.SendUnlockSignal(); err != nil {
+					return fmt.Errorf("failed to send unlock signal: %v", err)
+				}
+				fmt.Println("Unlock signal sent successfully - all blocks are now disabled")
+				return nil
+			}
+
+			if duration < 0 {
+				return fmt.Errorf("unlock duration must be positive")
+			}
+			if profile != "" && item != "" {
+				return fmt.Errorf("use either --profile or --item, not both")
 			}
-			fmt.Println("Unlock signal sent successfully - all blocks are now disabled")
+			if profile != "" && config.ProfileItems(profile) == nil {
+				return fmt.Errorf("profile '%s' not found", profile)
+			}
+
+			unlock := config.TimedUnlock{Item: item, Profile: profile}
+			fmt.Printf("Requesting unlock of %s for %s...\n", unlock.Target(), duration)
+			if err := service.SendTimedUnlock(item, profile, duration); err != nil {
+				return fmt.Errorf("failed to send unlock request: %v", err)
+			}
+			fmt.Printf("Unlock accepted - %s will be blocked again at %s\n", unlock.Target(), time.Now().Add(duration).Format("15:04:05"))
 			return nil
 		},
 	}
+	cmd.Flags().Duration("for", 0, "Unlock only for this long (e.g. 30m, 1h30m)")
+	cmd.Flags().String("profile", "", "Only unlock the items of this profile (requires --for)")
+	cmd.Flags().String("item", "", "Only unlock this blocked item (requires --for)")
+
+	return cmd
+}
+
+// sourceSuffix names the conf.d fragment a rule came from, if any.
+func sourceSuffix(kind, name string) string {
+	if !config.IsManaged(kind, name) {
+		return ""
+	}
+	return fmt.Sprintf(" (from %s)", config.Source(kind, name))
+}
+
+func printTimedUnlocks() {
+	state, err := config.LoadState()
+	if err != nil {
+		fmt.Printf("Timed unlocks: unavailable (%v)\n", err)
+		return
+	}
+	if state.LockedUntil != nil && time.Until(*state.LockedUntil) > 0 {
+		fmt.Printf("Lock extended after circumvention attempt until %s\n", state.LockedUntil.Local().Format("15:04:05"))
+	}
+	for _, unlock := range state.Unlocks {
+		remaining := time.Until(unlock.Expires)
+		if remaining <= 0 {
+			continue
+		}
+		fmt.Printf("Timed unlock: %s (%s remaining, relocks at %s)\n", unlock.Target(), remaining.Round(time.Second), unlock.Expires.Local().Format("15:04:05"))
+	}
 }
 
 func validateDeviceAuth() bool {
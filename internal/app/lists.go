@@ -0,0 +1,144 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/gajzzs/keyphy/internal/blocklist"
+	"github.com/gajzzs/keyphy/internal/config"
+)
+
+func NewImportCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import [file]",
+		Short: "Import websites from a hosts, plain-list, JSON or adblock file (use - for stdin)",
+		Args:  cobra.ExactArgs(1),
+		DisableFlagsInUseLine: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			format, _ := cmd.Flags().GetString("format")
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			yes, _ := cmd.Flags().GetBool("yes")
+			tags, _ := cmd.Flags().GetStringSlice("tag")
+
+			var input io.Reader = os.Stdin
+			if args[0] != "-" {
+				file, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				input = file
+			}
+
+			result, err := blocklist.Parse(input, format)
+			if err != nil {
+				return err
+			}
+
+			added := blocklist.Uncovered(config.GetConfig().BlockedWebsites, result.Domains)
+
+			// Preview what the import would change
+			for _, domain := range added {
+				fmt.Printf("+ %s\n", domain)
+			}
+			for _, entry := range result.Invalid {
+				fmt.Printf("! %s (invalid, skipped)\n", entry)
+			}
+			fmt.Printf("\n%d new, %d already blocked, %d invalid\n", len(added), len(result.Domains)-len(added), len(result.Invalid))
+
+			if dryRun || len(added) == 0 {
+				return nil
+			}
+			if !yes {
+				// The list itself came through stdin, so ask the terminal
+				answers := os.Stdin
+				if args[0] == "-" {
+					tty, err := os.Open("/dev/tty")
+					if err != nil {
+						return fmt.Errorf("cannot ask for confirmation while reading the list from stdin, use --yes")
+					}
+					defer tty.Close()
+					answers = tty
+				}
+				if !confirm(answers, fmt.Sprintf("Block %d new website(s)?", len(added))) {
+					fmt.Println("Import cancelled")
+					return nil
+				}
+			}
+
+			if !validateDeviceAuth() {
+				return fmt.Errorf("authentication device not connected or invalid")
+			}
+			if err := config.AddBlockedWebsites(added, config.NewRuleMeta("imported from "+args[0], tags, nil)); err != nil {
+				return err
+			}
+			fmt.Printf("Imported %d website(s) successfully\n", len(added))
+			return nil
+		},
+	}
+	cmd.Flags().String("format", "list", "Input format: "+strings.Join(blocklist.Formats, ", "))
+	cmd.Flags().Bool("dry-run", false, "Only show what would be imported")
+	cmd.Flags().BoolP("yes", "y", false, "Import without asking for confirmation")
+	cmd.Flags().StringSlice("tag", nil, "Tag every imported website (repeatable)")
+
+	return cmd
+}
+
+func NewExportCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export blocked websites as hosts, plain-list, JSON or adblock file",
+		Args:  cobra.NoArgs,
+		DisableFlagsInUseLine: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			format, _ := cmd.Flags().GetString("format")
+			output, _ := cmd.Flags().GetString("output")
+
+			websites := config.GetConfig().BlockedWebsites
+			warnSkipped := func(skipped []string) {
+				for _, rule := range skipped {
+					fmt.Fprintf(os.Stderr, "Warning: %s cannot be expressed in %s format, skipped\n", rule, format)
+				}
+			}
+
+			if output == "" || output == "-" {
+				skipped, err := blocklist.Write(os.Stdout, format, websites)
+				warnSkipped(skipped)
+				return err
+			}
+			file, err := os.Create(output)
+			if err != nil {
+				return err
+			}
+			skipped, err := blocklist.Write(file, format, websites)
+			if err != nil {
+				file.Close()
+				return err
+			}
+			if err := file.Close(); err != nil {
+				return err
+			}
+			warnSkipped(skipped)
+			fmt.Printf("Exported %d website(s) to %s\n", len(websites)-len(skipped), output)
+			return nil
+		},
+	}
+	cmd.Flags().String("format", "list", "Output format: "+strings.Join(blocklist.Formats, ", "))
+	cmd.Flags().StringP("output", "o", "", "Write to file instead of stdout")
+
+	return cmd
+}
+
+func confirm(answers io.Reader, question string) bool {
+	fmt.Printf("%s [y/N]: ", question)
+	answer, err := bufio.NewReader(answers).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,102 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/gajzzs/keyphy/internal/config"
+)
+
+func addRuleMetaFlags(cmd *cobra.Command) {
+	cmd.Flags().String("note", "", "Why this item is blocked")
+	cmd.Flags().StringSlice("tag", nil, "Tag for grouping and filtering (repeatable)")
+	cmd.Flags().String("expires", "", "Remove the rule automatically after a duration (e.g. 2h, 7d) or at a date (2006-01-02 or RFC 3339)")
+}
+
+func ruleMetaFromFlags(cmd *cobra.Command) (config.RuleMeta, error) {
+	note, _ := cmd.Flags().GetString("note")
+	tags, _ := cmd.Flags().GetStringSlice("tag")
+	expires, _ := cmd.Flags().GetString("expires")
+
+	var expiresAt *time.Time
+	if expires != "" {
+		at, err := parseExpiry(expires, time.Now())
+		if err != nil {
+			return config.RuleMeta{}, err
+		}
+		expiresAt = &at
+	}
+	return config.NewRuleMeta(note, tags, expiresAt), nil
+}
+
+// parseExpiry accepts a duration relative to now, with "d" for days, or an
+// absolute date or timestamp.
+func parseExpiry(value string, now time.Time) (time.Time, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n > 0 {
+			return now.AddDate(0, 0, n).Truncate(time.Second), nil
+		}
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		if duration <= 0 {
+			return time.Time{}, fmt.Errorf("expiry must be in the future")
+		}
+		return now.Add(duration).Truncate(time.Second), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04", "2006-01-02"} {
+		if at, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			if !at.After(now) {
+				return time.Time{}, fmt.Errorf("expiry %s is in the past", value)
+			}
+			return at, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry %s, use a duration like 2h or 7d or a date like 2006-01-02", value)
+}
+
+// printRules lists rules of one kind with their metadata, optionally only
+// those carrying tag.
+func printRules(kind string, items []string, tag string) {
+	for _, item := range items {
+		meta, hasMeta := config.Meta(item)
+		if tag != "" && !meta.HasTag(tag) {
+			continue
+		}
+		fmt.Printf("  - %s%s\n", item, sourceSuffix(kind, item))
+		if !hasMeta {
+			continue
+		}
+		if meta.Note != "" {
+			fmt.Printf("      Note: %s\n", meta.Note)
+		}
+		if len(meta.Tags) > 0 {
+			fmt.Printf("      Tags: %s\n", strings.Join(meta.Tags, ", "))
+		}
+		if meta.Scoped() {
+			var scope []string
+			if len(meta.Users) > 0 {
+				scope = append(scope, "users "+strings.Join(meta.Users, ", "))
+			}
+			if len(meta.Groups) > 0 {
+				scope = append(scope, "groups "+strings.Join(meta.Groups, ", "))
+			}
+			fmt.Printf("      Scope: %s\n", strings.Join(scope, "; "))
+		}
+		if len(meta.Ranges) > 0 {
+			fmt.Printf("      Ranges: %s\n", strings.Join(meta.Ranges, ", "))
+		}
+		if !meta.CreatedAt.IsZero() {
+			fmt.Printf("      Added: %s by UID %d\n", meta.CreatedAt.Local().Format("2006-01-02 15:04"), meta.CreatedBy)
+		}
+		if meta.ExpiresAt != nil {
+			label := "Expires"
+			if meta.Expired(time.Now()) {
+				label = "Expired"
+			}
+			fmt.Printf("      %s: %s\n", label, meta.ExpiresAt.Local().Format("2006-01-02 15:04"))
+		}
+	}
+}
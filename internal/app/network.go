@@ -0,0 +1,547 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/gajzzs/keyphy/internal/blocker"
+	"github.com/gajzzs/keyphy/internal/blocklist"
+	"github.com/gajzzs/keyphy/internal/config"
+	"github.com/gajzzs/keyphy/internal/matcher"
+)
+
+func NewNetworkCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "network",
+		Short: "Manage the network policy (blocklist or allowlist mode)",
+		DisableFlagsInUseLine: true,
+	}
+
+	cmd.AddCommand(
+		&cobra.Command{
+			Use:   "mode [blocklist|allowlist]",
+			Short: "Block listed websites only, or block every website except allowed ones",
+			Args:  cobra.ExactArgs(1),
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				mode := args[0]
+				if mode != config.NetworkModeBlocklist && mode != config.NetworkModeAllowlist {
+					return fmt.Errorf("invalid network mode %s (use %s or %s)", mode, config.NetworkModeBlocklist, config.NetworkModeAllowlist)
+				}
+				if mode == config.NetworkModeAllowlist && len(config.GetConfig().AllowedWebsites) == 0 {
+					fmt.Println("Warning: no allowed websites configured - all web traffic will be blocked while locked")
+				}
+				if !validateDeviceAuth() {
+					return fmt.Errorf("authentication device not connected or invalid")
+				}
+				return config.SetNetworkMode(mode)
+			},
+		},
+		&cobra.Command{
+			Use:   "allow [domain]",
+			Short: "Allow a website in allowlist mode (e.g. exam.example.com)",
+			Args:  cobra.ExactArgs(1),
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				domain := blocklist.Normalize(args[0])
+				if !blocklist.ValidDomain(domain) {
+					return fmt.Errorf("invalid domain %s", args[0])
+				}
+				if !validateDeviceAuth() {
+					return fmt.Errorf("authentication device not connected or invalid")
+				}
+				return config.AddAllowedWebsite(domain)
+			},
+		},
+		&cobra.Command{
+			Use:   "disallow [domain]",
+			Short: "Remove a website from the allowlist",
+			Args:  cobra.ExactArgs(1),
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				domain := blocklist.Normalize(args[0])
+				if config.IsManaged("allowed", domain) {
+					return fmt.Errorf("'%s' is managed by %s and cannot be removed here", domain, config.Source("allowed", domain))
+				}
+				if !validateDeviceAuth() {
+					return fmt.Errorf("authentication device not connected or invalid")
+				}
+				return config.RemoveAllowedWebsite(domain)
+			},
+		},
+		&cobra.Command{
+			Use:   "backend [auto|iptables|nftables]",
+			Short: "Select the firewall backend used for website blocking",
+			Args:  cobra.ExactArgs(1),
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				backend, err := blocker.ResolveBackend(args[0])
+				if err != nil {
+					return err
+				}
+				if !validateDeviceAuth() {
+					return fmt.Errorf("authentication device not connected or invalid")
+				}
+				if args[0] == blocker.BackendAuto {
+					fmt.Printf("Detected %s on this host\n", backend)
+				}
+				return config.SetFirewallBackend(args[0])
+			},
+		},
+		&cobra.Command{
+			Use:   "quic [all|sites]",
+			Short: "Drop all QUIC (UDP 443) while websites are blocked, or only towards blocked sites",
+			Args:  cobra.ExactArgs(1),
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				mode := args[0]
+				if mode != blocker.QUICBlockAll && mode != blocker.QUICBlockSites {
+					return fmt.Errorf("invalid QUIC mode %s (use %s or %s)", mode, blocker.QUICBlockAll, blocker.QUICBlockSites)
+				}
+				if !validateDeviceAuth() {
+					return fmt.Errorf("authentication device not connected or invalid")
+				}
+				return config.SetQUIC(mode)
+			},
+		},
+		&cobra.Command{
+			Use:   "sni [on|off]",
+			Short: "Inspect the server name of HTTPS handshakes in the daemon while websites are blocked",
+			Args:  cobra.ExactArgs(1),
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				if args[0] != "on" && args[0] != "off" {
+					return fmt.Errorf("invalid value %s (use on or off)", args[0])
+				}
+				if !validateDeviceAuth() {
+					return fmt.Errorf("authentication device not connected or invalid")
+				}
+				return config.SetSNIInspection(args[0] == "on")
+			},
+		},
+		newResolverCommand(),
+		newBrowserPolicyCommand(),
+		newLandingPageCommand(),
+		newCircumventionCommand(),
+		newEncryptedDNSCommand(),
+		&cobra.Command{
+			Use:   "show",
+			Short: "Show the network mode and allowed websites",
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				cfg := config.GetConfig()
+				mode := cfg.NetworkMode
+				if mode == "" {
+					mode = config.NetworkModeBlocklist
+				}
+				fmt.Printf("Network mode: %s\n", mode)
+				backend := cfg.FirewallBackend
+				if backend == "" {
+					backend = blocker.BackendAuto
+				}
+				if resolved, err := blocker.ResolveBackend(backend); err != nil {
+					fmt.Printf("Firewall backend: %s (%v)\n", backend, err)
+				} else {
+					fmt.Printf("Firewall backend: %s (using %s)\n", backend, resolved)
+				}
+				if cfg.QUIC == blocker.QUICBlockSites {
+					fmt.Println("QUIC: dropped towards blocked sites only")
+				} else {
+					fmt.Println("QUIC: all UDP 443 dropped while websites are blocked")
+				}
+				if cfg.Resolver.Enabled {
+					listen := cfg.Resolver.Listen
+					if listen == "" {
+						listen = config.DefaultResolverListen
+					}
+					fmt.Printf("DNS sinkhole: enabled on %s\n", listen)
+				} else {
+					fmt.Println("DNS sinkhole: disabled")
+				}
+				printSNIStatus(cfg)
+				if cfg.LandingPage.Enabled {
+					listen := cfg.LandingPage.Listen
+					if listen == "" {
+						listen = config.DefaultLandingListen
+					}
+					fmt.Printf("Landing page: enabled on http://%s\n", listen)
+				} else {
+					fmt.Println("Landing page: disabled")
+				}
+				if cfg.BrowserPolicy.Enabled {
+					var extras []string
+					if cfg.BrowserPolicy.BlockIncognito {
+						extras = append(extras, "incognito blocked")
+					}
+					if cfg.BrowserPolicy.BlockExtensions {
+						extras = append(extras, "extension installs blocked")
+					}
+					suffix := ""
+					if len(extras) > 0 {
+						suffix = ", " + strings.Join(extras, ", ")
+					}
+					fmt.Printf("Browser policies: enabled (URL blocklist, DoH off%s)\n", suffix)
+				} else {
+					fmt.Println("Browser policies: disabled")
+				}
+				policy := cfg.Circumvention.Policy
+				if policy == "" {
+					policy = config.CircumventionReport
+				}
+				if policy == config.CircumventionExtend {
+					extendBy := cfg.Circumvention.ExtendBy
+					if extendBy == "" {
+						extendBy = config.DefaultLockExtension
+					}
+					policy += " by " + extendBy
+				}
+				fmt.Printf("VPN, proxy and Tor detection: %s\n", policy)
+				fmt.Println("\nBypass protections while websites are blocked:")
+				for _, protection := range blocker.BypassProtections(encryptedDNSList(cfg), resolvedBackend(cfg)) {
+					fmt.Printf("  - %s\n", protection)
+				}
+				fmt.Println("\nAllowed Websites:")
+				for _, website := range cfg.AllowedWebsites {
+					fmt.Printf("  - %s%s\n", website, sourceSuffix("allowed", website))
+				}
+				return nil
+			},
+		},
+	)
+
+	return cmd
+}
+
+func newResolverCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "resolver",
+		Short: "Manage the built-in DNS sinkhole resolver",
+		DisableFlagsInUseLine: true,
+	}
+
+	enableCmd := &cobra.Command{
+		Use:   "enable",
+		Short: "Answer DNS locally while locked, sinkholing blocked names",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			listen, _ := cmd.Flags().GetString("listen")
+			upstreams, _ := cmd.Flags().GetStringSlice("upstream")
+			response, _ := cmd.Flags().GetString("response")
+			if ip := net.ParseIP(listen); ip == nil || !ip.IsLoopback() {
+				return fmt.Errorf("resolver address %s is not a loopback address", listen)
+			}
+			for _, upstream := range upstreams {
+				if net.ParseIP(upstream) == nil {
+					if _, _, err := net.SplitHostPort(upstream); err != nil {
+						return fmt.Errorf("invalid upstream %s (use an IP address, optionally with :port)", upstream)
+					}
+				}
+			}
+			if !validateDeviceAuth() {
+				return fmt.Errorf("authentication device not connected or invalid")
+			}
+			return config.SetResolver(config.Resolver{
+				Enabled:   true,
+				Listen:    listen,
+				Upstreams: upstreams,
+				Response:  response,
+			})
+		},
+	}
+	enableCmd.Flags().String("listen", config.DefaultResolverListen, "Loopback address to serve DNS on")
+	enableCmd.Flags().StringSlice("upstream", nil, "Upstream DNS server (repeatable, defaults to the system nameservers)")
+	enableCmd.Flags().String("response", config.ResolverNXDomain, "Answer for blocked names: nxdomain or zero")
+
+	cmd.AddCommand(
+		enableCmd,
+		&cobra.Command{
+			Use:   "disable",
+			Short: "Stop the DNS sinkhole and restore the system resolver",
+			Args:  cobra.NoArgs,
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				if !validateDeviceAuth() {
+					return fmt.Errorf("authentication device not connected or invalid")
+				}
+				return config.SetResolver(config.Resolver{})
+			},
+		},
+	)
+
+	return cmd
+}
+
+func printSNIStatus(cfg *config.Config) {
+	if !cfg.SNIInspection {
+		fmt.Println("SNI inspection: disabled")
+		return
+	}
+	fmt.Printf("SNI inspection: enabled on netfilter queue %d\n", blocker.SNIQueue)
+	stats, err := config.LoadSNIStats()
+	if err != nil || stats.Since.IsZero() {
+		return
+	}
+	fmt.Printf("  Since %s: %d handshakes inspected, %d blocked, %d unreadable, %d receive overflows\n",
+		stats.Since.Local().Format("2006-01-02 15:04"), stats.Inspected, stats.Blocked, stats.Unparsed, stats.Overflows)
+	rules := make([]string, 0, len(stats.Rules))
+	for rule := range stats.Rules {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	for _, rule := range rules {
+		fmt.Printf("  - %s: %d blocked\n", rule, stats.Rules[rule])
+	}
+}
+
+func newBrowserPolicyCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "browser-policy",
+		Short: "Manage Chrome, Chromium and Firefox policies written while websites are blocked",
+		DisableFlagsInUseLine: true,
+	}
+
+	enableCmd := &cobra.Command{
+		Use:   "enable",
+		Short: "Block websites inside browsers and turn off their built-in DoH while locked",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			incognito, _ := cmd.Flags().GetBool("block-incognito")
+			extensions, _ := cmd.Flags().GetBool("block-extensions")
+			if !validateDeviceAuth() {
+				return fmt.Errorf("authentication device not connected or invalid")
+			}
+			return config.SetBrowserPolicy(config.BrowserPolicy{
+				Enabled:         true,
+				BlockIncognito:  incognito,
+				BlockExtensions: extensions,
+			})
+		},
+	}
+	enableCmd.Flags().Bool("block-incognito", false, "Disable incognito and private windows")
+	enableCmd.Flags().Bool("block-extensions", false, "Block installing browser extensions")
+
+	cmd.AddCommand(
+		enableCmd,
+		&cobra.Command{
+			Use:   "disable",
+			Short: "Stop writing browser policies",
+			Args:  cobra.NoArgs,
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				if !validateDeviceAuth() {
+					return fmt.Errorf("authentication device not connected or invalid")
+				}
+				return config.SetBrowserPolicy(config.BrowserPolicy{})
+			},
+		},
+	)
+
+	return cmd
+}
+
+func newLandingPageCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "landing-page",
+		Short: "Manage the page shown instead of blocked websites",
+		DisableFlagsInUseLine: true,
+	}
+
+	enableCmd := &cobra.Command{
+		Use:   "enable",
+		Short: "Serve a \"blocked by keyphy\" page for blocked sites over HTTP",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			listen, _ := cmd.Flags().GetString("listen")
+			// Hosts entries map blocked names to it, so it must be IPv4
+			if ip := net.ParseIP(listen); ip == nil || ip.To4() == nil || !ip.IsLoopback() {
+				return fmt.Errorf("landing page address %s is not an IPv4 loopback address", listen)
+			}
+			if listen == "127.0.0.1" {
+				return fmt.Errorf("landing page needs its own loopback address, not 127.0.0.1")
+			}
+			if !validateDeviceAuth() {
+				return fmt.Errorf("authentication device not connected or invalid")
+			}
+			return config.SetLandingPage(config.LandingPage{Enabled: true, Listen: listen})
+		},
+	}
+	enableCmd.Flags().String("listen", config.DefaultLandingListen, "Loopback address to serve the page on")
+
+	cmd.AddCommand(
+		enableCmd,
+		&cobra.Command{
+			Use:   "disable",
+			Short: "Stop serving the landing page",
+			Args:  cobra.NoArgs,
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				if !validateDeviceAuth() {
+					return fmt.Errorf("authentication device not connected or invalid")
+				}
+				return config.SetLandingPage(config.LandingPage{})
+			},
+		},
+	)
+
+	return cmd
+}
+
+func newCircumventionCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "circumvention [off|report|block|extend]",
+		Short: "Choose what happens when a VPN, proxy or Tor is detected while locked",
+		Long: `While anything is blocked the daemon watches for VPN interfaces, proxy and
+VPN client processes, SSH SOCKS tunnels, Tor ports and changed proxy settings.
+Every detection is written to the audit log.
+
+  off     do not look for circumvention
+  report  only audit detections (default)
+  block   also drop traffic through VPN interfaces, reject Tor ports and
+          terminate proxy processes
+  extend  also hold every block for --extend-by, over timed unlocks and
+          schedule ends`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			extendBy, _ := cmd.Flags().GetString("extend-by")
+			policy := config.Circumvention{Policy: args[0]}
+			if args[0] == config.CircumventionExtend {
+				policy.ExtendBy = extendBy
+			}
+			if !validateDeviceAuth() {
+				return fmt.Errorf("authentication device not connected or invalid")
+			}
+			return config.SetCircumvention(policy)
+		},
+	}
+	cmd.Flags().String("extend-by", config.DefaultLockExtension, "How long to hold the lock after a detection with the extend policy")
+	return cmd
+}
+
+func newEncryptedDNSCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "encrypted-dns",
+		Short: "Show or change the DoH, DoT and DoQ resolvers blocked while websites are locked",
+		Args:  cobra.NoArgs,
+		DisableFlagsInUseLine: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg := config.GetConfig()
+			list := encryptedDNSList(cfg)
+			if cfg.EncryptedDNS.NoDefaults {
+				fmt.Println("Built-in list: disabled")
+			} else {
+				fmt.Println("Built-in list: enabled")
+			}
+			fmt.Println("\nProtections while websites are blocked:")
+			for _, protection := range blocker.BypassProtections(list, resolvedBackend(cfg)) {
+				fmt.Printf("  - %s\n", protection)
+			}
+			fmt.Println("\nBlocked addresses:")
+			for _, address := range list.Addresses {
+				fmt.Printf("  - %s\n", address)
+			}
+			fmt.Println("\nBlocked hostnames:")
+			for _, host := range list.Hosts {
+				fmt.Printf("  - %s\n", host)
+			}
+			return nil
+		},
+	}
+
+	cmd.AddCommand(
+		&cobra.Command{
+			Use:   "add [address|cidr|hostname]",
+			Short: "Block another encrypted DNS resolver",
+			Args:  cobra.ExactArgs(1),
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				server := blocklist.Normalize(args[0])
+				if !validEncryptedDNSServer(server) {
+					return fmt.Errorf("invalid resolver %s (use an IP address, CIDR or hostname)", args[0])
+				}
+				if !validateDeviceAuth() {
+					return fmt.Errorf("authentication device not connected or invalid")
+				}
+				return config.AddEncryptedDNSServer(server)
+			},
+		},
+		&cobra.Command{
+			Use:   "remove [address|cidr|hostname]",
+			Short: "Stop blocking a resolver added with add",
+			Args:  cobra.ExactArgs(1),
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				if !validateDeviceAuth() {
+					return fmt.Errorf("authentication device not connected or invalid")
+				}
+				return config.RemoveEncryptedDNSServer(blocklist.Normalize(args[0]))
+			},
+		},
+		&cobra.Command{
+			Use:   "defaults [on|off]",
+			Short: "Include the built-in resolver list, or block only added resolvers",
+			Args:  cobra.ExactArgs(1),
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				if args[0] != "on" && args[0] != "off" {
+					return fmt.Errorf("invalid value %s (use on or off)", args[0])
+				}
+				if !validateDeviceAuth() {
+					return fmt.Errorf("authentication device not connected or invalid")
+				}
+				return config.SetEncryptedDNSDefaults(args[0] == "on")
+			},
+		},
+	)
+
+	return cmd
+}
+
+// encryptedDNSList returns the encrypted DNS resolvers blocked by cfg.
+func encryptedDNSList(cfg *config.Config) blocker.EncryptedDNS {
+	extra := blocker.EncryptedDNS{Addresses: cfg.EncryptedDNS.Addresses, Hosts: cfg.EncryptedDNS.Hosts}
+	return blocker.MergeEncryptedDNS(extra, !cfg.EncryptedDNS.NoDefaults)
+}
+
+func validEncryptedDNSServer(server string) bool {
+	if net.ParseIP(server) != nil {
+		return true
+	}
+	if _, _, err := net.ParseCIDR(server); err == nil {
+		return true
+	}
+	return blocklist.ValidDomain(server)
+}
+
+// resolvedBackend returns the firewall backend the daemon will use.
+func resolvedBackend(cfg *config.Config) string {
+	backend, err := blocker.ResolveBackend(cfg.FirewallBackend)
+	if err != nil {
+		return blocker.BackendIptables
+	}
+	return backend
+}
+
+func NewCheckCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "check [domain]",
+		Short: "Show which website rule, if any, blocks a domain",
+		Args:  cobra.ExactArgs(1),
+		DisableFlagsInUseLine: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			m, errs := matcher.New(config.GetConfig().BlockedWebsites)
+			for _, err := range errs {
+				fmt.Printf("Warning: skipping invalid rule: %v\n", err)
+			}
+			rule, ok := m.Match(args[0])
+			if !ok {
+				fmt.Printf("%s is not blocked by any website rule\n", args[0])
+				return nil
+			}
+			fmt.Printf("%s is blocked by rule %s (%s)%s\n", args[0], rule, rule.Kind(), sourceSuffix("website", rule.String()))
+			return nil
+		},
+	}
+}
@@ -0,0 +1,164 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/gajzzs/keyphy/internal/config"
+	"github.com/gajzzs/keyphy/internal/schedule"
+	"github.com/gajzzs/keyphy/internal/service"
+)
+
+func NewQuotaCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "quota",
+		Short: "Manage daily usage budgets for apps and websites",
+		DisableFlagsInUseLine: true,
+	}
+
+	newAddCmd := func(kind, use, short string) *cobra.Command {
+		addCmd := &cobra.Command{
+			Use:   use,
+			Short: short,
+			Args:  cobra.ExactArgs(1),
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				limit, _ := cmd.Flags().GetDuration("limit")
+				days, _ := cmd.Flags().GetString("days")
+				if limit <= 0 {
+					return fmt.Errorf("--limit must be a positive duration (e.g. 45m, 2h)")
+				}
+				if _, err := schedule.Parse([]string{days}, "00:00", "24:00", ""); err != nil {
+					return err
+				}
+
+				if !validateDeviceAuth() {
+					return fmt.Errorf("authentication device not connected or invalid")
+				}
+				quota := config.Quota{
+					Kind:  kind,
+					Item:  args[0],
+					Limit: limit.String(),
+					Days:  []string{days},
+				}
+				if err := config.AddQuota(quota); err != nil {
+					return err
+				}
+				fmt.Printf("'%s' may now be used for %s per day (%s)\n", args[0], limit, days)
+				return nil
+			},
+		}
+		addCmd.Flags().Duration("limit", 0, "Daily budget (e.g. 45m, 2h)")
+		addCmd.Flags().String("days", "daily", "Days the budget applies to (e.g. weekends, mon-fri)")
+		addCmd.MarkFlagRequired("limit")
+		return addCmd
+	}
+
+	addCmd := &cobra.Command{
+		Use:   "add",
+		Short: "Add a daily budget for an app or website",
+		DisableFlagsInUseLine: true,
+	}
+	addCmd.AddCommand(
+		newAddCmd("app", "app [application-name]", "Add a daily budget for an application (e.g. steam --limit 2h --days weekends)"),
+		newAddCmd("website", "website [domain]", "Add a daily budget for a website (e.g. youtube.com --limit 45m)"),
+	)
+
+	newRemoveCmd := func(kind, use, short string) *cobra.Command {
+		return &cobra.Command{
+			Use:   use,
+			Short: short,
+			Args:  cobra.ExactArgs(1),
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				if !validateDeviceAuth() {
+					return fmt.Errorf("authentication device not connected or invalid")
+				}
+				return config.RemoveQuota(kind, args[0])
+			},
+		}
+	}
+
+	removeCmd := &cobra.Command{
+		Use:   "remove",
+		Short: "Remove the budget for an app or website",
+		DisableFlagsInUseLine: true,
+	}
+	removeCmd.AddCommand(
+		newRemoveCmd("app", "app [application-name]", "Remove the daily budget for an application"),
+		newRemoveCmd("website", "website [domain]", "Remove the daily budget for a website"),
+	)
+
+	cmd.AddCommand(
+		addCmd,
+		removeCmd,
+		&cobra.Command{
+			Use:   "reset-time [HH:MM]",
+			Short: "Set the time of day when usage counters reset",
+			Args:  cobra.ExactArgs(1),
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				if _, err := time.Parse("15:04", args[0]); err != nil {
+					return fmt.Errorf("invalid time %s, expected HH:MM", args[0])
+				}
+				if !validateDeviceAuth() {
+					return fmt.Errorf("authentication device not connected or invalid")
+				}
+				return config.SetQuotaResetTime(args[0])
+			},
+		},
+	)
+
+	return cmd
+}
+
+func NewUsageCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "usage",
+		Short: "Show today's usage of apps and websites with a quota",
+		DisableFlagsInUseLine: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg := config.GetConfig()
+			if len(cfg.Quotas) == 0 {
+				fmt.Println("No quotas configured")
+				return nil
+			}
+
+			usage, err := config.LoadUsage()
+			if err != nil {
+				return fmt.Errorf("failed to read usage counters: %v", err)
+			}
+
+			now := time.Now()
+			periodStart := service.QuotaPeriodStart(cfg.QuotaResetTime, now)
+			if !usage.PeriodStart.Equal(periodStart) {
+				// Counters from an earlier period; the daemon resets them on its next tick
+				usage.Seconds = map[string]int64{}
+			}
+
+			fmt.Printf("Usage since %s (resets at %s):\n", periodStart.Format("Mon 15:04"), periodStart.AddDate(0, 0, 1).Format("Mon 15:04"))
+			for _, quota := range cfg.Quotas {
+				used := time.Duration(usage.Seconds[quota.Key()]) * time.Second
+				days := strings.Join(quota.Days, ",")
+				if !service.QuotaAppliesOn(quota, now) {
+					fmt.Printf("  - %s (%s): no budget today (%s %s)\n", quota.Item, quota.Kind, quota.Limit, days)
+					continue
+				}
+
+				limit, err := time.ParseDuration(quota.Limit)
+				if err != nil {
+					fmt.Printf("  - %s (%s): invalid limit %s\n", quota.Item, quota.Kind, quota.Limit)
+					continue
+				}
+				status := fmt.Sprintf("%s left", (limit - used).Round(time.Minute))
+				if used >= limit {
+					status = "used up, blocked"
+				}
+				fmt.Printf("  - %s (%s): %s of %s used, %s\n", quota.Item, quota.Kind, used.Round(time.Minute), limit, status)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,237 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/gajzzs/keyphy/internal/config"
+	"github.com/gajzzs/keyphy/internal/schedule"
+)
+
+func NewScheduleCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "schedule",
+		Short: "Manage time windows that lock blocks automatically",
+		DisableFlagsInUseLine: true,
+	}
+
+	addCmd := &cobra.Command{
+		Use:   "add [name]",
+		Short: "Add a weekly lock window (e.g. --days mon-fri --from 09:00 --to 17:00)",
+		Args:  cobra.ExactArgs(1),
+		DisableFlagsInUseLine: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			days, _ := cmd.Flags().GetString("days")
+			from, _ := cmd.Flags().GetString("from")
+			to, _ := cmd.Flags().GetString("to")
+			timezone, _ := cmd.Flags().GetString("tz")
+			profile, _ := cmd.Flags().GetString("profile")
+			items, _ := cmd.Flags().GetStringSlice("item")
+
+			sched := config.Schedule{
+				Name:     args[0],
+				Days:     []string{days},
+				Start:    from,
+				End:      to,
+				Timezone: timezone,
+				Profile:  profile,
+				Items:    items,
+			}
+			window, err := schedule.Parse(sched.Days, sched.Start, sched.End, sched.Timezone)
+			if err != nil {
+				return err
+			}
+
+			if !validateDeviceAuth() {
+				return fmt.Errorf("authentication device not connected or invalid")
+			}
+			if err := config.AddSchedule(sched); err != nil {
+				return err
+			}
+			fmt.Printf("Schedule '%s' added: %s, targets: %s\n", sched.Name, window, scheduleTargets(sched))
+			return nil
+		},
+	}
+	addCmd.Flags().String("days", "daily", "Days the window applies to (e.g. mon-fri, sat,sun, weekdays, daily)")
+	addCmd.Flags().String("from", "", "Window start time (HH:MM)")
+	addCmd.Flags().String("to", "", "Window end time (HH:MM, 24:00 for end of day)")
+	addCmd.Flags().String("tz", "", "IANA timezone for the window (default: system timezone)")
+	addCmd.Flags().String("profile", "", "Profile whose items the window locks")
+	addCmd.Flags().StringSlice("item", nil, "Blocked item the window locks (repeatable)")
+	addCmd.MarkFlagRequired("from")
+	addCmd.MarkFlagRequired("to")
+
+	cmd.AddCommand(
+		addCmd,
+		&cobra.Command{
+			Use:   "remove [name]",
+			Short: "Remove a schedule",
+			Args:  cobra.ExactArgs(1),
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				if !validateDeviceAuth() {
+					return fmt.Errorf("authentication device not connected or invalid")
+				}
+				return config.RemoveSchedule(args[0])
+			},
+		},
+		&cobra.Command{
+			Use:   "list",
+			Short: "List schedules and whether they are currently active",
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				cfg := config.GetConfig()
+				if len(cfg.Schedules) == 0 {
+					fmt.Println("No schedules configured")
+					return nil
+				}
+
+				now := time.Now()
+				fmt.Println("Schedules:")
+				for _, sched := range cfg.Schedules {
+					window, err := schedule.Parse(sched.Days, sched.Start, sched.End, sched.Timezone)
+					if err != nil {
+						fmt.Printf("  - %s: invalid (%v)\n", sched.Name, err)
+						continue
+					}
+					state := "inactive"
+					if window.ActiveAt(now) {
+						state = "active"
+					}
+					fmt.Printf("  - %s: %s [%s]%s\n", sched.Name, window, state, sourceSuffix("schedule", sched.Name))
+					fmt.Printf("    Targets: %s\n", scheduleTargets(sched))
+				}
+				return nil
+			},
+		},
+		&cobra.Command{
+			Use:   "next",
+			Short: "Show upcoming schedule transitions",
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				type transition struct {
+					at     time.Time
+					name   string
+					starts bool
+				}
+
+				now := time.Now()
+				var transitions []transition
+				for _, sched := range config.GetConfig().Schedules {
+					window, err := schedule.Parse(sched.Days, sched.Start, sched.End, sched.Timezone)
+					if err != nil {
+						continue
+					}
+					// Show the next opening and closing of every window
+					at := now
+					for i := 0; i < 2; i++ {
+						next, ok := window.NextTransition(at)
+						if !ok {
+							break
+						}
+						transitions = append(transitions, transition{next, sched.Name, window.ActiveAt(next)})
+						at = next
+					}
+				}
+
+				if len(transitions) == 0 {
+					fmt.Println("No upcoming schedule transitions")
+					return nil
+				}
+				sort.Slice(transitions, func(i, j int) bool {
+					return transitions[i].at.Before(transitions[j].at)
+				})
+
+				fmt.Println("Upcoming transitions:")
+				for _, t := range transitions {
+					// Other windows or blocks may keep the daemon locked
+					// past a closing, so only the window is described
+					action := "window closes"
+					if t.starts {
+						action = "window opens"
+					}
+					fmt.Printf("  %s  %s %s (in %s)\n", t.at.Local().Format("Mon 2006-01-02 15:04 MST"), t.name, action, t.at.Sub(now).Round(time.Minute))
+				}
+				return nil
+			},
+		},
+	)
+
+	return cmd
+}
+
+func NewProfileCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "profile",
+		Short: "Manage named groups of blocked items",
+		DisableFlagsInUseLine: true,
+	}
+
+	cmd.AddCommand(
+		&cobra.Command{
+			Use:   "set [name] [item...]",
+			Short: "Create or replace a profile (e.g. profile set social youtube.com reddit.com)",
+			Args:  cobra.MinimumNArgs(2),
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				if !validateDeviceAuth() {
+					return fmt.Errorf("authentication device not connected or invalid")
+				}
+				return config.SetProfile(args[0], args[1:])
+			},
+		},
+		&cobra.Command{
+			Use:   "remove [name]",
+			Short: "Remove a profile",
+			Args:  cobra.ExactArgs(1),
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				if !validateDeviceAuth() {
+					return fmt.Errorf("authentication device not connected or invalid")
+				}
+				return config.RemoveProfile(args[0])
+			},
+		},
+		&cobra.Command{
+			Use:   "list",
+			Short: "List profiles",
+			DisableFlagsInUseLine: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				profiles := config.GetConfig().Profiles
+				if len(profiles) == 0 {
+					fmt.Println("No profiles configured")
+					return nil
+				}
+
+				var names []string
+				for name := range profiles {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+
+				fmt.Println("Profiles:")
+				for _, name := range names {
+					fmt.Printf("  - %s: %s%s\n", name, strings.Join(profiles[name], ", "), sourceSuffix("profile", name))
+				}
+				return nil
+			},
+		},
+	)
+
+	return cmd
+}
+
+func scheduleTargets(sched config.Schedule) string {
+	var targets []string
+	if sched.Profile != "" {
+		targets = append(targets, "profile "+sched.Profile)
+	}
+	targets = append(targets, sched.Items...)
+	if len(targets) == 0 {
+		return "all blocked items"
+	}
+	return strings.Join(targets, ", ")
+}
@@ -0,0 +1,221 @@
+package blocker
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/gajzzs/keyphy/internal/matcher"
+	"github.com/gajzzs/keyphy/internal/resolver"
+)
+
+// Blocked domains are resolved periodically and every address seen is
+// blocked until its TTL runs out, so browsers with cached answers or
+// encrypted ClientHellos are caught by address as well as by name.
+const (
+	// minAddressTTL keeps short lived answers blocked long enough to cover
+	// clients that cache beyond the TTL.
+	minAddressTTL      = 5 * time.Minute
+	minResolveInterval = time.Minute
+	maxResolveInterval = time.Hour
+)
+
+// resolvedDomain tracks the addresses of one blocked rule.
+type resolvedDomain struct {
+	expires     map[string]time.Time
+	nextResolve time.Time
+}
+
+// resolveDomain refreshes the addresses of rule and drops the ones whose
+// TTL has passed.
+func (nb *NetworkBlocker) resolveDomain(rule *matcher.Rule, now time.Time) {
+	state, ok := nb.resolved[rule.String()]
+	if !ok {
+		state = &resolvedDomain{expires: make(map[string]time.Time)}
+		nb.resolved[rule.String()] = state
+	}
+
+	interval := maxResolveInterval
+	addrs := nb.lookupAddresses(rule.HostsNames())
+	for _, addr := range addrs {
+		ttl := addr.TTL
+		if ttl < minAddressTTL {
+			ttl = minAddressTTL
+		}
+		ip := addr.IP.String()
+		if expiry := now.Add(ttl); expiry.After(state.expires[ip]) {
+			state.expires[ip] = expiry
+		}
+		if addr.TTL < interval {
+			interval = addr.TTL
+		}
+	}
+	if len(addrs) == 0 {
+		// Retry soon after failures or empty answers
+		interval = minAddressTTL
+	}
+	if interval < minResolveInterval {
+		interval = minResolveInterval
+	}
+	state.nextResolve = now.Add(interval)
+
+	for ip, expiry := range state.expires {
+		if !expiry.After(now) {
+			delete(state.expires, ip)
+		}
+	}
+}
+
+// liveAddresses returns the addresses of domain that are still blocked.
+func (nb *NetworkBlocker) liveAddresses(domain string) []string {
+	state, ok := nb.resolved[domain]
+	if !ok {
+		return nil
+	}
+	var ips []string
+	for ip := range state.expires {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// AddressLookup holds the DNS answers for one refresh. Lookups can take
+// seconds, so they are resolved apart from the blocker and only the
+// answers are applied under the caller's lock.
+type AddressLookup struct {
+	domains      []string
+	encryptedDNS bool
+	allowlist    bool
+	names        []string
+	lookup       Resolver
+	answers      map[string][]resolver.Address
+}
+
+// PendingLookups returns the names RefreshAddresses and RefreshAllowlist
+// need resolved now.
+func (nb *NetworkBlocker) PendingLookups() *AddressLookup {
+	now := time.Now()
+	l := &AddressLookup{lookup: nb.lookup}
+	for domain := range nb.blockedDomains {
+		if state, ok := nb.resolved[domain]; ok && now.Before(state.nextResolve) {
+			continue
+		}
+		rule, err := matcher.Parse(domain)
+		if err != nil {
+			continue
+		}
+		l.domains = append(l.domains, domain)
+		l.names = append(l.names, rule.HostsNames()...)
+	}
+	if nb.bypassActive && len(nb.encryptedDNS.Hosts) > 0 && now.Sub(nb.bypassResolved) >= encryptedDNSRefresh {
+		l.encryptedDNS = true
+		l.names = append(l.names, nb.encryptedDNS.Hosts...)
+	}
+	if nb.allowActive && now.Sub(nb.allowRefreshed) >= allowlistRefreshInterval {
+		l.allowlist = true
+		for _, domain := range nb.allowedDomains {
+			l.names = append(l.names, domain, "www."+domain)
+		}
+	}
+	return l
+}
+
+// Resolve looks up the pending names. It does not touch the blocker, so it
+// is safe to call without holding its lock.
+func (l *AddressLookup) Resolve() {
+	l.answers = make(map[string][]resolver.Address)
+	for _, name := range l.names {
+		if _, ok := l.answers[name]; ok {
+			continue
+		}
+		addrs, _ := l.lookup(name)
+		l.answers[name] = addrs
+	}
+}
+
+// cached answers a lookup from the resolved names only.
+func (l *AddressLookup) cached(name string) ([]resolver.Address, error) {
+	return l.answers[name], nil
+}
+
+// withLookup runs apply with lookups answered from l. nb.lookup itself is
+// left alone, since HasActiveConnections reads it without the lock.
+func (nb *NetworkBlocker) withLookup(l *AddressLookup, apply func() error) error {
+	nb.pending = l
+	defer func() { nb.pending = nil }()
+	return apply()
+}
+
+// RefreshAddresses updates the firewall rules of the blocked domains that
+// were due when l was prepared, using its answers.
+func (nb *NetworkBlocker) RefreshAddresses(l *AddressLookup) error {
+	return nb.withLookup(l, func() error {
+		var firstErr error
+		for _, domain := range l.domains {
+			if !nb.blockedDomains[domain] {
+				continue
+			}
+			rule, err := matcher.Parse(domain)
+			if err != nil {
+				continue
+			}
+			if err := nb.blockDNS(rule); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		if l.encryptedDNS && nb.bypassActive {
+			if err := nb.blockEncryptedDNS(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	})
+}
+
+// lookupUpstream resolves name straight at the upstream nameservers, so our
+// own hosts entries and the DNS sinkhole do not hide the real addresses.
+func lookupUpstream(name string) ([]resolver.Address, error) {
+	found, err := resolver.LookupAddresses(name)
+	if err == nil {
+		return found, nil
+	}
+	// Fall back to the system resolver, which reports no TTL
+	ips, err := net.LookupIP(name)
+	if err != nil {
+		return nil, err
+	}
+	found = nil
+	for _, ip := range ips {
+		found = append(found, resolver.Address{IP: ip, TTL: minAddressTTL})
+	}
+	return found, nil
+}
+
+// lookupAddresses resolves names with their TTLs, skipping loopback and
+// unspecified answers.
+func (nb *NetworkBlocker) lookupAddresses(names []string) []resolver.Address {
+	var addrs []resolver.Address
+	lookup := nb.lookup
+	if nb.pending != nil {
+		lookup = nb.pending.cached
+	}
+	for _, name := range names {
+		found, _ := lookup(name)
+		for _, addr := range found {
+			if !addr.IP.IsLoopback() && !addr.IP.IsUnspecified() {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// resolveAddresses returns the public IPv4 and IPv6 addresses of names.
+func (nb *NetworkBlocker) resolveAddresses(names []string) []string {
+	var ips []string
+	for _, addr := range nb.lookupAddresses(names) {
+		ips = append(ips, addr.IP.String())
+	}
+	return ips
+}
@@ -0,0 +1,126 @@
+package blocker
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Allowlist mode denies all outbound web traffic except to the resolved
+// addresses of approved domains. Updates replace the old policy in one
+// firewall transaction, so there is never a moment without one in place.
+const allowlistRefreshInterval = 5 * time.Minute
+
+// EnableAllowlist switches to allowlist mode for the given domains, or
+// updates the allowed domains if the mode is already active. upstreams are
+// the nameservers the daemon forwards to, as host or host:port; root may
+// reach them on their port and nowhere else.
+func (nb *NetworkBlocker) EnableAllowlist(domains, upstreams []string) error {
+	sorted := append([]string{}, domains...)
+	sort.Strings(sorted)
+	if nb.allowActive && strings.Join(sorted, ",") == strings.Join(nb.allowedDomains, ",") && equalStrings(upstreams, nb.allowUpstreams) {
+		return nil
+	}
+	if !nb.allowActive {
+		nb.pinnedIPs = make(map[string]bool)
+	}
+	nb.allowedDomains = sorted
+	nb.allowUpstreams = upstreams
+	return nb.rebuildAllowlist()
+}
+
+// RefreshAllowlist pins the addresses the allowed domains resolved to in l
+// periodically, so changing CDN addresses keep working.
+func (nb *NetworkBlocker) RefreshAllowlist(l *AddressLookup) error {
+	if !l.allowlist || !nb.allowActive {
+		return nil
+	}
+	return nb.withLookup(l, nb.rebuildAllowlist)
+}
+
+// DisableAllowlist returns to normal blocklist behaviour.
+func (nb *NetworkBlocker) DisableAllowlist() error {
+	if !nb.allowActive {
+		return nil
+	}
+	fmt.Println("Disabling allowlist mode...")
+	err := nb.fw.Remove(nb.allowRules...)
+	nb.allowRules = nil
+	nb.allowActive = false
+	nb.allowedDomains = nil
+	nb.allowUpstreams = nil
+	nb.pinnedIPs = nil
+	return err
+}
+
+func (nb *NetworkBlocker) AllowlistActive() bool {
+	return nb.allowActive
+}
+
+func (nb *NetworkBlocker) rebuildAllowlist() error {
+	// Addresses stay pinned for the whole session, so connections opened
+	// before a DNS change are not cut off
+	for _, domain := range nb.allowedDomains {
+		for _, ip := range nb.resolveAddresses([]string{domain, "www." + domain}) {
+			nb.pinnedIPs[ip] = true
+		}
+	}
+
+	var ips []string
+	for ip := range nb.pinnedIPs {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	rules := allowlistRules(ips, nb.allowUpstreams)
+	if err := nb.fw.Replace(nb.allowRules, rules); err != nil {
+		return err
+	}
+	nb.allowRules = rules
+
+	nb.allowActive = true
+	nb.allowRefreshed = time.Now()
+	fmt.Printf("Allowlist active: %d domain(s), %d pinned address(es)\n", len(nb.allowedDomains), len(nb.pinnedIPs))
+	return nil
+}
+
+func allowlistRules(ips, upstreams []string) []Rule {
+	rules := []Rule{
+		// Never break local services
+		{OutIface: "lo", Action: Accept},
+		// DNS keeps working so allowed domains resolve; other names resolve
+		// too but their addresses are dropped below
+		{Proto: "udp", DPorts: []int{53}, Action: Accept},
+		{Proto: "tcp", DPorts: []int{53}, Action: Accept},
+	}
+	// The daemon runs as root and forwards sinkhole queries to the
+	// upstreams, which may listen on another port. Other root traffic is
+	// filtered like everyone else's.
+	for _, upstream := range upstreams {
+		host, port := upstream, 53
+		if h, p, err := net.SplitHostPort(upstream); err == nil {
+			host = h
+			if n, err := strconv.Atoi(p); err == nil {
+				port = n
+			}
+		}
+		if net.ParseIP(host) == nil || port == 53 {
+			continue
+		}
+		for _, proto := range []string{"udp", "tcp"} {
+			rules = append(rules, Rule{Proto: proto, Dest: host, DPorts: []int{port}, UIDOwner: "0", Action: Accept})
+		}
+	}
+	for _, ip := range ips {
+		rules = append(rules, Rule{Dest: ip, Action: Accept})
+	}
+	for i := range rules {
+		rules[i].Priority = priorityAllowlist
+	}
+	return append(rules,
+		Rule{Priority: priorityAllowlistDeny, Proto: "tcp", DPorts: []int{80, 443}, Action: Reject},
+		Rule{Priority: priorityAllowlistDeny, Proto: "udp", DPorts: []int{443}, Action: Drop},
+	)
+}
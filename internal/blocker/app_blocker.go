@@ -9,30 +9,49 @@ import (
 	"syscall"
 )
 
+// AppBlocker stops blocked apps from running. With the exec guard started,
+// fanotify denies executing them; otherwise their binary is replaced with
+// a wrapper script.
 type AppBlocker struct {
 	blockedApps map[string]bool
+	guard       *execGuard
+	targets     map[string]execTarget
+	// OnDenied, if set, is called for every execution the guard denies. It
+	// runs on a goroutine of its own.
+	OnDenied func(app, path string, pid int)
 }
 
 func NewAppBlocker() *AppBlocker {
 	return &AppBlocker{
 		blockedApps: make(map[string]bool),
+		targets:     make(map[string]execTarget),
 	}
 }
 
 func (ab *AppBlocker) BlockApp(appName string) error {
 	ab.blockedApps[appName] = true
+	if ab.guard != nil {
+		// Relaunches are denied before running copies are killed
+		if err := ab.guardApp(appName); err != nil {
+			return err
+		}
+	}
 	
 	// Kill existing processes
 	if err := ab.killProcesses(appName); err != nil {
 		return fmt.Errorf("failed to kill existing processes: %v", err)
 	}
 	
+	if ab.guard != nil {
+		return nil
+	}
 	// Set up D-Bus monitoring for new launches
 	return ab.setupDBusMonitoring(appName)
 }
 
 func (ab *AppBlocker) UnblockApp(appName string) error {
 	delete(ab.blockedApps, appName)
+	ab.unguardApp(appName)
 	return ab.restoreOriginalExecutable(appName)
 }
 
@@ -96,46 +115,9 @@ func (ab *AppBlocker) setupDBusMonitoring(appName string) error {
 }
 
 func (ab *AppBlocker) createBlockingWrapper(appName string) error {
-	var execPath string
-	var displayName string
-	
-	// Check if appName contains custom path (format: "name:path")
-	if strings.Contains(appName, ":") {
-		parts := strings.SplitN(appName, ":", 2)
-		displayName = parts[0]
-		execPath = parts[1]
-		if _, err := os.Stat(execPath); err != nil {
-			return fmt.Errorf("custom executable path %s not found", execPath)
-		}
-	} else if strings.HasPrefix(appName, "/") {
-		// Full path provided directly
-		execPath = appName
-		displayName = filepath.Base(appName)
-		if _, err := os.Stat(execPath); err != nil {
-			return fmt.Errorf("executable path %s not found", execPath)
-		}
-	} else {
-		// Find the actual executable path
-		displayName = appName
-		var err error
-		execPath, err = exec.LookPath(appName)
-		if err != nil {
-			// App not found in PATH, try common locations
-			commonPaths := []string{
-				"/usr/bin/" + appName,
-				"/usr/local/bin/" + appName,
-				"/snap/bin/" + appName,
-			}
-			for _, path := range commonPaths {
-				if _, err := os.Stat(path); err == nil {
-					execPath = path
-					break
-				}
-			}
-			if execPath == "" {
-				return fmt.Errorf("executable %s not found", appName)
-			}
-		}
+	displayName, execPath, err := findExecutable(appName)
+	if err != nil {
+		return err
 	}
 	
 	// Backup original executable
@@ -226,4 +208,51 @@ func (ab *AppBlocker) GetRunningProcesses(appName string) ([]int, error) {
 	}
 	
 	return pids, nil
+}
+
+// findExecutable returns the display name and executable path of an app
+// given by name, full path or name:path.
+func findExecutable(appName string) (string, string, error) {
+	var execPath string
+	var displayName string
+	
+	// Check if appName contains custom path (format: "name:path")
+	if strings.Contains(appName, ":") {
+		parts := strings.SplitN(appName, ":", 2)
+		displayName = parts[0]
+		execPath = parts[1]
+		if _, err := os.Stat(execPath); err != nil {
+			return "", "", fmt.Errorf("custom executable path %s not found", execPath)
+		}
+	} else if strings.HasPrefix(appName, "/") {
+		// Full path provided directly
+		execPath = appName
+		displayName = filepath.Base(appName)
+		if _, err := os.Stat(execPath); err != nil {
+			return "", "", fmt.Errorf("executable path %s not found", execPath)
+		}
+	} else {
+		// Find the actual executable path
+		displayName = appName
+		var err error
+		execPath, err = exec.LookPath(appName)
+		if err != nil {
+			// App not found in PATH, try common locations
+			commonPaths := []string{
+				"/usr/bin/" + appName,
+				"/usr/local/bin/" + appName,
+				"/snap/bin/" + appName,
+			}
+			for _, path := range commonPaths {
+				if _, err := os.Stat(path); err == nil {
+					execPath = path
+					break
+				}
+			}
+			if execPath == "" {
+				return "", "", fmt.Errorf("executable %s not found", appName)
+			}
+		}
+	}
+	return displayName, execPath, nil
 }
\ No newline at end of file
@@ -0,0 +1,265 @@
+package blocker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+
+	"github.com/gajzzs/keyphy/internal/matcher"
+)
+
+// Browsers resolve names with their own DoH clients and cache them, which
+// sidesteps the hosts file. Managed policies block the sites inside the
+// browser and turn their DoH off.
+
+// chromePolicyDirs are the managed policy directories of Chrome and
+// Chromium builds. Keyphy writes its own file into each.
+var chromePolicyDirs = []string{
+	"/etc/opt/chrome/policies/managed",
+	"/etc/chromium/policies/managed",
+	"/etc/chromium-browser/policies/managed",
+}
+
+const (
+	chromePolicyName = "keyphy.json"
+	// firefoxPolicyFile is shared with the distribution and the admin, so
+	// keyphy merges into it and keeps the original next to it. An empty
+	// backup means there was no file before.
+	firefoxPolicyFile   = "/etc/firefox/policies/policies.json"
+	firefoxBackupSuffix = ".keyphy-orig"
+)
+
+// BrowserPolicyOptions are the optional restrictions applied together with
+// the URL blocklist.
+type BrowserPolicyOptions struct {
+	BlockIncognito  bool
+	BlockExtensions bool
+}
+
+// SetBrowserPolicies enables or disables managed browser policies while
+// websites are blocked and applies the change right away.
+func (nb *NetworkBlocker) SetBrowserPolicies(enabled bool, options BrowserPolicyOptions) error {
+	nb.policyEnabled = enabled
+	nb.policyOptions = options
+	return nb.syncBrowserPolicies()
+}
+
+// syncBrowserPolicies writes the policies for the blocked websites, or
+// removes them when nothing is blocked.
+func (nb *NetworkBlocker) syncBrowserPolicies() error {
+	domains := nb.globalDomains()
+	if !nb.policyEnabled || len(domains) == 0 {
+		if !nb.policyActive {
+			return nil
+		}
+		if err := nb.removeBrowserPolicies(); err != nil {
+			return err
+		}
+		nb.policyActive = false
+		return nil
+	}
+	if err := nb.writeBrowserPolicies(domains, nb.policyOptions); err != nil {
+		return err
+	}
+	nb.policyActive = true
+	return nil
+}
+
+// VerifyBrowserPolicies restores policy files that were edited or removed.
+func (nb *NetworkBlocker) VerifyBrowserPolicies() error {
+	if !nb.policyActive {
+		return nil
+	}
+	return nb.writeBrowserPolicies(nb.globalDomains(), nb.policyOptions)
+}
+
+// policyPath returns path below the policy root.
+func (nb *NetworkBlocker) policyPath(path string) string {
+	return filepath.Join(nb.policyRoot, path)
+}
+
+func (nb *NetworkBlocker) writeBrowserPolicies(domains map[string]bool, options BrowserPolicyOptions) error {
+	var chromeURLs, firefoxURLs []string
+	for domain := range domains {
+		rule, err := matcher.Parse(domain)
+		if err != nil {
+			continue
+		}
+		chromeURLs = append(chromeURLs, chromeURLFilters(rule)...)
+		firefoxURLs = append(firefoxURLs, firefoxURLFilters(rule)...)
+	}
+	sort.Strings(chromeURLs)
+	sort.Strings(firefoxURLs)
+
+	chrome := map[string]interface{}{
+		"URLBlocklist":            chromeURLs,
+		"DnsOverHttpsMode":        "off",
+		"BuiltInDnsClientEnabled": false,
+	}
+	if options.BlockIncognito {
+		chrome["IncognitoModeAvailability"] = 1
+	}
+	if options.BlockExtensions {
+		chrome["ExtensionInstallBlocklist"] = []string{"*"}
+	}
+	data, err := json.MarshalIndent(chrome, "", "  ")
+	if err != nil {
+		return err
+	}
+	for _, dir := range chromePolicyDirs {
+		if err := writePolicyFile(nb.policyPath(filepath.Join(dir, chromePolicyName)), data); err != nil {
+			return fmt.Errorf("failed to write Chrome policy in %s: %v", dir, err)
+		}
+	}
+
+	firefox := map[string]interface{}{
+		"WebsiteFilter": map[string]interface{}{"Block": firefoxURLs},
+		"DNSOverHTTPS":  map[string]interface{}{"Enabled": false, "Locked": true},
+	}
+	if options.BlockIncognito {
+		firefox["DisablePrivateBrowsing"] = true
+	}
+	if options.BlockExtensions {
+		firefox["ExtensionSettings"] = map[string]interface{}{"*": map[string]interface{}{"installation_mode": "blocked"}}
+	}
+	if err := writeFirefoxPolicies(nb.policyPath(firefoxPolicyFile), firefox); err != nil {
+		return fmt.Errorf("failed to write Firefox policy: %v", err)
+	}
+	return nil
+}
+
+// chromeURLFilters converts a rule into URLBlocklist filters. A leading dot
+// stops Chrome from matching subdomains.
+func chromeURLFilters(rule *matcher.Rule) []string {
+	switch rule.Kind() {
+	case matcher.Wildcard:
+		return []string{rule.Domain()}
+	case matcher.Plain, matcher.Exact:
+		var filters []string
+		for _, name := range rule.HostsNames() {
+			filters = append(filters, "."+name)
+		}
+		return filters
+	}
+	return nil
+}
+
+// firefoxURLFilters converts a rule into WebsiteFilter match patterns.
+func firefoxURLFilters(rule *matcher.Rule) []string {
+	switch rule.Kind() {
+	case matcher.Wildcard:
+		return []string{"*://*." + rule.Domain() + "/*"}
+	case matcher.Plain, matcher.Exact:
+		var filters []string
+		for _, name := range rule.HostsNames() {
+			filters = append(filters, "*://"+name+"/*")
+		}
+		return filters
+	}
+	return nil
+}
+
+// writeFirefoxPolicies merges policies into the Firefox policy file at path.
+// The file as it was before is saved first, so removal can put it back.
+func writeFirefoxPolicies(path string, policies map[string]interface{}) error {
+	merged := map[string]interface{}{}
+	backup := path + firefoxBackupSuffix
+	original, err := os.ReadFile(backup)
+	if os.IsNotExist(err) {
+		original, err = os.ReadFile(path)
+		if os.IsNotExist(err) {
+			original, err = nil, nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(backup), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(backup, original, 0644); err != nil {
+			return err
+		}
+		exec.Command("chattr", "+i", backup).Run()
+	} else if err != nil {
+		return err
+	}
+	if len(original) > 0 {
+		var existing struct {
+			Policies map[string]interface{} `json:"policies"`
+		}
+		if json.Unmarshal(original, &existing) == nil && existing.Policies != nil {
+			merged = existing.Policies
+		}
+	}
+	for name, value := range policies {
+		merged[name] = value
+	}
+	data, err := json.MarshalIndent(map[string]interface{}{"policies": merged}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writePolicyFile(path, data)
+}
+
+// writePolicyFile writes and protects a policy file if its content differs.
+func writePolicyFile(path string, data []byte) error {
+	data = append(data, '\n')
+	if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	exec.Command("chattr", "-i", path).Run()
+	// Browsers run as the user and must be able to read the policy
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	exec.Command("chattr", "+i", path).Run()
+	return nil
+}
+
+// removeBrowserPolicies deletes the Chrome policy files and restores the
+// original Firefox policy file.
+func (nb *NetworkBlocker) removeBrowserPolicies() error {
+	var firstErr error
+	for _, dir := range chromePolicyDirs {
+		if err := removePolicyFile(nb.policyPath(filepath.Join(dir, chromePolicyName))); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	// Without a backup the Firefox file was never written by keyphy
+	path := nb.policyPath(firefoxPolicyFile)
+	backup := path + firefoxBackupSuffix
+	original, err := os.ReadFile(backup)
+	switch {
+	case os.IsNotExist(err):
+		return firstErr
+	case err != nil:
+		return err
+	case len(original) == 0:
+		if err := removePolicyFile(path); err != nil {
+			return err
+		}
+	default:
+		exec.Command("chattr", "-i", path).Run()
+		if err := os.WriteFile(path, original, 0644); err != nil {
+			return err
+		}
+	}
+	removePolicyFile(backup)
+	return firstErr
+}
+
+func removePolicyFile(path string) error {
+	exec.Command("chattr", "-i", path).Run()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package blocker
+
+// SetCircumventionBlocks drops outbound traffic through VPN interfaces and
+// rejects connections to ports, which the daemon uses for detected VPNs and
+// Tor. Calling it without interfaces and ports removes the rules.
+func (nb *NetworkBlocker) SetCircumventionBlocks(ifaces []string, ports []int) error {
+	var rules []Rule
+	for _, iface := range ifaces {
+		rules = append(rules, Rule{Priority: priorityBlock, OutIface: iface, Action: Drop})
+	}
+	if len(ports) > 0 {
+		rules = append(rules, Rule{Priority: priorityBlock, Proto: "tcp", DPorts: ports, Action: Reject})
+	}
+	if len(rules) == len(nb.circumventionRules) && equalRules(rules, nb.circumventionRules) {
+		return nil
+	}
+	if err := nb.fw.Replace(nb.circumventionRules, rules); err != nil {
+		return err
+	}
+	nb.circumventionRules = rules
+	return nil
+}
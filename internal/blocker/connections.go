@@ -0,0 +1,140 @@
+package blocker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Connection is one TCP socket as listed in /proc/net/tcp{,6}.
+type Connection struct {
+	LocalIP    net.IP
+	LocalPort  int
+	RemoteIP   net.IP
+	RemotePort int
+	State      int
+	UID        int
+	Inode      uint64
+}
+
+const tcpEstablished = 0x01
+
+// ReadEstablishedConnections returns all established IPv4 and IPv6 TCP
+// connections on the host.
+func ReadEstablishedConnections() ([]Connection, error) {
+	var established []Connection
+	for _, file := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		conns, err := readProcNet(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // IPv6 disabled
+			}
+			return nil, err
+		}
+		for _, conn := range conns {
+			if conn.State == tcpEstablished {
+				established = append(established, conn)
+			}
+		}
+	}
+	return established, nil
+}
+
+func readProcNet(path string) ([]Connection, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var conns []Connection
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // Skip header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		localIP, localPort, err := parseProcAddr(fields[1])
+		if err != nil {
+			continue
+		}
+		remoteIP, remotePort, err := parseProcAddr(fields[2])
+		if err != nil {
+			continue
+		}
+		state, _ := strconv.ParseUint(fields[3], 16, 8)
+		uid, _ := strconv.Atoi(fields[7])
+		inode, _ := strconv.ParseUint(fields[9], 10, 64)
+		conns = append(conns, Connection{
+			LocalIP:    localIP,
+			LocalPort:  localPort,
+			RemoteIP:   remoteIP,
+			RemotePort: remotePort,
+			State:      int(state),
+			UID:        uid,
+			Inode:      inode,
+		})
+	}
+	return conns, scanner.Err()
+}
+
+// parseProcAddr decodes "0100007F:0050" style addresses. The kernel prints
+// each 32-bit word of the address in host byte order.
+func parseProcAddr(field string) (net.IP, int, error) {
+	addrHex, portHex, ok := strings.Cut(field, ":")
+	if !ok || (len(addrHex) != 8 && len(addrHex) != 32) {
+		return nil, 0, fmt.Errorf("invalid address %s", field)
+	}
+	raw, err := hex.DecodeString(addrHex)
+	if err != nil {
+		return nil, 0, err
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		binary.NativeEndian.PutUint32(ip[i:], binary.BigEndian.Uint32(raw[i:]))
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ip, int(port), nil
+}
+
+// HasActiveConnections reports whether any established connection goes to
+// an address the domain (or its www subdomain) currently resolves to. It
+// only reads state fixed at construction, so callers need not hold the lock
+// guarding the blocker while it waits for DNS.
+func (nb *NetworkBlocker) HasActiveConnections(domain string) (bool, error) {
+	addrs := make(map[string]bool)
+	for _, name := range []string{domain, "www." + domain} {
+		found, err := nb.lookup(name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range found {
+			if !addr.IP.IsLoopback() && !addr.IP.IsUnspecified() {
+				addrs[addr.IP.String()] = true
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return false, nil
+	}
+
+	conns, err := ReadEstablishedConnections()
+	if err != nil {
+		return false, err
+	}
+	for _, conn := range conns {
+		if addrs[conn.RemoteIP.String()] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,44 @@
+package blocker
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reconcile compares the firewall rules and the hosts entries this blocker
+// installed with the live state of the host and reapplies whatever drifted,
+// for example after iptables was flushed or the hosts file was edited. It
+// returns one description per difference. Reapplying is idempotent, so an
+// intact host is left alone.
+func (nb *NetworkBlocker) Reconcile() ([]string, error) {
+	var drift []string
+	var errs []error
+
+	firewallDrift, err := nb.fw.Verify()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(firewallDrift) > 0 {
+		drift = append(drift, firewallDrift...)
+		if err := nb.fw.Reapply(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to reapply %s rules: %v", nb.fw.Name(), err))
+		}
+	}
+
+	current, err := nb.hostsFileCurrent()
+	if err != nil {
+		errs = append(errs, err)
+	} else if !current {
+		drift = append(drift, fmt.Sprintf("%s is missing blocked entries", nb.hostsFile))
+		err := nb.updateHosts(func(entries map[string][]string) {
+			for key, names := range nb.hostsEntries {
+				entries[key] = names
+			}
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to restore hosts entries: %v", err))
+		}
+	}
+
+	return drift, errors.Join(errs...)
+}
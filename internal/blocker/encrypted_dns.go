@@ -0,0 +1,181 @@
+package blocker
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gajzzs/keyphy/internal/matcher"
+)
+
+// EncryptedDNS lists resolvers that browsers can reach over DNS-over-HTTPS,
+// DNS-over-TLS or DNS-over-QUIC, bypassing the hosts file and the sinkhole.
+type EncryptedDNS struct {
+	// Addresses are IPs or CIDRs whose web ports are blocked.
+	Addresses []string
+	// Hosts are DoH hostnames, sinkholed in the hosts file, matched by SNI
+	// where the backend supports it and blocked by resolved address.
+	Hosts []string
+}
+
+// DefaultEncryptedDNS is the built-in list of public encrypted resolvers.
+var DefaultEncryptedDNS = EncryptedDNS{
+	Addresses: []string{
+		// Cloudflare
+		"1.1.1.1", "1.0.0.1", "1.1.1.2", "1.0.0.2", "1.1.1.3", "1.0.0.3",
+		"2606:4700:4700::1111", "2606:4700:4700::1001",
+		"2606:4700:4700::1112", "2606:4700:4700::1002",
+		"2606:4700:4700::1113", "2606:4700:4700::1003",
+		// Google
+		"8.8.8.8", "8.8.4.4", "2001:4860:4860::8888", "2001:4860:4860::8844",
+		// Quad9
+		"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9",
+		// OpenDNS
+		"208.67.222.222", "208.67.220.220", "2620:119:35::35", "2620:119:53::53",
+		// AdGuard
+		"94.140.14.14", "94.140.15.15", "2a10:50c0::ad1:ff", "2a10:50c0::ad2:ff",
+		// NextDNS
+		"45.90.28.0/24", "45.90.30.0/24", "2a07:a8c0::/33", "2a07:a8c1::/33",
+		// CleanBrowsing
+		"185.228.168.168", "185.228.169.168", "2a0d:2a00:1::", "2a0d:2a00:2::",
+	},
+	Hosts: []string{
+		"cloudflare-dns.com", "one.one.one.one", "1dot1dot1dot1.cloudflare-dns.com",
+		"dns.google", "dns.google.com", "dns64.dns.google",
+		"dns.quad9.net", "dns9.quad9.net", "dns10.quad9.net", "dns11.quad9.net",
+		"doh.opendns.com", "dns.umbrella.com",
+		"dns.adguard.com", "dns.adguard-dns.com",
+		"dns.nextdns.io",
+		"doh.cleanbrowsing.org",
+		"dns.mullvad.net", "doh.mullvad.net",
+		"doh.dns.sb",
+		"dns.controld.com",
+	},
+}
+
+// encryptedDNSPort is used by DNS-over-TLS (TCP) and DNS-over-QUIC (UDP)
+// for every resolver, so it is blocked regardless of destination.
+const encryptedDNSPort = 853
+
+// encryptedDNSHostsMarker is the hosts section key of the DoH hostnames.
+const encryptedDNSHostsMarker = "encrypted-dns"
+
+// encryptedDNSRefresh is how often DoH hostnames are resolved again.
+const encryptedDNSRefresh = 30 * time.Minute
+
+// MergeEncryptedDNS returns the built-in list extended with extra, or extra
+// alone when defaults is false.
+func MergeEncryptedDNS(extra EncryptedDNS, defaults bool) EncryptedDNS {
+	var merged EncryptedDNS
+	if defaults {
+		merged.Addresses = append(merged.Addresses, DefaultEncryptedDNS.Addresses...)
+		merged.Hosts = append(merged.Hosts, DefaultEncryptedDNS.Hosts...)
+	}
+	merged.Addresses = appendMissing(merged.Addresses, extra.Addresses)
+	merged.Hosts = appendMissing(merged.Hosts, extra.Hosts)
+	return merged
+}
+
+func appendMissing(list, items []string) []string {
+	seen := make(map[string]bool)
+	for _, item := range list {
+		seen[item] = true
+	}
+	for _, item := range items {
+		if !seen[item] {
+			seen[item] = true
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// BypassProtections describes what is blocked to stop encrypted DNS from
+// bypassing website rules on a firewall backend.
+func BypassProtections(list EncryptedDNS, backend string) []string {
+	protections := []string{
+		fmt.Sprintf("DNS-over-TLS and DNS-over-QUIC to any server (TCP and UDP %d)", encryptedDNSPort),
+		fmt.Sprintf("HTTPS and HTTP/3 to %d encrypted DNS resolver addresses", len(list.Addresses)),
+	}
+	if len(list.Hosts) > 0 {
+		protections = append(protections,
+			fmt.Sprintf("%d DoH hostnames sinkholed in the hosts file", len(list.Hosts)),
+			fmt.Sprintf("Resolved addresses of the DoH hostnames, refreshed every %s", encryptedDNSRefresh))
+		if backend == BackendIptables {
+			protections = append(protections, "DoH hostnames matched in DNS queries and TLS SNI")
+		}
+	}
+	return protections
+}
+
+// SetEncryptedDNS changes the encrypted DNS blocklist, updating the active
+// rules if websites are currently blocked.
+func (nb *NetworkBlocker) SetEncryptedDNS(list EncryptedDNS) error {
+	sort.Strings(list.Addresses)
+	sort.Strings(list.Hosts)
+	if equalStrings(list.Addresses, nb.encryptedDNS.Addresses) && equalStrings(list.Hosts, nb.encryptedDNS.Hosts) {
+		return nil
+	}
+	nb.encryptedDNS = list
+	if !nb.bypassActive {
+		return nil
+	}
+	return nb.blockEncryptedDNS()
+}
+
+// blockEncryptedDNS installs the encrypted DNS rules and hosts entries.
+func (nb *NetworkBlocker) blockEncryptedDNS() error {
+	rules := []Rule{
+		{Priority: priorityBlock, Proto: "tcp", DPorts: []int{encryptedDNSPort}, Action: Reject},
+		{Priority: priorityBlock, Proto: "udp", DPorts: []int{encryptedDNSPort}, Action: Drop},
+	}
+	rules = append(rules, addressRules(nb.encryptedDNS.Addresses)...)
+	if nb.fw.PayloadMatching() {
+		for _, host := range nb.encryptedDNS.Hosts {
+			if rule, err := matcher.Parse(host); err == nil {
+				rules = append(rules, payloadRules(rule)...)
+			}
+		}
+	}
+	rules = append(rules, addressRules(nb.resolveAddresses(nb.encryptedDNS.Hosts))...)
+	nb.bypassResolved = time.Now()
+
+	if err := nb.fw.Replace(nb.bypassRules, rules); err != nil {
+		return err
+	}
+	nb.bypassRules = rules
+	nb.bypassActive = true
+
+	if len(nb.encryptedDNS.Hosts) == 0 {
+		return nb.removeFromHosts(encryptedDNSHostsMarker)
+	}
+	if err := nb.addToHosts(encryptedDNSHostsMarker, nb.encryptedDNS.Hosts); err != nil {
+		return fmt.Errorf("failed to add encrypted DNS hosts: %v", err)
+	}
+	return nil
+}
+
+// unblockEncryptedDNS removes everything blockEncryptedDNS installed.
+func (nb *NetworkBlocker) unblockEncryptedDNS() error {
+	if !nb.bypassActive {
+		return nil
+	}
+	if err := nb.fw.Remove(nb.bypassRules...); err != nil {
+		return err
+	}
+	nb.bypassRules = nil
+	nb.bypassActive = false
+	return nb.removeFromHosts(encryptedDNSHostsMarker)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,486 @@
+package blocker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gajzzs/keyphy/internal/fanotify"
+)
+
+// App blocking backends selectable in the config.
+const (
+	AppBackendAuto     = "auto"
+	AppBackendFanotify = "fanotify"
+	AppBackendWrapper  = "wrapper"
+)
+
+const (
+	// maxCachedHashes bounds the hashes the guard keeps for executables it
+	// checked.
+	maxCachedHashes = 4096
+	// guardStartTimeout is how long the guard process gets to report that
+	// it watches every filesystem.
+	guardStartTimeout = 10 * time.Second
+	// guardMountInterval is how often the guard looks for new mounts.
+	guardMountInterval = 5 * time.Second
+	// maxPendingDenials is how many denials the guard buffers for the daemon
+	// before dropping them.
+	maxPendingDenials = 256
+)
+
+// ExecGuardCommand is the keyphy command line that runs the exec guard.
+var ExecGuardCommand = []string{"service", "run-exec-guard"}
+
+// ResolveAppBackend turns a configured app blocking backend into the one
+// that will be used on this host. Auto prefers fanotify when exec
+// permission events work.
+func ResolveAppBackend(backend string) (string, error) {
+	switch backend {
+	case "", AppBackendAuto:
+		if fanotify.Available() == nil {
+			return AppBackendFanotify, nil
+		}
+		return AppBackendWrapper, nil
+	case AppBackendWrapper:
+		return backend, nil
+	case AppBackendFanotify:
+		if err := fanotify.Available(); err != nil {
+			return "", fmt.Errorf("fanotify backend requested but not usable: %v", err)
+		}
+		return backend, nil
+	}
+	return "", fmt.Errorf("unknown app backend %s (use %s, %s or %s)", backend, AppBackendAuto, AppBackendFanotify, AppBackendWrapper)
+}
+
+// execTarget identifies a blocked executable by its path, its inode and
+// its content, so hard links and copies are denied as well.
+type execTarget struct {
+	App  string `json:"app"`
+	Path string `json:"path"`
+	Dev  uint64 `json:"dev"`
+	Ino  uint64 `json:"ino"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+}
+
+// guardMessage is sent by the guard process to the daemon: first whether
+// it started, then one message per denied execution and one per target
+// list it applied.
+type guardMessage struct {
+	Ready   bool   `json:"ready,omitempty"`
+	Updated bool   `json:"updated,omitempty"`
+	Error   string `json:"error,omitempty"`
+	App     string `json:"app,omitempty"`
+	Path    string `json:"path,omitempty"`
+	PID     int    `json:"pid,omitempty"`
+}
+
+func newExecTarget(app, path string) (execTarget, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return execTarget{}, err
+	}
+	file, err := os.Open(resolved)
+	if err != nil {
+		return execTarget{}, err
+	}
+	defer file.Close()
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(file.Fd()), &st); err != nil {
+		return execTarget{}, err
+	}
+	hash, err := hashFile(file, st.Size)
+	if err != nil {
+		return execTarget{}, err
+	}
+	return execTarget{App: app, Path: resolved, Dev: uint64(st.Dev), Ino: uint64(st.Ino), Size: st.Size, Hash: hash}, nil
+}
+
+func hashFile(file *os.File, size int64) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(file, 0, size)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// execGuard is the daemon's handle on the guard process. The daemon runs
+// programs all the time, so the fanotify group lives in a process of its
+// own that never does; see fanotify.Handler.
+type execGuard struct {
+	cmd      *exec.Cmd
+	targets  *os.File
+	messages chan guardMessage
+	done     chan struct{}
+}
+
+// StartExecGuard moves app blocking to fanotify, which denies executing
+// blocked binaries without touching them. Apps blocked before need
+// BlockApp again to move over.
+func (ab *AppBlocker) StartExecGuard() error {
+	if ab.guard != nil {
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	targetsRead, targetsWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	eventsRead, eventsWrite, err := os.Pipe()
+	if err != nil {
+		targetsRead.Close()
+		targetsWrite.Close()
+		return err
+	}
+	cmd := exec.Command(exe, ExecGuardCommand...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// The guard reads targets from fd 3 and reports on fd 4
+	cmd.ExtraFiles = []*os.File{targetsRead, eventsWrite}
+	err = cmd.Start()
+	targetsRead.Close()
+	eventsWrite.Close()
+	if err != nil {
+		targetsWrite.Close()
+		eventsRead.Close()
+		return fmt.Errorf("failed to start exec guard: %v", err)
+	}
+
+	g := &execGuard{cmd: cmd, targets: targetsWrite, messages: make(chan guardMessage, 1), done: make(chan struct{})}
+	onDenied := ab.OnDenied
+	go func() {
+		decoder := json.NewDecoder(eventsRead)
+		for {
+			var msg guardMessage
+			if decoder.Decode(&msg) != nil {
+				break
+			}
+			if msg.App == "" {
+				// Replies nobody waits for any more are dropped
+				select {
+				case g.messages <- msg:
+				default:
+				}
+			} else if onDenied != nil {
+				onDenied(msg.App, msg.Path, msg.PID)
+			}
+		}
+		eventsRead.Close()
+		cmd.Wait()
+		close(g.done)
+	}()
+
+	var startErr error
+	select {
+	case msg := <-g.messages:
+		if msg.Error != "" {
+			startErr = errors.New(msg.Error)
+		}
+	case <-g.done:
+		startErr = fmt.Errorf("exec guard exited: %v", cmd.ProcessState)
+	case <-time.After(guardStartTimeout):
+		startErr = fmt.Errorf("exec guard did not start within %s", guardStartTimeout)
+	}
+	if startErr != nil {
+		g.stop()
+		return startErr
+	}
+	ab.guard = g
+	ab.sendTargets()
+	return nil
+}
+
+// stop closes the target pipe, which makes the guard exit, and kills it if
+// it does not.
+func (g *execGuard) stop() {
+	g.targets.Close()
+	select {
+	case <-g.done:
+	case <-time.After(guardStartTimeout):
+		g.cmd.Process.Kill()
+		<-g.done
+	}
+}
+
+// StopExecGuard goes back to wrapper scripts. Executions are allowed until
+// apps are blocked again.
+func (ab *AppBlocker) StopExecGuard() {
+	if ab.guard == nil {
+		return
+	}
+	ab.guard.stop()
+	ab.guard = nil
+	ab.targets = make(map[string]execTarget)
+}
+
+// Backend returns the app blocking backend in use.
+func (ab *AppBlocker) Backend() string {
+	if ab.guard != nil {
+		return AppBackendFanotify
+	}
+	return AppBackendWrapper
+}
+
+// RefreshExecGuard restarts the guard process if it exited. If that fails,
+// wrappers are used again and the error is returned; blocked apps then
+// have to be blocked again.
+func (ab *AppBlocker) RefreshExecGuard() error {
+	if ab.guard == nil {
+		return nil
+	}
+	select {
+	case <-ab.guard.done:
+	default:
+		return nil
+	}
+	state := ab.guard.cmd.ProcessState
+	ab.guard = nil
+	// The new guard is sent the targets of the old one
+	if err := ab.StartExecGuard(); err != nil {
+		ab.targets = make(map[string]execTarget)
+		return fmt.Errorf("exec guard exited (%v) and could not be restarted: %v", state, err)
+	}
+	return fmt.Errorf("exec guard exited (%v), restarted it", state)
+}
+
+// guardApp denies executing appName from now on.
+func (ab *AppBlocker) guardApp(appName string) error {
+	// A wrapper left by an earlier run would be hashed instead of the app
+	if err := ab.restoreOriginalExecutable(appName); err != nil {
+		return err
+	}
+	_, execPath, err := findExecutable(appName)
+	if err != nil {
+		return err
+	}
+	target, err := newExecTarget(appName, execPath)
+	if err != nil {
+		return fmt.Errorf("failed to identify %s: %v", execPath, err)
+	}
+	ab.targets[appName] = target
+	return ab.sendTargets()
+}
+
+func (ab *AppBlocker) unguardApp(appName string) {
+	if _, ok := ab.targets[appName]; !ok {
+		return
+	}
+	delete(ab.targets, appName)
+	ab.sendTargets()
+}
+
+// sendTargets hands the complete target list to the guard process.
+func (ab *AppBlocker) sendTargets() error {
+	if ab.guard == nil {
+		return nil
+	}
+	targets := make([]execTarget, 0, len(ab.targets))
+	for _, target := range ab.targets {
+		targets = append(targets, target)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].App < targets[j].App
+	})
+	data, err := json.Marshal(targets)
+	if err != nil {
+		return err
+	}
+	for len(ab.guard.messages) > 0 {
+		<-ab.guard.messages
+	}
+	if _, err := ab.guard.targets.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to update exec guard: %v", err)
+	}
+	// Callers rely on the new list being enforced once this returns
+	select {
+	case <-ab.guard.messages:
+		return nil
+	case <-ab.guard.done:
+		return fmt.Errorf("exec guard exited")
+	case <-time.After(guardStartTimeout):
+		return fmt.Errorf("exec guard did not apply the update within %s", guardStartTimeout)
+	}
+}
+
+// execMatcher decides permission events in the guard process.
+type execMatcher struct {
+	mu      sync.Mutex
+	targets []execTarget
+	hashes  map[fileKey]string
+	denials chan guardMessage
+}
+
+type fileKey struct {
+	dev, ino uint64
+	size     int64
+	mtime    int64
+}
+
+// RunExecGuard runs the guard process: it watches executions on every
+// filesystem, reads target lists from targets and reports to events. It
+// returns when targets is closed, which releases every execution.
+func RunExecGuard(targets io.Reader, events io.Writer) error {
+	encoder := json.NewEncoder(events)
+	m := newExecMatcher()
+	guard, err := fanotify.Open(m.allowExec)
+	if err == nil {
+		if err = guard.MarkMounts(); err != nil {
+			guard.Close()
+		}
+	}
+	if err != nil {
+		encoder.Encode(guardMessage{Error: err.Error()})
+		return err
+	}
+	defer guard.Close()
+	guard.Start()
+	encoder.Encode(guardMessage{Ready: true})
+
+	ticker := time.NewTicker(guardMountInterval)
+	defer ticker.Stop()
+	return m.serve(targets, encoder, guard, ticker.C)
+}
+
+func newExecMatcher() *execMatcher {
+	return &execMatcher{
+		hashes:  make(map[fileKey]string),
+		denials: make(chan guardMessage, maxPendingDenials),
+	}
+}
+
+// mountWatcher is the part of fanotify.Guard that serve looks after.
+type mountWatcher interface {
+	Err() error
+	MarkMounts() error
+}
+
+// serve applies every target list read from targets, acknowledging each
+// with an Updated message, and reports denials to encoder. On every tick it
+// checks the watcher and watches new mounts. It returns when targets is
+// closed.
+func (m *execMatcher) serve(targets io.Reader, encoder *json.Encoder, watcher mountWatcher, tick <-chan time.Time) error {
+	// Denials are written apart from the handler, so a slow daemon never
+	// holds up executions
+	go func() {
+		for msg := range m.denials {
+			encoder.Encode(msg)
+		}
+	}()
+
+	updates := make(chan []execTarget)
+	readErr := make(chan error, 1)
+	go func() {
+		decoder := json.NewDecoder(targets)
+		for {
+			var list []execTarget
+			if err := decoder.Decode(&list); err != nil {
+				readErr <- err
+				return
+			}
+			updates <- list
+		}
+	}()
+
+	for {
+		select {
+		case list := <-updates:
+			m.mu.Lock()
+			m.targets = list
+			m.mu.Unlock()
+			m.denials <- guardMessage{Updated: true}
+		case err := <-readErr:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-tick:
+			if err := watcher.Err(); err != nil {
+				return err
+			}
+			// Copies on newly mounted filesystems are caught as well
+			watcher.MarkMounts()
+		}
+	}
+}
+
+// allowExec is the fanotify handler. It denies executables matching a
+// blocked app and reports them.
+func (m *execMatcher) allowExec(file *os.File, pid int) bool {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(file.Fd()), &st); err != nil {
+		return true
+	}
+	path, _ := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", file.Fd()))
+
+	denied := m.match(file, path, st)
+	if denied == "" {
+		return true
+	}
+	select {
+	case m.denials <- guardMessage{App: denied, Path: path, PID: pid}:
+	default:
+	}
+	return false
+}
+
+// match returns the blocked app that file, found at path with status st,
+// is: by path or inode, or for same sized files by content hash. It returns
+// "" for files that match no target.
+func (m *execMatcher) match(file *os.File, path string, st syscall.Stat_t) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sameSize := false
+	for _, target := range m.targets {
+		if target.Path == path || target.Dev == uint64(st.Dev) && target.Ino == uint64(st.Ino) {
+			return target.App
+		}
+		if target.Size == st.Size {
+			sameSize = true
+		}
+	}
+	if !sameSize {
+		return ""
+	}
+	hash, err := m.cachedHash(file, st)
+	if err != nil {
+		return ""
+	}
+	for _, target := range m.targets {
+		if target.Size == st.Size && target.Hash == hash {
+			return target.App
+		}
+	}
+	return ""
+}
+
+// cachedHash hashes file once per inode and modification. Callers must
+// hold m.mu.
+func (m *execMatcher) cachedHash(file *os.File, st syscall.Stat_t) (string, error) {
+	key := fileKey{uint64(st.Dev), uint64(st.Ino), st.Size, st.Mtim.Nano()}
+	if hash, ok := m.hashes[key]; ok {
+		return hash, nil
+	}
+	hash, err := hashFile(file, st.Size)
+	if err != nil {
+		return "", err
+	}
+	if len(m.hashes) >= maxCachedHashes {
+		m.hashes = make(map[fileKey]string)
+	}
+	m.hashes[key] = hash
+	return hash, nil
+}
@@ -0,0 +1,186 @@
+package blocker
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func writeExecutable(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// matchFile runs the match decision for path as the fanotify handler would
+// for an execution of it.
+func matchFile(t *testing.T, m *execMatcher, path string) string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(file.Fd()), &st); err != nil {
+		t.Fatal(err)
+	}
+	return m.match(file, path, st)
+}
+
+func TestExecMatch(t *testing.T) {
+	dir := t.TempDir()
+	app := filepath.Join(dir, "app")
+	writeExecutable(t, app, "#!/bin/sh\necho app\n")
+	if err := os.Link(app, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(app, filepath.Join(dir, "symlink")); err != nil {
+		t.Fatal(err)
+	}
+	writeExecutable(t, filepath.Join(dir, "copy"), "#!/bin/sh\necho app\n")
+	writeExecutable(t, filepath.Join(dir, "same-size"), "#!/bin/sh\necho oth\n")
+	writeExecutable(t, filepath.Join(dir, "other"), "#!/bin/sh\necho other app\n")
+
+	target, err := newExecTarget("app", filepath.Join(dir, "symlink"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.Path != app {
+		t.Errorf("target path = %s, want %s", target.Path, app)
+	}
+	m := newExecMatcher()
+	m.targets = []execTarget{target}
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"path", app, "app"},
+		{"hard link", filepath.Join(dir, "link"), "app"},
+		{"copy", filepath.Join(dir, "copy"), "app"},
+		{"same size other content", filepath.Join(dir, "same-size"), ""},
+		{"other size", filepath.Join(dir, "other"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchFile(t, m, tt.path); got != tt.want {
+				t.Errorf("match(%s) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+
+	// A copy edited after it was hashed is hashed again
+	copyPath := filepath.Join(dir, "copy")
+	writeExecutable(t, copyPath, "#!/bin/sh\necho cpy\n")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(copyPath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := matchFile(t, m, copyPath); got != "" {
+		t.Errorf("edited copy matched %q", got)
+	}
+
+	m.targets = nil
+	if got := matchFile(t, m, app); got != "" {
+		t.Errorf("match without targets = %q", got)
+	}
+}
+
+type fakeWatcher struct {
+	err   error
+	marks int
+}
+
+func (w *fakeWatcher) Err() error { return w.err }
+
+func (w *fakeWatcher) MarkMounts() error {
+	w.marks++
+	return nil
+}
+
+// TestExecGuardProtocol drives serve the way the daemon drives the guard
+// process on fds 3 and 4.
+func TestExecGuardProtocol(t *testing.T) {
+	dir := t.TempDir()
+	app := filepath.Join(dir, "app")
+	writeExecutable(t, app, "#!/bin/sh\n")
+	target, err := newExecTarget("app", app)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targetsRead, targetsWrite := io.Pipe()
+	eventsRead, eventsWrite := io.Pipe()
+	m := newExecMatcher()
+	watcher := &fakeWatcher{}
+	tick := make(chan time.Time)
+	done := make(chan error, 1)
+	go func() {
+		done <- m.serve(targetsRead, json.NewEncoder(eventsWrite), watcher, tick)
+	}()
+	events := bufio.NewScanner(eventsRead)
+	next := func() guardMessage {
+		t.Helper()
+		if !events.Scan() {
+			t.Fatal("no message from the guard")
+		}
+		var msg guardMessage
+		if err := json.Unmarshal(events.Bytes(), &msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	send := func(targets []execTarget) {
+		t.Helper()
+		data, _ := json.Marshal(targets)
+		if _, err := targetsWrite.Write(append(data, '\n')); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send([]execTarget{target})
+	if msg := next(); !msg.Updated {
+		t.Fatalf("reply to a target list = %+v, want updated", msg)
+	}
+	file, err := os.Open(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if m.allowExec(file, 42) {
+		t.Error("blocked app was allowed")
+	}
+	if msg := next(); msg.App != "app" || msg.PID != 42 {
+		t.Errorf("denial = %+v", msg)
+	}
+
+	tick <- time.Now()
+	send(nil)
+	if msg := next(); !msg.Updated {
+		t.Fatalf("reply to an empty target list = %+v, want updated", msg)
+	}
+	if watcher.marks != 1 {
+		t.Errorf("mounts marked %d times on one tick", watcher.marks)
+	}
+	if !m.allowExec(file, 42) {
+		t.Error("app was denied after it was unblocked")
+	}
+
+	targetsWrite.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serve = %v after the targets were closed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after the targets were closed")
+	}
+}
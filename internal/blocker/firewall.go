@@ -0,0 +1,337 @@
+package blocker
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// Firewall backends selectable in the config.
+const (
+	BackendAuto     = "auto"
+	BackendIptables = "iptables"
+	BackendNftables = "nftables"
+)
+
+// Action is what a Rule does with matching outbound packets.
+type Action string
+
+const (
+	Accept Action = "accept"
+	Drop   Action = "drop"
+	// Reject resets TCP connections so clients fail fast instead of
+	// waiting for a timeout.
+	Reject Action = "reject"
+	// Queue hands packets to a userspace classifier on netfilter queue
+	// Rule.Queue. Packets are accepted while nothing listens on it.
+	Queue Action = "queue"
+)
+
+// Address families a Rule can be limited to.
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// Payload matches bytes inside a packet.
+type Payload struct {
+	Pattern    []byte
+	IgnoreCase bool
+	// From and To bound the packet offsets searched when To is non-zero.
+	From, To int
+}
+
+// Rule is one outbound packet filter rule. Empty fields match anything.
+type Rule struct {
+	// Priority orders rules; lower values are evaluated first and rules
+	// with equal priority keep the order they were added in.
+	Priority int
+	// Family limits the rule to IPv4 or IPv6. Rules with a Dest always
+	// take the family of that address.
+	Family   string
+	Proto    string
+	Dest     string
+	DPorts   []int
+	OutIface string
+	UIDOwner string
+	GIDOwner string
+	Payload  *Payload
+	// FlowPackets limits the rule to established connections that have sent
+	// at most this many packets.
+	FlowPackets int
+	Action      Action
+	Queue       uint16
+}
+
+// String renders the rule in a backend neutral form. Rules with the same
+// string are the same rule.
+func (r Rule) String() string {
+	var parts []string
+	if r.Family != "" {
+		parts = append(parts, "family "+r.Family)
+	}
+	if r.Proto != "" {
+		parts = append(parts, "proto "+r.Proto)
+	}
+	if r.Dest != "" {
+		parts = append(parts, "dest "+r.Dest)
+	}
+	if len(r.DPorts) > 0 {
+		parts = append(parts, "dport "+joinPorts(r.DPorts, ","))
+	}
+	if r.OutIface != "" {
+		parts = append(parts, "oif "+r.OutIface)
+	}
+	if r.UIDOwner != "" {
+		parts = append(parts, "uid "+r.UIDOwner)
+	}
+	if r.GIDOwner != "" {
+		parts = append(parts, "gid "+r.GIDOwner)
+	}
+	if p := r.Payload; p != nil {
+		match := fmt.Sprintf("payload %s", hex.EncodeToString(p.Pattern))
+		if p.To > 0 {
+			match += fmt.Sprintf(" at %d-%d", p.From, p.To)
+		}
+		if p.IgnoreCase {
+			match += " icase"
+		}
+		parts = append(parts, match)
+	}
+	if r.FlowPackets > 0 {
+		parts = append(parts, fmt.Sprintf("flow-packets %d", r.FlowPackets))
+	}
+	action := string(r.Action)
+	if r.Action == Queue {
+		action += fmt.Sprintf(" %d", r.Queue)
+	}
+	return fmt.Sprintf("%d: %s %s", r.Priority, strings.Join(parts, " "), action)
+}
+
+// appliesTo reports whether the rule is enforced for family.
+func (r Rule) appliesTo(family string) bool {
+	if r.Dest != "" {
+		return addressFamily(r.Dest) == family
+	}
+	return r.Family == "" || r.Family == family
+}
+
+// addressFamily returns the family of an address or CIDR.
+func addressFamily(address string) string {
+	if strings.Contains(address, ":") {
+		return FamilyIPv6
+	}
+	return FamilyIPv4
+}
+
+// Firewall owns keyphy's packet filter rules on the host. Implementations
+// keep the rules apart from the user's own and apply every change as a
+// single transaction.
+type Firewall interface {
+	Name() string
+	// Add installs rules. Identical rules are installed once but counted
+	// every time they are added.
+	Add(rules ...Rule) error
+	// Remove releases rules added before. A rule is deleted once every
+	// Add of it has been released; rules that are not present are ignored.
+	Remove(rules ...Rule) error
+	// Replace removes old and adds new in one transaction.
+	Replace(old, new []Rule) error
+	// List returns the installed rules in evaluation order.
+	List() []Rule
+	// Flush removes everything the firewall installed.
+	Flush() error
+	// Verify compares the installed rules with the live packet filter and
+	// describes every difference it finds.
+	Verify() ([]string, error)
+	// Reapply loads the installed rules again, repairing rules that were
+	// removed or changed behind the firewall's back.
+	Reapply() error
+	// PayloadMatching reports whether Payload rules are enforced. Backends
+	// without it need address based rules instead.
+	PayloadMatching() bool
+	// GroupMatching reports whether GIDOwner rules match every member of
+	// the group, including those who have it as a supplementary group.
+	// Backends without it cannot limit rules to a group.
+	GroupMatching() bool
+}
+
+// ruleStore is the rule bookkeeping shared by the firewall backends. Every
+// change computes the new rule list and hands it to commit, which only
+// keeps it if the backend applied it. Rules are counted by their string,
+// so two blocked sites sharing an address each hold the rule for it.
+type ruleStore struct {
+	rules  []Rule
+	refs   map[string]int
+	commit func(rules []Rule) error
+}
+
+func (s *ruleStore) Add(rules ...Rule) error {
+	return s.Replace(nil, rules)
+}
+
+func (s *ruleStore) Remove(rules ...Rule) error {
+	return s.Replace(rules, nil)
+}
+
+func (s *ruleStore) Replace(old, new []Rule) error {
+	refs := make(map[string]int, len(s.refs))
+	for key, n := range s.refs {
+		refs[key] = n
+	}
+	for _, rule := range old {
+		if refs[rule.String()] > 0 {
+			refs[rule.String()]--
+		}
+	}
+	for _, rule := range new {
+		refs[rule.String()]++
+	}
+	// Rules still held keep their place, so an unchanged set commits
+	// nothing
+	present := make(map[string]bool)
+	var next []Rule
+	for _, rule := range s.rules {
+		if refs[rule.String()] > 0 {
+			next = append(next, rule)
+			present[rule.String()] = true
+		}
+	}
+	for _, rule := range new {
+		if !present[rule.String()] {
+			next = append(next, rule)
+			present[rule.String()] = true
+		}
+	}
+	for key, n := range refs {
+		if n == 0 {
+			delete(refs, key)
+		}
+	}
+	sort.SliceStable(next, func(i, j int) bool {
+		return next[i].Priority < next[j].Priority
+	})
+	if len(next) == len(s.rules) && equalRules(next, s.rules) {
+		s.refs = refs
+		return nil
+	}
+	if err := s.commit(next); err != nil {
+		return err
+	}
+	s.rules = next
+	s.refs = refs
+	return nil
+}
+
+// reset forgets every rule, after the backend flushed them.
+func (s *ruleStore) reset() {
+	s.rules = nil
+	s.refs = nil
+}
+
+// diffListing summarises how the live listing of a firewall object differs
+// from the expected one, or returns "" if they match. Both are compared line
+// by line, ignoring order and indentation.
+func diffListing(name, want, live string) string {
+	count := func(listing string) map[string]int {
+		lines := make(map[string]int)
+		for _, line := range strings.Split(listing, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				lines[line]++
+			}
+		}
+		return lines
+	}
+	wantLines, liveLines := count(want), count(live)
+	var missing, unexpected []string
+	for line, n := range wantLines {
+		for i := liveLines[line]; i < n; i++ {
+			missing = append(missing, line)
+		}
+	}
+	for line, n := range liveLines {
+		for i := wantLines[line]; i < n; i++ {
+			unexpected = append(unexpected, line)
+		}
+	}
+	if len(missing) == 0 && len(unexpected) == 0 {
+		return ""
+	}
+	sort.Strings(missing)
+	sort.Strings(unexpected)
+	summary := fmt.Sprintf("%s has %d missing and %d unexpected lines", name, len(missing), len(unexpected))
+	if len(unexpected) > 0 {
+		summary += fmt.Sprintf(", e.g. %q", unexpected[0])
+	} else {
+		summary += fmt.Sprintf(", e.g. %q is gone", missing[0])
+	}
+	return summary
+}
+
+func (s *ruleStore) Reapply() error {
+	return s.commit(s.rules)
+}
+
+func (s *ruleStore) List() []Rule {
+	return append([]Rule(nil), s.rules...)
+}
+
+func equalRules(a, b []Rule) bool {
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+func joinPorts(ports []int, sep string) string {
+	parts := make([]string, len(ports))
+	for i, port := range ports {
+		parts[i] = fmt.Sprint(port)
+	}
+	return strings.Join(parts, sep)
+}
+
+// ResolveBackend turns a configured backend name into the one that will be
+// used on this host. Auto prefers nftables when the nft tool works.
+func ResolveBackend(backend string) (string, error) {
+	switch backend {
+	case "", BackendAuto:
+		if nftAvailable() {
+			return BackendNftables, nil
+		}
+		return BackendIptables, nil
+	case BackendIptables:
+		return backend, nil
+	case BackendNftables:
+		if !nftAvailable() {
+			return "", fmt.Errorf("nftables backend requested but nft is not usable")
+		}
+		return backend, nil
+	}
+	return "", fmt.Errorf("unknown firewall backend %s (use %s, %s or %s)", backend, BackendAuto, BackendIptables, BackendNftables)
+}
+
+// NewFirewall returns the firewall for a configured backend name, falling
+// back to iptables when the choice cannot be used.
+func NewFirewall(backend string) Firewall {
+	resolved, err := ResolveBackend(backend)
+	if err != nil {
+		fmt.Printf("Warning: %v, falling back to iptables\n", err)
+		return NewIptablesFirewall()
+	}
+	if resolved == BackendNftables {
+		return NewNftFirewall()
+	}
+	return NewIptablesFirewall()
+}
+
+func nftAvailable() bool {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return false
+	}
+	return exec.Command("nft", "list", "tables").Run() == nil
+}
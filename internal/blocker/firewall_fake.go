@@ -0,0 +1,57 @@
+package blocker
+
+import "fmt"
+
+// FakeFirewall keeps rules in memory and records every operation, so
+// NetworkBlocker can be exercised without root or a real packet filter.
+type FakeFirewall struct {
+	ruleStore
+	// Calls lists the operations in the order they happened.
+	Calls []string
+	// Err, when set, fails every commit and flush.
+	Err error
+	// Payload is returned by PayloadMatching.
+	Payload bool
+	// Groups is returned by GroupMatching.
+	Groups bool
+	// Drift is returned by Verify until the next commit.
+	Drift []string
+}
+
+func NewFakeFirewall() *FakeFirewall {
+	fw := &FakeFirewall{Payload: true, Groups: true}
+	fw.commit = func(rules []Rule) error {
+		fw.Calls = append(fw.Calls, fmt.Sprintf("commit %d", len(rules)))
+		if fw.Err != nil {
+			return fw.Err
+		}
+		fw.Drift = nil
+		return nil
+	}
+	return fw
+}
+
+func (fw *FakeFirewall) Name() string {
+	return "fake"
+}
+
+func (fw *FakeFirewall) PayloadMatching() bool {
+	return fw.Payload
+}
+
+func (fw *FakeFirewall) GroupMatching() bool {
+	return fw.Groups
+}
+
+func (fw *FakeFirewall) Flush() error {
+	fw.Calls = append(fw.Calls, "flush")
+	if fw.Err != nil {
+		return fw.Err
+	}
+	fw.reset()
+	return nil
+}
+
+func (fw *FakeFirewall) Verify() ([]string, error) {
+	return fw.Drift, nil
+}
@@ -0,0 +1,309 @@
+package blocker
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// keyphyChain holds every rule of the iptables backend, in both the IPv4
+// and the IPv6 filter table. OUTPUT only gets a single jump to it, so user
+// rules are never touched.
+const keyphyChain = "KEYPHY-OUT"
+
+// iptablesTools maps each family to its command and restore tool.
+var iptablesTools = []struct {
+	family, command, restore string
+}{
+	{FamilyIPv4, "iptables", "iptables-restore"},
+	{FamilyIPv6, "ip6tables", "ip6tables-restore"},
+}
+
+// Chains used for allowlist mode by earlier versions.
+var legacyAllowlistChains = []string{"KEYPHY-ALLOW-A", "KEYPHY-ALLOW-B"}
+
+// legacyDoHServers and legacyAddressBlocks were dropped in OUTPUT by
+// earlier versions.
+var legacyDoHServers = []string{"1.1.1.1", "8.8.8.8", "9.9.9.9", "208.67.222.222"}
+var legacyAddressBlocks = []string{"142.250.0.0/15", "172.217.0.0/16", "216.58.192.0/19", "74.125.0.0/16"}
+
+// IptablesFirewall keeps keyphy's rules in KEYPHY-OUT. Every change
+// regenerates the chain and loads it with one iptables-restore and one
+// ip6tables-restore call, each of which replaces it atomically. Hosts
+// without ip6tables only get the IPv4 rules.
+type IptablesFirewall struct {
+	ruleStore
+	legacyCleaned bool
+	// snapshots holds the listing of KEYPHY-OUT per family right after the
+	// last apply, which Verify compares the live chain with.
+	snapshots map[string]string
+}
+
+func NewIptablesFirewall() *IptablesFirewall {
+	fw := &IptablesFirewall{snapshots: make(map[string]string)}
+	fw.commit = fw.apply
+	return fw
+}
+
+func (fw *IptablesFirewall) Name() string {
+	return BackendIptables
+}
+
+func (fw *IptablesFirewall) PayloadMatching() bool {
+	return true
+}
+
+func (fw *IptablesFirewall) GroupMatching() bool {
+	return true
+}
+
+// Flush unhooks and deletes KEYPHY-OUT, together with anything earlier
+// versions left directly in OUTPUT.
+func (fw *IptablesFirewall) Flush() error {
+	fw.reset()
+	fw.snapshots = make(map[string]string)
+	for _, tool := range iptablesTools {
+		deleteChain(tool.command, keyphyChain)
+	}
+	removeLegacyRules()
+	fw.legacyCleaned = true
+	return nil
+}
+
+func (fw *IptablesFirewall) apply(rules []Rule) error {
+	if !fw.legacyCleaned {
+		removeLegacyRules()
+		fw.legacyCleaned = true
+	}
+
+	for _, tool := range iptablesTools {
+		if _, err := exec.LookPath(tool.restore); err != nil && tool.family == FamilyIPv6 {
+			continue
+		}
+		var familyRules []Rule
+		for _, rule := range rules {
+			if rule.appliesTo(tool.family) {
+				familyRules = append(familyRules, rule)
+			}
+		}
+
+		cmd := exec.Command(tool.restore, "--noflush", "-w")
+		cmd.Stdin = strings.NewReader(iptablesRuleset(familyRules))
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s failed: %v: %s", tool.restore, err, strings.TrimSpace(stderr.String()))
+		}
+
+		// The jump is added once, after the chain exists
+		if exec.Command(tool.command, "-C", "OUTPUT", "-j", keyphyChain).Run() != nil {
+			if err := exec.Command(tool.command, "-I", "OUTPUT", "1", "-j", keyphyChain).Run(); err != nil {
+				return fmt.Errorf("failed to hook %s into %s OUTPUT: %v", keyphyChain, tool.command, err)
+			}
+		}
+		if listing, err := exec.Command(tool.command, "-w", "-S", keyphyChain).Output(); err == nil {
+			fw.snapshots[tool.family] = string(listing)
+		}
+	}
+	return nil
+}
+
+// Verify lists KEYPHY-OUT in every family and compares it with the listing
+// taken after the last apply, so rules are compared the way iptables prints
+// them rather than the way they were written.
+func (fw *IptablesFirewall) Verify() ([]string, error) {
+	if len(fw.rules) == 0 {
+		return nil, nil
+	}
+	var drift []string
+	for _, tool := range iptablesTools {
+		want, ok := fw.snapshots[tool.family]
+		if !ok {
+			continue
+		}
+		listing, err := exec.Command(tool.command, "-w", "-S", keyphyChain).Output()
+		if _, exited := err.(*exec.ExitError); exited {
+			drift = append(drift, fmt.Sprintf("%s chain %s is missing", tool.command, keyphyChain))
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %v", keyphyChain, err)
+		}
+		if d := diffListing(tool.command+" "+keyphyChain, want, string(listing)); d != "" {
+			drift = append(drift, d)
+		}
+		if exec.Command(tool.command, "-w", "-C", "OUTPUT", "-j", keyphyChain).Run() != nil {
+			drift = append(drift, fmt.Sprintf("%s OUTPUT no longer jumps to %s", tool.command, keyphyChain))
+		}
+	}
+	return drift, nil
+}
+
+// iptablesRuleset renders the filter table input for iptables-restore.
+// Declaring the chain flushes it, so the rules below replace the previous
+// set.
+func iptablesRuleset(rules []Rule) string {
+	var b strings.Builder
+	b.WriteString("*filter\n")
+	fmt.Fprintf(&b, ":%s - [0:0]\n", keyphyChain)
+	for _, rule := range rules {
+		fmt.Fprintf(&b, "-A %s %s\n", keyphyChain, quoteArgs(iptablesSpec(rule)))
+	}
+	b.WriteString("COMMIT\n")
+	return b.String()
+}
+
+// iptablesSpec converts a rule into iptables arguments without the chain.
+func iptablesSpec(rule Rule) []string {
+	var spec []string
+	if rule.Proto != "" {
+		spec = append(spec, "-p", rule.Proto)
+	}
+	if rule.Dest != "" {
+		spec = append(spec, "-d", rule.Dest)
+	}
+	switch len(rule.DPorts) {
+	case 0:
+	case 1:
+		spec = append(spec, "--dport", fmt.Sprint(rule.DPorts[0]))
+	default:
+		spec = append(spec, "-m", "multiport", "--dports", joinPorts(rule.DPorts, ","))
+	}
+	if rule.OutIface != "" {
+		spec = append(spec, "-o", rule.OutIface)
+	}
+	if rule.UIDOwner != "" {
+		spec = append(spec, "-m", "owner", "--uid-owner", rule.UIDOwner)
+	}
+	if rule.GIDOwner != "" {
+		// Members of the group usually have it as a supplementary group
+		spec = append(spec, "-m", "owner", "--gid-owner", rule.GIDOwner, "--suppl-groups")
+	}
+	if p := rule.Payload; p != nil {
+		spec = append(spec, "-m", "string", "--hex-string", "|"+hex.EncodeToString(p.Pattern)+"|", "--algo", "bm")
+		if p.To > 0 {
+			spec = append(spec, "--from", fmt.Sprint(p.From), "--to", fmt.Sprint(p.To))
+		}
+		if p.IgnoreCase {
+			spec = append(spec, "--icase")
+		}
+	}
+	if rule.FlowPackets > 0 {
+		spec = append(spec, "-m", "conntrack", "--ctstate", "ESTABLISHED",
+			"-m", "connbytes", "--connbytes", fmt.Sprintf("0:%d", rule.FlowPackets), "--connbytes-dir", "original", "--connbytes-mode", "packets")
+	}
+	switch rule.Action {
+	case Accept:
+		spec = append(spec, "-j", "ACCEPT")
+	case Queue:
+		spec = append(spec, "-j", "NFQUEUE", "--queue-num", fmt.Sprint(rule.Queue), "--queue-bypass")
+	case Reject:
+		spec = append(spec, "-j", "REJECT")
+		if rule.Proto == "tcp" {
+			spec = append(spec, "--reject-with", "tcp-reset")
+		}
+	default:
+		spec = append(spec, "-j", "DROP")
+	}
+	return spec
+}
+
+// removeLegacyRules deletes rules that earlier versions inserted straight
+// into OUTPUT: string matches on DNS and web ports, DoH and address drops,
+// and the allowlist chains.
+func removeLegacyRules() {
+	for _, chain := range legacyAllowlistChains {
+		deleteChain("iptables", chain)
+	}
+	for _, server := range legacyDoHServers {
+		for runIptables("-D", "OUTPUT", "-p", "tcp", "-d", server, "--dport", "443", "-j", "DROP") == nil {
+		}
+	}
+	for _, cidr := range legacyAddressBlocks {
+		for runIptables("-D", "OUTPUT", "-d", cidr, "-j", "DROP") == nil {
+		}
+	}
+
+	output, err := exec.Command("iptables", "-S", "OUTPUT").Output()
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		args := splitArgs(line)
+		if len(args) < 2 || args[0] != "-A" || !isLegacyStringRule(args) {
+			continue
+		}
+		runIptables(append([]string{"-D"}, args[1:]...)...)
+	}
+}
+
+// isLegacyStringRule recognises the old boyer-moore string match drops on
+// DNS, HTTP and HTTPS.
+func isLegacyStringRule(args []string) bool {
+	joined := " " + strings.Join(args, " ") + " "
+	if !strings.Contains(joined, " -m string ") || !strings.Contains(joined, " --algo bm ") || !strings.HasSuffix(joined, " -j DROP ") {
+		return false
+	}
+	for _, port := range []string{"53", "80", "443"} {
+		if strings.Contains(joined, " --dport "+port+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// splitArgs splits an iptables -S line, honouring double quotes.
+func splitArgs(line string) []string {
+	var args []string
+	var current strings.Builder
+	inQuotes, inArg := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && inQuotes && i+1 < len(line):
+			i++
+			current.WriteByte(line[i])
+		case c == '"':
+			inQuotes = !inQuotes
+			inArg = true
+		case (c == ' ' || c == '\t') && !inQuotes:
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\"'\\") {
+			arg = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
+
+// deleteChain removes every jump from OUTPUT to chain, then the chain
+// itself, using command (iptables or ip6tables).
+func deleteChain(command, chain string) {
+	for exec.Command(command, "-D", "OUTPUT", "-j", chain).Run() == nil {
+	}
+	exec.Command(command, "-F", chain).Run()
+	exec.Command(command, "-X", chain).Run()
+}
+
+func runIptables(args ...string) error {
+	return exec.Command("iptables", args...).Run()
+}
@@ -0,0 +1,224 @@
+package blocker
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const nftTable = "keyphy"
+
+// NftFirewall owns the inet keyphy table, which covers IPv4 and IPv6.
+// Rules that differ only in their destination are folded into one rule
+// matching a named address set, and every change swaps the complete table
+// in with a single nft transaction. nftables cannot search packet payloads,
+// so Payload rules are skipped, and cannot match supplementary groups, so
+// group scoped rules are refused before they reach it.
+type NftFirewall struct {
+	ruleStore
+	// snapshot is the listing of the table right after the last apply.
+	snapshot string
+	applied  bool
+}
+
+func NewNftFirewall() *NftFirewall {
+	fw := &NftFirewall{}
+	fw.commit = fw.apply
+	return fw
+}
+
+func (fw *NftFirewall) Name() string {
+	return BackendNftables
+}
+
+func (fw *NftFirewall) PayloadMatching() bool {
+	return false
+}
+
+// GroupMatching is false because meta skgid only sees the primary group of
+// a socket's owner.
+func (fw *NftFirewall) GroupMatching() bool {
+	return false
+}
+
+// Flush drops the whole table in one operation.
+func (fw *NftFirewall) Flush() error {
+	fw.reset()
+	fw.snapshot, fw.applied = "", false
+	// Declaring the table first makes the delete succeed even if it is gone
+	return runNft(fmt.Sprintf("table inet %s\ndelete table inet %s\n", nftTable, nftTable))
+}
+
+func (fw *NftFirewall) apply(rules []Rule) error {
+	if err := runNft(nftRuleset(rules)); err != nil {
+		return fmt.Errorf("failed to apply nftables ruleset: %v", err)
+	}
+	if listing, err := exec.Command("nft", "list", "table", "inet", nftTable).Output(); err == nil {
+		fw.snapshot, fw.applied = string(listing), true
+	}
+	return nil
+}
+
+// Verify lists the keyphy table and compares it with the listing taken
+// after the last apply.
+func (fw *NftFirewall) Verify() ([]string, error) {
+	if !fw.applied || len(fw.rules) == 0 {
+		return nil, nil
+	}
+	listing, err := exec.Command("nft", "list", "table", "inet", nftTable).Output()
+	if _, exited := err.(*exec.ExitError); exited {
+		return []string{fmt.Sprintf("nftables table inet %s is missing", nftTable)}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list nftables table: %v", err)
+	}
+	if d := diffListing("nftables table inet "+nftTable, fw.snapshot, string(listing)); d != "" {
+		return []string{d}, nil
+	}
+	return nil, nil
+}
+
+// nftRuleset renders a script that atomically replaces the keyphy table.
+func nftRuleset(rules []Rule) string {
+	type group struct {
+		first Rule
+		dests []string
+	}
+	var order []string
+	groups := make(map[string]*group)
+	for _, rule := range rules {
+		if rule.Payload != nil {
+			continue
+		}
+		shape := rule
+		shape.Dest = ""
+		key := shape.String()
+		if rule.Dest == "" {
+			// Rules without a destination are never folded
+			key = "any " + key
+		}
+		g, ok := groups[key]
+		if !ok {
+			g = &group{first: rule}
+			groups[key] = g
+			order = append(order, key)
+		}
+		if rule.Dest != "" {
+			g.dests = append(g.dests, rule.Dest)
+		}
+	}
+
+	var sets, chain strings.Builder
+	for i, key := range order {
+		g := groups[key]
+		if len(g.dests) == 0 {
+			fmt.Fprintf(&chain, "\t\t%s%s\n", nftFamily(g.first.Family), nftStatement(g.first))
+			continue
+		}
+		// One set per address family, since a set holds a single type
+		for _, family := range []string{FamilyIPv4, FamilyIPv6} {
+			var dests []string
+			for _, dest := range g.dests {
+				if addressFamily(dest) == family {
+					dests = append(dests, dest)
+				}
+			}
+			selector, setType := "ip daddr", "ipv4_addr"
+			if family == FamilyIPv6 {
+				selector, setType = "ip6 daddr", "ipv6_addr"
+			}
+			switch len(dests) {
+			case 0:
+				continue
+			case 1:
+				selector += " " + dests[0]
+			default:
+				name := fmt.Sprintf("addresses_%d_%s", i, family)
+				fmt.Fprintf(&sets, "\tset %s {\n\t\ttype %s\n\t\tflags interval\n\t\tauto-merge\n", name, setType)
+				fmt.Fprintf(&sets, "\t\telements = { %s }\n\t}\n", strings.Join(dests, ", "))
+				selector += " @" + name
+			}
+			fmt.Fprintf(&chain, "\t\t%s %s\n", selector, nftStatement(g.first))
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n", nftTable, nftTable)
+	fmt.Fprintf(&b, "table inet %s {\n", nftTable)
+	b.WriteString(sets.String())
+	b.WriteString("\tchain output {\n")
+	b.WriteString("\t\ttype filter hook output priority filter; policy accept;\n")
+	b.WriteString(chain.String())
+	b.WriteString("\t}\n}\n")
+	return b.String()
+}
+
+// nftFamily restricts a rule without destination to one address family.
+func nftFamily(family string) string {
+	if family == "" {
+		return ""
+	}
+	return "meta nfproto " + family + " "
+}
+
+// nftStatement renders everything of a rule except its destination.
+func nftStatement(rule Rule) string {
+	var parts []string
+	if rule.OutIface != "" {
+		parts = append(parts, fmt.Sprintf("oifname %q", rule.OutIface))
+	}
+	if rule.UIDOwner != "" {
+		parts = append(parts, "meta skuid "+rule.UIDOwner)
+	}
+	if rule.GIDOwner != "" {
+		parts = append(parts, "meta skgid "+rule.GIDOwner)
+	}
+	ports := ""
+	switch len(rule.DPorts) {
+	case 0:
+	case 1:
+		ports = fmt.Sprint(rule.DPorts[0])
+	default:
+		ports = "{ " + joinPorts(rule.DPorts, ", ") + " }"
+	}
+	switch {
+	case rule.Proto != "" && ports != "":
+		parts = append(parts, rule.Proto+" dport "+ports)
+	case rule.Proto != "":
+		parts = append(parts, "meta l4proto "+rule.Proto)
+	case ports != "":
+		parts = append(parts, "meta l4proto { tcp, udp } th dport "+ports)
+	}
+	if rule.FlowPackets > 0 {
+		parts = append(parts, "ct state established", fmt.Sprintf("ct original packets <= %d", rule.FlowPackets))
+	}
+	switch rule.Action {
+	case Accept:
+		parts = append(parts, "accept")
+	case Queue:
+		parts = append(parts, fmt.Sprintf("queue num %d bypass", rule.Queue))
+	case Reject:
+		if rule.Proto == "tcp" {
+			parts = append(parts, "reject with tcp reset")
+		} else {
+			parts = append(parts, "reject")
+		}
+	default:
+		parts = append(parts, "drop")
+	}
+	return strings.Join(parts, " ")
+}
+
+func runNft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package blocker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNftRulesetOwners(t *testing.T) {
+	rules := Owners{UIDs: []string{"1000"}}.scope([]Rule{
+		{Dest: "93.184.216.34", Action: Reject},
+		{Dest: "151.101.1.140", Action: Reject},
+	})
+	ruleset := nftRuleset(rules)
+	for _, want := range []string{
+		"set addresses_0_ipv4 {",
+		"elements = { 93.184.216.34, 151.101.1.140 }",
+		"ip daddr @addresses_0_ipv4 meta skuid 1000 reject",
+	} {
+		if !strings.Contains(ruleset, want) {
+			t.Errorf("ruleset lacks %q:\n%s", want, ruleset)
+		}
+	}
+}
+
+func TestGroupRulesNeedGroupMatching(t *testing.T) {
+	owners := Owners{GIDs: []string{"1001"}}
+	if err := owners.check(NewIptablesFirewall()); err != nil {
+		t.Errorf("iptables refused a group rule: %v", err)
+	}
+	if err := owners.check(NewNftFirewall()); err == nil {
+		t.Error("nftables accepted a group rule it cannot enforce")
+	}
+
+	tb := newTestBlocker(t)
+	tb.fw.Groups = false
+	if err := tb.BlockWebsite("example.com", owners); err == nil {
+		t.Fatal("BlockWebsite accepted a group rule")
+	}
+	if err := tb.BlockWebsites([]WebsiteBlock{{Domain: "example.com", Owners: owners}, {Domain: "reddit.com"}}); err == nil {
+		t.Error("BlockWebsites accepted a group rule")
+	}
+	if tb.IsBlocked("example.com") || !tb.IsBlocked("reddit.com") {
+		t.Error("the group rule was recorded or the other rule was dropped")
+	}
+	for _, rule := range tb.fw.List() {
+		if rule.GIDOwner != "" {
+			t.Errorf("group rule %s was installed", rule)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package blocker
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BlockedFlow is an established connection to an address of a blocked
+// website, attributed to the process owning the socket.
+type BlockedFlow struct {
+	Connection
+	Rule string
+	// PID and Command are zero when the owning process could not be found.
+	PID     int
+	Command string
+	// Closed is set when the socket was destroyed; otherwise the firewall
+	// rules only drop its packets until it times out.
+	Closed bool
+}
+
+func (f BlockedFlow) String() string {
+	process := "unknown process"
+	if f.PID > 0 {
+		process = fmt.Sprintf("%s (PID %d)", f.Command, f.PID)
+	}
+	return fmt.Sprintf("%s -> %s blocked by rule %s, %s, UID %d",
+		net.JoinHostPort(f.LocalIP.String(), strconv.Itoa(f.LocalPort)),
+		net.JoinHostPort(f.RemoteIP.String(), strconv.Itoa(f.RemotePort)),
+		f.Rule, process, f.UID)
+}
+
+// MonitorNetworkTraffic finds established TCP connections to the resolved
+// addresses and ranges of blocked websites, closes them and returns them.
+// Connections opened before a block started would otherwise stay usable,
+// since browsers keep them alive. Each flow is only returned once.
+func (nb *NetworkBlocker) MonitorNetworkTraffic() ([]BlockedFlow, error) {
+	if len(nb.blockedDomains) == 0 {
+		nb.reportedFlows = nil
+		return nil, nil
+	}
+	conns, err := ReadEstablishedConnections()
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, ranges := nb.blockedAddresses()
+	seen := make(map[string]bool)
+	var flows []BlockedFlow
+	for _, conn := range conns {
+		rule, ok := addresses[conn.RemoteIP.String()]
+		if !ok {
+			rule, ok = matchRange(ranges, conn.RemoteIP)
+		}
+		if !ok || !nb.ownerMatches(rule, conn.UID) {
+			continue
+		}
+		key := flowKey(conn)
+		seen[key] = true
+		if nb.reportedFlows[key] {
+			continue
+		}
+		flows = append(flows, BlockedFlow{Connection: conn, Rule: rule})
+	}
+	nb.reportedFlows = seen
+	if len(flows) == 0 {
+		return nil, nil
+	}
+
+	owners := socketProcesses()
+	for i := range flows {
+		if pid, ok := owners[flows[i].Inode]; ok {
+			flows[i].PID = pid
+			flows[i].Command = processName(pid)
+		}
+		flows[i].Closed = destroySocket(flows[i].Connection) == nil
+	}
+	return flows, nil
+}
+
+type blockedRange struct {
+	network *net.IPNet
+	rule    string
+}
+
+// blockedAddresses maps the currently blocked addresses to their rules.
+func (nb *NetworkBlocker) blockedAddresses() (map[string]string, []blockedRange) {
+	addresses := make(map[string]string)
+	var ranges []blockedRange
+	for domain := range nb.blockedDomains {
+		for _, ip := range nb.liveAddresses(domain) {
+			addresses[ip] = domain
+		}
+		for _, cidr := range nb.ranges[domain] {
+			if _, network, err := net.ParseCIDR(cidr); err == nil {
+				ranges = append(ranges, blockedRange{network, domain})
+			}
+		}
+	}
+	return addresses, ranges
+}
+
+func matchRange(ranges []blockedRange, ip net.IP) (string, bool) {
+	for _, r := range ranges {
+		if r.network.Contains(ip) {
+			return r.rule, true
+		}
+	}
+	return "", false
+}
+
+// ownerMatches reports whether rule applies to sockets of uid.
+func (nb *NetworkBlocker) ownerMatches(rule string, uid int) bool {
+	owners := nb.owners[rule]
+	if owners.Empty() {
+		return true
+	}
+	for _, owner := range owners.UIDs {
+		if owner == strconv.Itoa(uid) {
+			return true
+		}
+	}
+	if len(owners.GIDs) == 0 {
+		return false
+	}
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return false
+	}
+	groups, _ := u.GroupIds()
+	for _, gid := range append(groups, u.Gid) {
+		for _, owner := range owners.GIDs {
+			if owner == gid {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func flowKey(conn Connection) string {
+	return fmt.Sprintf("%s:%d-%s:%d", conn.LocalIP, conn.LocalPort, conn.RemoteIP, conn.RemotePort)
+}
+
+// socketProcesses maps socket inodes to the PID of a process holding them.
+func socketProcesses() map[uint64]int {
+	owners := make(map[uint64]int)
+	procs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(filepath.Base(proc))
+		if err != nil {
+			continue
+		}
+		fds, err := os.ReadDir(filepath.Join(proc, "fd"))
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(proc, "fd", fd.Name()))
+			if err != nil || !strings.HasPrefix(target, "socket:[") {
+				continue
+			}
+			inode, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(target, "socket:["), "]"), 10, 64)
+			if err == nil {
+				owners[inode] = pid
+			}
+		}
+	}
+	return owners
+}
+
+func processName(pid int) string {
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(comm))
+}
+
+// destroySocket closes a TCP connection with ss, which needs a kernel
+// built with CONFIG_INET_DIAG_DESTROY.
+func destroySocket(conn Connection) error {
+	filter := fmt.Sprintf("dst %s dport = :%d src %s sport = :%d",
+		ssAddress(conn.RemoteIP), conn.RemotePort, ssAddress(conn.LocalIP), conn.LocalPort)
+	args := append([]string{"-K", "-t", "-n"}, strings.Fields(filter)...)
+	output, err := exec.Command("ss", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	// ss lists the sockets it destroyed after its header line
+	if len(strings.Split(strings.TrimSpace(string(output)), "\n")) < 2 {
+		return fmt.Errorf("socket was not destroyed")
+	}
+	return nil
+}
+
+func ssAddress(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String()
+	}
+	return "[" + ip.String() + "]"
+}
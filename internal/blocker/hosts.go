@@ -0,0 +1,247 @@
+package blocker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Keyphy owns a single fenced section of the hosts file and leaves every
+// other line alone.
+const (
+	hostsBegin = "# BEGIN KEYPHY"
+	hostsEnd   = "# END KEYPHY"
+	// legacyHostsMarker started the per-domain blocks of earlier versions.
+	legacyHostsMarker = "# Keyphy block "
+	selinuxXattr      = "security.selinux"
+)
+
+// hostsSection renders the managed section for entries, which map a rule to
+// the names it sinkholes, mapping each name to addresses. It is empty
+// without entries.
+func hostsSection(entries map[string][]string, addresses []string) string {
+	if len(entries) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(hostsBegin + "\n")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "# %s\n", key)
+		for _, address := range addresses {
+			for _, name := range entries[key] {
+				fmt.Fprintf(&b, "%s %s\n", address, name)
+			}
+		}
+	}
+	b.WriteString(hostsEnd + "\n")
+	return b.String()
+}
+
+// stripHostsSection removes the managed section and blocks left by earlier
+// versions from content. Only the sinkhole lines a legacy block wrote for
+// its own domain are dropped, so user entries following it survive.
+func stripHostsSection(content string) string {
+	lines := strings.Split(content, "\n")
+	var kept []string
+	inSection := false
+	legacyDomain := ""
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == hostsBegin:
+			inSection = true
+			continue
+		case inSection:
+			if trimmed == hostsEnd {
+				inSection = false
+			}
+			continue
+		case strings.HasPrefix(trimmed, legacyHostsMarker):
+			legacyDomain = strings.TrimSpace(strings.TrimPrefix(trimmed, legacyHostsMarker))
+			continue
+		case legacyDomain != "" && isLegacyEntry(line, legacyDomain):
+			continue
+		}
+		legacyDomain = ""
+		kept = append(kept, line)
+	}
+	return strings.TrimRight(strings.Join(kept, "\n"), "\n")
+}
+
+// isLegacyEntry reports whether line is a sinkhole line that earlier
+// versions wrote for domain, naming only domain and www.domain.
+func isLegacyEntry(line, domain string) bool {
+	if !isSinkholeEntry(line) {
+		return false
+	}
+	for _, name := range strings.Fields(line)[1:] {
+		if name != domain && name != "www."+domain {
+			return false
+		}
+	}
+	return true
+}
+
+// renderHosts returns content with the managed section replaced by the one
+// for entries.
+func renderHosts(content string, entries map[string][]string, addresses []string) string {
+	rest := stripHostsSection(content)
+	section := hostsSection(entries, addresses)
+	switch {
+	case section == "":
+		return rest + "\n"
+	case rest == "":
+		return section
+	}
+	return rest + "\n\n" + section
+}
+
+// parseHostsSection returns the entries of the managed section in content.
+func parseHostsSection(content string) map[string][]string {
+	entries := make(map[string][]string)
+	inSection := false
+	key := ""
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == hostsBegin:
+			inSection = true
+		case !inSection:
+		case trimmed == hostsEnd:
+			inSection = false
+		case strings.HasPrefix(trimmed, "# "):
+			key = strings.TrimPrefix(trimmed, "# ")
+			if _, ok := entries[key]; !ok {
+				entries[key] = nil
+			}
+		case key != "" && isSinkholeEntry(line):
+			for _, name := range strings.Fields(line)[1:] {
+				if !seen[key+" "+name] {
+					seen[key+" "+name] = true
+					entries[key] = append(entries[key], name)
+				}
+			}
+		}
+	}
+	return entries
+}
+
+// updateHosts applies edit to the entries of the managed section and writes
+// the hosts file if that changed it. Entries added by other keyphy
+// processes are kept.
+func (nb *NetworkBlocker) updateHosts(edit func(entries map[string][]string)) error {
+	content, err := os.ReadFile(nb.hostsFile)
+	if err != nil {
+		return err
+	}
+	entries := parseHostsSection(string(content))
+	edit(entries)
+	section := hostsSection(entries, nb.hostsAddresses())
+	if reflect.DeepEqual(entries, parseHostsSection(string(content))) && strings.Contains(string(content), section) && !strings.Contains(string(content), legacyHostsMarker) {
+		return nil
+	}
+	updated := renderHosts(string(content), entries, nb.hostsAddresses())
+	if updated == string(content) {
+		return nil
+	}
+
+	nb.UnprotectHostsFile()
+	defer nb.ProtectHostsFile()
+	return writeFileAtomic(nb.hostsFile, []byte(updated))
+}
+
+// hostsFileCurrent reports whether the managed section still holds every
+// entry this blocker added.
+func (nb *NetworkBlocker) hostsFileCurrent() (bool, error) {
+	content, err := os.ReadFile(nb.hostsFile)
+	if err != nil {
+		return false, err
+	}
+	entries := parseHostsSection(string(content))
+	for key, names := range nb.hostsEntries {
+		if !equalStrings(entries[key], names) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// writeFileAtomic replaces path through a temporary file in the same
+// directory, keeping the mode, owner and SELinux label of the original, so
+// readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".keyphy-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := os.Chown(tmp.Name(), int(stat.Uid), int(stat.Gid)); err != nil {
+			return err
+		}
+	}
+	if label := getXattr(path, selinuxXattr); label != nil {
+		// Without the label, confined services could no longer read it
+		if err := syscall.Setxattr(tmp.Name(), selinuxXattr, label, 0); err != nil {
+			return fmt.Errorf("failed to copy SELinux label: %v", err)
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// getXattr returns the value of an extended attribute, or nil if it is not
+// set or not supported.
+func getXattr(path, name string) []byte {
+	size, err := syscall.Getxattr(path, name, nil)
+	if err != nil || size <= 0 {
+		return nil
+	}
+	value := make([]byte, size)
+	size, err = syscall.Getxattr(path, name, value)
+	if err != nil {
+		return nil
+	}
+	return value[:size]
+}
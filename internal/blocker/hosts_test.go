@@ -0,0 +1,86 @@
+package blocker
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+// checkGolden compares got with testdata/name, rewriting it with -update.
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("%s mismatch\n--- got ---\n%s\n--- want ---\n%s", name, got, want)
+	}
+}
+
+func TestStripHostsSection(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "strip_*.in"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no test inputs found")
+	}
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".in")
+		t.Run(name, func(t *testing.T) {
+			content, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, name+".golden", stripHostsSection(string(content)))
+		})
+	}
+}
+
+var testEntries = map[string][]string{
+	"example.com":      {"example.com", "www.example.com"},
+	"*.reddit.com":     {"reddit.com", "www.reddit.com", "m.reddit.com"},
+	"=www.example.org": {"www.example.org"},
+}
+
+func TestHostsSection(t *testing.T) {
+	section := hostsSection(testEntries, sinkholeAddresses)
+	checkGolden(t, "section.golden", section)
+
+	if got := parseHostsSection(section); !reflect.DeepEqual(got, testEntries) {
+		t.Errorf("parseHostsSection did not round trip: %v", got)
+	}
+	if got := hostsSection(nil, sinkholeAddresses); got != "" {
+		t.Errorf("hostsSection without entries = %q, want empty", got)
+	}
+}
+
+func TestRenderHosts(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("testdata", "strip_legacy_user_entry.in"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered := renderHosts(string(content), testEntries, sinkholeAddresses)
+	checkGolden(t, "render.golden", rendered)
+
+	// Rendering again must not change anything
+	if again := renderHosts(rendered, testEntries, sinkholeAddresses); again != rendered {
+		t.Errorf("renderHosts is not idempotent:\n%s", again)
+	}
+	if got := renderHosts(rendered, nil, sinkholeAddresses); got != stripHostsSection(string(content))+"\n" {
+		t.Errorf("renderHosts without entries left:\n%s", got)
+	}
+}
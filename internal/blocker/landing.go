@@ -0,0 +1,56 @@
+package blocker
+
+import "fmt"
+
+// priorityLanding lets requests to the landing page through before the
+// payload rules drop them for naming a blocked host.
+const priorityLanding = -10
+
+// SetLandingAddress points the IPv4 hosts entries of blocked names at the
+// loopback address the daemon serves its landing page on. An empty address
+// restores the plain sinkhole.
+func (nb *NetworkBlocker) SetLandingAddress(address string) error {
+	if address == nb.landingAddress {
+		return nil
+	}
+	nb.landingAddress = address
+	// Rewriting the section moves every entry to the new address
+	if err := nb.updateHosts(func(entries map[string][]string) {}); err != nil {
+		return fmt.Errorf("failed to update hosts entries: %v", err)
+	}
+	return nb.syncLanding()
+}
+
+// syncLanding installs the landing page rules while websites are blocked:
+// HTTP to the landing address is accepted and HTTPS is reset right away.
+func (nb *NetworkBlocker) syncLanding() error {
+	var rules []Rule
+	if nb.landingAddress != "" && len(nb.globalDomains()) > 0 {
+		rules = []Rule{
+			{Priority: priorityLanding, Proto: "tcp", Dest: nb.landingAddress, DPorts: []int{80}, Action: Accept},
+			{Priority: priorityLanding, Proto: "tcp", Dest: nb.landingAddress, DPorts: []int{443}, Action: Reject},
+		}
+	}
+	if len(rules) == len(nb.landingRules) && equalRules(rules, nb.landingRules) {
+		return nil
+	}
+	if err := nb.fw.Replace(nb.landingRules, rules); err != nil {
+		return err
+	}
+	nb.landingRules = rules
+	return nil
+}
+
+// hostsAddresses returns the addresses blocked names are mapped to.
+func (nb *NetworkBlocker) hostsAddresses() []string {
+	if nb.landingAddress == "" {
+		return sinkholeAddresses
+	}
+	addresses := []string{nb.landingAddress}
+	for _, address := range sinkholeAddresses {
+		if address != "127.0.0.1" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
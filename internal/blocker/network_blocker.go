@@ -1,46 +1,174 @@
 package blocker
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"net"
 	"os/exec"
 	"strings"
+	"time"
+
+	"github.com/gajzzs/keyphy/internal/matcher"
+	"github.com/gajzzs/keyphy/internal/resolver"
+)
+
+// sinkholeAddresses are written for blocked names in the hosts file, so
+// lookups fail over both IPv4 and IPv6.
+var sinkholeAddresses = []string{"127.0.0.1", "0.0.0.0", "::1", "::"}
+
+// isSinkholeEntry reports whether a hosts line maps a name to one of the
+// sinkhole addresses or a loopback landing page address.
+func isSinkholeEntry(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+	for _, address := range sinkholeAddresses {
+		if fields[0] == address {
+			return true
+		}
+	}
+	ip := net.ParseIP(fields[0])
+	return ip != nil && ip.IsLoopback()
+}
+
+// Rule priorities: website blocks come before the allowlist policy, whose
+// final reject would otherwise hide them. The final reject has its own
+// priority, so addresses accepted later still come before it.
+const (
+	priorityBlock         = 0
+	priorityAllowlist     = 100
+	priorityAllowlistDeny = 110
 )
 
 type NetworkBlocker struct {
 	blockedDomains map[string]bool
-	ipBlocksAdded  bool
-	dohBlocksAdded bool
+	fw             Firewall
+	hostsFile      string
+	hostsEntries   map[string][]string
+	lookup         Resolver
+	pending        *AddressLookup
+	policyRoot     string
+	websiteRules   map[string][]Rule
+	ranges         map[string][]string
+	owners         map[string]Owners
+	resolved       map[string]*resolvedDomain
+	encryptedDNS   EncryptedDNS
+	bypassRules    []Rule
+	bypassActive   bool
+	bypassResolved time.Time
+	quicMode       string
+	quicActive     bool
+	sniEnabled     bool
+	sniActive      bool
+	policyEnabled  bool
+	policyActive   bool
+	policyOptions  BrowserPolicyOptions
+	landingAddress string
+	landingRules   []Rule
+	allowActive    bool
+	allowRules     []Rule
+	allowedDomains []string
+	allowUpstreams []string
+	pinnedIPs      map[string]bool
+	allowRefreshed time.Time
+	reportedFlows  map[string]bool
+	// circumventionRules block detected VPN interfaces and Tor
+	circumventionRules []Rule
+}
+
+// Resolver looks up the addresses of name together with their TTLs.
+type Resolver func(name string) ([]resolver.Address, error)
+
+// Option changes where a NetworkBlocker reads and writes host state.
+type Option func(*NetworkBlocker)
+
+// WithHostsFile manages path instead of /etc/hosts.
+func WithHostsFile(path string) Option {
+	return func(nb *NetworkBlocker) {
+		nb.hostsFile = path
+	}
+}
+
+// WithResolver resolves blocked names through lookup instead of the
+// upstream nameservers.
+func WithResolver(lookup Resolver) Option {
+	return func(nb *NetworkBlocker) {
+		nb.lookup = lookup
+	}
+}
+
+// WithPolicyRoot writes browser policies below root instead of /.
+func WithPolicyRoot(root string) Option {
+	return func(nb *NetworkBlocker) {
+		nb.policyRoot = root
+	}
 }
 
-func NewNetworkBlocker() *NetworkBlocker {
-	return &NetworkBlocker{
+// NewNetworkBlocker creates a blocker that installs its packet filter rules
+// through fw.
+func NewNetworkBlocker(fw Firewall, options ...Option) *NetworkBlocker {
+	nb := &NetworkBlocker{
 		blockedDomains: make(map[string]bool),
+		fw:             fw,
+		hostsFile:      "/etc/hosts",
+		hostsEntries:   make(map[string][]string),
+		lookup:         lookupUpstream,
+		policyRoot:     "/",
+		websiteRules:   make(map[string][]Rule),
+		ranges:         make(map[string][]string),
+		owners:         make(map[string]Owners),
+		resolved:       make(map[string]*resolvedDomain),
+		encryptedDNS:   MergeEncryptedDNS(EncryptedDNS{}, true),
+		quicMode:       QUICBlockAll,
 	}
+	for _, option := range options {
+		option(nb)
+	}
+	return nb
 }
 
-func (nb *NetworkBlocker) BlockWebsite(domain string) error {
-	nb.blockedDomains[domain] = true
-	
-	// Block both domain and www subdomain
-	domains := []string{domain}
-	if !strings.HasPrefix(domain, "www.") {
-		domains = append(domains, "www."+domain)
+// Backend returns the firewall backend in use.
+func (nb *NetworkBlocker) Backend() string {
+	return nb.fw.Name()
+}
+
+// BlockWebsite blocks a website rule for owners, or for everyone when
+// owners is empty. Optional ranges are CIDRs that belong to the site and
+// are blocked along with its resolved addresses.
+func (nb *NetworkBlocker) BlockWebsite(domain string, owners Owners, ranges ...string) error {
+	rule, err := matcher.Parse(domain)
+	if err != nil {
+		return err
+	}
+	if err := owners.check(nb.fw); err != nil {
+		return err
 	}
 	
-	for _, d := range domains {
-		// Add to /etc/hosts
-		fmt.Printf("Adding %s to hosts file...\n", d)
-		if err := nb.addToHosts(d); err != nil {
-			return fmt.Errorf("failed to add %s to hosts: %v", d, err)
-		}
-		
-		// Block DNS queries
-		fmt.Printf("Creating iptables rules for %s...\n", d)
-		if err := nb.blockDNS(d); err != nil {
-			return fmt.Errorf("failed to block DNS for %s: %v", d, err)
-		}
+	// Block DNS queries and HTTP/HTTPS connections
+	fmt.Printf("Creating %s rules for %s...\n", nb.fw.Name(), domain)
+	nb.resolveDomain(rule, time.Now())
+	rules := nb.websiteRuleset(rule, owners, ranges)
+	if err := nb.fw.Replace(nb.websiteRules[domain], rules); err != nil {
+		return fmt.Errorf("failed to block DNS for %s: %v", domain, err)
 	}
+	// The rule only counts as blocked once its firewall rules are in place
+	nb.websiteRules[domain] = rules
+	nb.blockedDomains[domain] = true
+	nb.ranges[domain] = ranges
+	nb.owners[domain] = owners
+	
+	// Update /etc/hosts (regex rules cannot be expressed there)
+	var names []string
+	if owners.Empty() {
+		names = rule.HostsNames()
+	} else {
+		fmt.Printf("Blocking %s for %s only, hosts file left unchanged\n", domain, owners)
+	}
+	if err := nb.setHostsEntry(domain, names); err != nil {
+		return fmt.Errorf("failed to update hosts entry for %s: %v", domain, err)
+	}
+	nb.syncProtections()
 	
 	fmt.Printf("Website blocking rules created successfully for %s\n", domain)
 	return nil
@@ -56,357 +184,278 @@ func (nb *NetworkBlocker) UnblockWebsite(domain string) error {
 	}
 	
 	// Unblock DNS queries
-	fmt.Printf("Removing iptables rules for %s...\n", domain)
+	fmt.Printf("Removing %s rules for %s...\n", nb.fw.Name(), domain)
 	if err := nb.unblockDNS(domain); err != nil {
 		return fmt.Errorf("failed to unblock DNS: %v", err)
 	}
+	if len(nb.globalDomains()) == 0 {
+		if err := nb.unblockEncryptedDNS(); err != nil {
+			return fmt.Errorf("failed to unblock encrypted DNS: %v", err)
+		}
+	}
+	if err := nb.syncQUIC(); err != nil {
+		return fmt.Errorf("failed to unblock QUIC: %v", err)
+	}
+	if err := nb.syncSNI(); err != nil {
+		return fmt.Errorf("failed to stop SNI inspection: %v", err)
+	}
+	if err := nb.syncBrowserPolicies(); err != nil {
+		return fmt.Errorf("failed to update browser policies: %v", err)
+	}
+	if err := nb.syncLanding(); err != nil {
+		return fmt.Errorf("failed to remove landing page rules: %v", err)
+	}
 	
 	fmt.Printf("Website unblocking completed for %s\n", domain)
 	return nil
 }
 
-func (nb *NetworkBlocker) IsBlocked(domain string) bool {
-	return nb.blockedDomains[domain]
+// IsBlocked reports whether any active website rule covers host.
+func (nb *NetworkBlocker) IsBlocked(host string) bool {
+	_, blocked := nb.MatchingRule(host)
+	return blocked
 }
 
-func (nb *NetworkBlocker) blockDNS(domain string) error {
-	// Check if rule already exists to prevent duplicates
-	if nb.ruleExists(domain) {
-		return nil
-	}
-	
-	// Block DNS queries using iptables
-	cmd := exec.Command("iptables", "-I", "OUTPUT", "1", "-p", "udp", "--dport", "53", "-m", "string", "--string", domain, "--algo", "bm", "-j", "DROP")
-	if err := cmd.Run(); err != nil {
-		return err
-	}
-	
-	// Also block TCP DNS
-	cmd = exec.Command("iptables", "-I", "OUTPUT", "1", "-p", "tcp", "--dport", "53", "-m", "string", "--string", domain, "--algo", "bm", "-j", "DROP")
-	if err := cmd.Run(); err != nil {
-		return err
-	}
-	
-	// Block HTTPS connections to domain
-	cmd = exec.Command("iptables", "-I", "OUTPUT", "1", "-p", "tcp", "--dport", "443", "-m", "string", "--string", domain, "--algo", "bm", "-j", "DROP")
-	cmd.Run()
-	
-	// Block HTTP connections to domain  
-	cmd = exec.Command("iptables", "-I", "OUTPUT", "1", "-p", "tcp", "--dport", "80", "-m", "string", "--string", domain, "--algo", "bm", "-j", "DROP")
-	cmd.Run()
-	
-	// Block systemd-resolved on port 53 (127.0.0.53)
-	cmd = exec.Command("iptables", "-I", "OUTPUT", "1", "-d", "127.0.0.53", "-p", "udp", "--dport", "53", "-m", "string", "--string", domain, "--algo", "bm", "-j", "DROP")
-	cmd.Run()
-	
-	cmd = exec.Command("iptables", "-I", "OUTPUT", "1", "-d", "127.0.0.53", "-p", "tcp", "--dport", "53", "-m", "string", "--string", domain, "--algo", "bm", "-j", "DROP")
-	cmd.Run()
-	
-
-	
-	// Block DNS-over-HTTPS servers - only once
-	if !nb.dohBlocksAdded {
-		dohServers := []string{"1.1.1.1", "8.8.8.8", "9.9.9.9", "208.67.222.222"}
-		for _, server := range dohServers {
-			cmd = exec.Command("iptables", "-I", "OUTPUT", "1", "-p", "tcp", "-d", server, "--dport", "443", "-j", "DROP")
-			cmd.Run() // Ignore errors
+// MatchingRule returns the active website rule covering host.
+func (nb *NetworkBlocker) MatchingRule(host string) (string, bool) {
+	for domain := range nb.blockedDomains {
+		if rule, err := matcher.Parse(domain); err == nil && rule.Matches(host) {
+			return domain, true
 		}
-		nb.dohBlocksAdded = true
 	}
-	
-	return nil
+	return "", false
 }
 
-func (nb *NetworkBlocker) unblockDNS(domain string) error {
-	// Remove DNS blocking rules
-	cmd := exec.Command("iptables", "-D", "OUTPUT", "-p", "udp", "--dport", "53", "-m", "string", "--string", domain, "--algo", "bm", "-j", "DROP")
-	cmd.Run()
-	
-	cmd = exec.Command("iptables", "-D", "OUTPUT", "-p", "tcp", "--dport", "53", "-m", "string", "--string", domain, "--algo", "bm", "-j", "DROP")
-	cmd.Run()
-	
-	// Remove HTTPS/HTTP blocking
-	cmd = exec.Command("iptables", "-D", "OUTPUT", "-p", "tcp", "--dport", "443", "-m", "string", "--string", domain, "--algo", "bm", "-j", "DROP")
-	cmd.Run()
-	
-	cmd = exec.Command("iptables", "-D", "OUTPUT", "-p", "tcp", "--dport", "80", "-m", "string", "--string", domain, "--algo", "bm", "-j", "DROP")
-	cmd.Run()
-	
-	// Remove systemd-resolved blocks
-	cmd = exec.Command("iptables", "-D", "OUTPUT", "-d", "127.0.0.53", "-p", "udp", "--dport", "53", "-m", "string", "--string", domain, "--algo", "bm", "-j", "DROP")
-	cmd.Run()
-	
-	cmd = exec.Command("iptables", "-D", "OUTPUT", "-d", "127.0.0.53", "-p", "tcp", "--dport", "53", "-m", "string", "--string", domain, "--algo", "bm", "-j", "DROP")
-	cmd.Run()
-	
-
-	
-	return nil
+// WebsiteBlock is one website rule for BlockWebsites.
+type WebsiteBlock struct {
+	Domain string
+	Owners Owners
+	Ranges []string
 }
 
-func (nb *NetworkBlocker) addToHosts(domain string) error {
-	// Temporarily remove immutable flag
-	nb.UnprotectHostsFile()
-	defer nb.ProtectHostsFile()
-	
-	// Read current hosts file
-	hostsFile := "/etc/hosts"
-	content, err := os.ReadFile(hostsFile)
-	if err != nil {
-		return err
+// BlockWebsites blocks many website rules at once, as after an import: the
+// hosts file is written once and all their firewall rules are committed in
+// a single Replace. Their addresses are not looked up here but are due for
+// the next RefreshAddresses, so the caller does not wait on DNS. Invalid
+// rules are skipped and reported in the returned error.
+func (nb *NetworkBlocker) BlockWebsites(blocks []WebsiteBlock) error {
+	var errs []error
+	var old, new []Rule
+	type pending struct {
+		rule  *matcher.Rule
+		block WebsiteBlock
 	}
-	
-	// Check if domain already blocked (check for exact keyphy block)
-	hostsContent := string(content)
-	keyphyBlock := fmt.Sprintf("# Keyphy block %s", domain)
-	if strings.Contains(hostsContent, keyphyBlock) {
-		return nil // Already blocked
+	var valid []pending
+	rulesets := make(map[string][]Rule)
+	for _, block := range blocks {
+		rule, err := matcher.Parse(block.Domain)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := block.Owners.check(nb.fw); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", block.Domain, err))
+			continue
+		}
+		domain := rule.String()
+		if _, seen := rulesets[domain]; seen {
+			continue
+		}
+		rulesets[domain] = nb.websiteRuleset(rule, block.Owners, block.Ranges)
+		old = append(old, nb.websiteRules[domain]...)
+		new = append(new, rulesets[domain]...)
+		valid = append(valid, pending{rule, block})
 	}
-	
-	// Add blocking entries with unique marker
-	newContent := hostsContent + fmt.Sprintf("\n# Keyphy block %s\n127.0.0.1 %s\n127.0.0.1 www.%s\n0.0.0.0 %s\n0.0.0.0 www.%s\n", domain, domain, domain, domain, domain)
-	
-	return os.WriteFile(hostsFile, []byte(newContent), 0600)
-}
 
-func (nb *NetworkBlocker) removeFromHosts(domain string) error {
-	// Temporarily remove immutable flag
-	nb.UnprotectHostsFile()
-	defer nb.ProtectHostsFile()
-	
-	// Read current hosts file
-	hostsFile := "/etc/hosts"
-	content, err := os.ReadFile(hostsFile)
-	if err != nil {
-		return err
+	fmt.Printf("Creating %s rules for %d website(s)...\n", nb.fw.Name(), len(rulesets))
+	if err := nb.fw.Replace(old, new); err != nil {
+		errs = append(errs, err)
+		return errors.Join(errs...)
 	}
-	
-	// Remove keyphy block section for this domain
-	lines := strings.Split(string(content), "\n")
-	var newLines []string
-	inKeyphyBlock := false
-	keyphyBlockMarker := fmt.Sprintf("# Keyphy block %s", domain)
-	
-	for _, line := range lines {
-		if line == keyphyBlockMarker {
-			inKeyphyBlock = true
-			continue
+
+	// Only the hosts entries that change are written, all in one go
+	added := make(map[string][]string)
+	var removed []string
+	for _, p := range valid {
+		rule, block := p.rule, p.block
+		domain := rule.String()
+		nb.websiteRules[domain] = rulesets[domain]
+		nb.blockedDomains[domain] = true
+		nb.ranges[domain] = block.Ranges
+		nb.owners[domain] = block.Owners
+
+		current, present := nb.hostsEntries[domain]
+		var names []string
+		if block.Owners.Empty() {
+			names = rule.HostsNames()
 		}
-		if inKeyphyBlock && (strings.Contains(line, domain) || strings.HasPrefix(line, "127.0.0.1") || strings.HasPrefix(line, "0.0.0.0")) {
-			continue // Skip keyphy block lines
+		if len(names) == 0 && present {
+			removed = append(removed, domain)
+			delete(nb.hostsEntries, domain)
+		} else if len(names) > 0 && !equalStrings(current, names) {
+			added[domain] = names
+			nb.hostsEntries[domain] = names
 		}
-		if inKeyphyBlock && strings.HasPrefix(line, "#") {
-			inKeyphyBlock = false // End of this block
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		fmt.Printf("Updating hosts file for %d website(s)...\n", len(added)+len(removed))
+		err := nb.updateHosts(func(entries map[string][]string) {
+			for _, domain := range removed {
+				delete(entries, domain)
+			}
+			for domain, names := range added {
+				entries[domain] = names
+			}
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to update hosts: %v", err))
 		}
-		newLines = append(newLines, line)
 	}
-	
-	newContent := strings.Join(newLines, "\n")
-	return os.WriteFile(hostsFile, []byte(newContent), 0600)
+	nb.syncProtections()
+	return errors.Join(errs...)
 }
 
-func (nb *NetworkBlocker) MonitorNetworkTraffic() error {
-	// Monitor network connections using netstat or ss
-	cmd := exec.Command("ss", "-tuln")
-	output, err := cmd.Output()
-	if err != nil {
-		return err
+// websiteRuleset returns the firewall rules for rule from its payload
+// patterns, ranges and the addresses resolved so far, limited to owners.
+func (nb *NetworkBlocker) websiteRuleset(rule *matcher.Rule, owners Owners, ranges []string) []Rule {
+	var rules []Rule
+	if nb.fw.PayloadMatching() {
+		rules = payloadRules(rule)
 	}
-	
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		// Parse connections and check against blocked domains
-		if nb.shouldBlockConnection(line) {
-			// Block the connection
-			nb.blockConnection(line)
-		}
+	rules = append(rules, addressRules(ranges)...)
+	rules = append(rules, addressRules(nb.liveAddresses(rule.String()))...)
+	return owners.scope(rules)
+}
+
+func (nb *NetworkBlocker) blockDNS(rule *matcher.Rule) error {
+	nb.resolveDomain(rule, time.Now())
+	rules := nb.websiteRuleset(rule, nb.owners[rule.String()], nb.ranges[rule.String()])
+	if err := nb.fw.Replace(nb.websiteRules[rule.String()], rules); err != nil {
+		return err
 	}
-	
+	nb.websiteRules[rule.String()] = rules
+	nb.syncProtections()
 	return nil
 }
 
-func (nb *NetworkBlocker) shouldBlockConnection(connection string) bool {
-	for domain := range nb.blockedDomains {
-		if strings.Contains(connection, domain) {
-			return true
+// syncProtections brings the layers shared by all blocked websites in line
+// with them. Failures only weaken the block, so they are warnings.
+func (nb *NetworkBlocker) syncProtections() {
+	// Block encrypted DNS resolvers - only once
+	if !nb.bypassActive && len(nb.globalDomains()) > 0 {
+		if err := nb.blockEncryptedDNS(); err != nil {
+			fmt.Printf("Warning: failed to block encrypted DNS: %v\n", err)
 		}
 	}
-	return false
-}
-
-func (nb *NetworkBlocker) blockConnection(connection string) error {
-	// Parse connection string to extract IP and port
-	fields := strings.Fields(connection)
-	if len(fields) < 5 {
-		return nil // Invalid connection format
+	if err := nb.syncQUIC(); err != nil {
+		fmt.Printf("Warning: failed to block QUIC: %v\n", err)
 	}
-	
-	// Extract destination IP from connection
-	destAddr := fields[4]
-	if strings.Contains(destAddr, ":") {
-		parts := strings.Split(destAddr, ":")
-		if len(parts) >= 1 {
-			ip := parts[0]
-			// Block this specific IP
-			cmd := exec.Command("iptables", "-I", "OUTPUT", "1", "-d", ip, "-j", "DROP")
-			cmd.Run()
-		}
+	if err := nb.syncSNI(); err != nil {
+		fmt.Printf("Warning: failed to enable SNI inspection: %v\n", err)
+	}
+	if err := nb.syncBrowserPolicies(); err != nil {
+		fmt.Printf("Warning: failed to write browser policies: %v\n", err)
+	}
+	if err := nb.syncLanding(); err != nil {
+		fmt.Printf("Warning: failed to allow the landing page: %v\n", err)
 	}
-	return nil
 }
 
-func (nb *NetworkBlocker) VerifyHostsFile() error {
-	// Check if blocked domains are still in hosts file
-	hostsFile := "/etc/hosts"
-	content, err := os.ReadFile(hostsFile)
-	if err != nil {
+func (nb *NetworkBlocker) unblockDNS(domain string) error {
+	if err := nb.fw.Remove(nb.websiteRules[domain]...); err != nil {
 		return err
 	}
-	
-	hostsContent := string(content)
-	modified := false
-	
-	// Check each blocked domain
-	for domain := range nb.blockedDomains {
-		blockEntry := fmt.Sprintf("127.0.0.1 %s", domain)
-		if !strings.Contains(hostsContent, blockEntry) {
-			// Domain block was removed, restore it
-			if err := nb.addToHosts(domain); err != nil {
-				return fmt.Errorf("failed to restore hosts entry for %s: %v", domain, err)
-			}
-			modified = true
-		}
-	}
-	
-	if modified {
-		// Also restore DNS blocks
-		for domain := range nb.blockedDomains {
-			nb.blockDNS(domain)
-		}
-	}
-	
+	delete(nb.websiteRules, domain)
+	delete(nb.ranges, domain)
+	delete(nb.owners, domain)
+	delete(nb.resolved, domain)
 	return nil
 }
 
+// setHostsEntry makes names the hosts entry of key, or removes the entry
+// when names is empty. The file is only touched when the entry changes.
+func (nb *NetworkBlocker) setHostsEntry(key string, names []string) error {
+	current, present := nb.hostsEntries[key]
+	switch {
+	case len(names) == 0 && !present, len(names) > 0 && equalStrings(current, names):
+		return nil
+	case len(names) == 0:
+		fmt.Printf("Removing %s from hosts file...\n", key)
+		return nb.removeFromHosts(key)
+	}
+	fmt.Printf("Adding %s to hosts file...\n", key)
+	return nb.addToHosts(key, names)
+}
+
+// addToHosts sinkholes names in the managed hosts section under key.
+func (nb *NetworkBlocker) addToHosts(key string, names []string) error {
+	nb.hostsEntries[key] = names
+	return nb.updateHosts(func(entries map[string][]string) {
+		entries[key] = names
+	})
+}
+
+func (nb *NetworkBlocker) removeFromHosts(key string) error {
+	delete(nb.hostsEntries, key)
+	return nb.updateHosts(func(entries map[string][]string) {
+		delete(entries, key)
+	})
+}
+
 func (nb *NetworkBlocker) ProtectHostsFile() error {
 	// Make hosts file immutable to prevent tampering
-	cmd := exec.Command("chattr", "+i", "/etc/hosts")
+	cmd := exec.Command("chattr", "+i", nb.hostsFile)
 	return cmd.Run()
 }
 
 func (nb *NetworkBlocker) UnprotectHostsFile() error {
 	// Remove immutable flag from hosts file
-	cmd := exec.Command("chattr", "-i", "/etc/hosts")
+	cmd := exec.Command("chattr", "-i", nb.hostsFile)
 	return cmd.Run()
 }
 
-func (nb *NetworkBlocker) ruleExists(domain string) bool {
-	// Check if iptables rule already exists for this domain
-	cmd := exec.Command("iptables", "-C", "OUTPUT", "-p", "udp", "--dport", "53", "-m", "string", "--string", domain, "--algo", "bm", "-j", "DROP")
-	return cmd.Run() == nil
-}
-
 func (nb *NetworkBlocker) UnblockAll() error {
-	// Remove all keyphy-related iptables rules
-	fmt.Println("Removing all iptables rules...")
-	nb.removeAllIptablesRules()
+	// Remove all keyphy-related firewall rules
+	fmt.Printf("Removing all %s rules...\n", nb.fw.Name())
+	if err := nb.fw.Flush(); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+	nb.websiteRules = make(map[string][]Rule)
+	nb.ranges = make(map[string][]string)
+	nb.owners = make(map[string]Owners)
+	nb.resolved = make(map[string]*resolvedDomain)
+	nb.allowActive = false
+	nb.allowRules = nil
+	nb.allowedDomains = nil
+	nb.allowUpstreams = nil
+	nb.pinnedIPs = nil
 	
 	// Clear blocked domains map
 	nb.blockedDomains = make(map[string]bool)
-	nb.ipBlocksAdded = false
-	nb.dohBlocksAdded = false
-	
-	// Clean hosts file
-	fmt.Println("Cleaning hosts file...")
-	nb.UnprotectHostsFile()
-	defer nb.ProtectHostsFile()
-	
-	// Remove all keyphy entries from hosts file
-	hostsFile := "/etc/hosts"
-	content, err := os.ReadFile(hostsFile)
-	if err != nil {
-		return err
+	nb.bypassRules = nil
+	nb.bypassActive = false
+	nb.quicActive = false
+	nb.sniActive = false
+	nb.landingRules = nil
+	nb.circumventionRules = nil
+	
+	fmt.Println("Removing browser policies...")
+	if err := nb.removeBrowserPolicies(); err != nil {
+		fmt.Printf("Warning: %v\n", err)
 	}
+	nb.policyActive = false
 	
-	lines := strings.Split(string(content), "\n")
-	var newLines []string
-	inKeyphyBlock := false
-	
-	for _, line := range lines {
-		if strings.HasPrefix(line, "# Keyphy block") {
-			inKeyphyBlock = true
-			continue
-		}
-		if inKeyphyBlock && (strings.HasPrefix(line, "127.0.0.1") || strings.HasPrefix(line, "0.0.0.0")) {
-			continue
-		}
-		if inKeyphyBlock && line == "" {
-			inKeyphyBlock = false
+	// Clean hosts file, including blocks written by earlier versions
+	fmt.Println("Cleaning hosts file...")
+	nb.hostsEntries = make(map[string][]string)
+	err := nb.updateHosts(func(entries map[string][]string) {
+		for key := range entries {
+			delete(entries, key)
 		}
-		newLines = append(newLines, line)
-	}
-	
-	newContent := strings.Join(newLines, "\n")
-	if err := os.WriteFile(hostsFile, []byte(newContent), 0600); err != nil {
+	})
+	if err != nil {
 		return err
 	}
 	fmt.Println("All network blocking rules removed successfully")
 	return nil
 }
-
-func (nb *NetworkBlocker) removeAllIptablesRules() {
-	
-	// Remove all DoH server blocks
-	dohServers := []string{"1.1.1.1", "8.8.8.8", "9.9.9.9", "208.67.222.222"}
-	for _, server := range dohServers {
-		for {
-			cmd := exec.Command("iptables", "-D", "OUTPUT", "-p", "tcp", "-d", server, "--dport", "443", "-j", "DROP")
-			if cmd.Run() != nil {
-				break
-			}
-		}
-	}
-	
-	// Remove all string matching rules for blocked domains
-	for domain := range nb.blockedDomains {
-		// Remove DNS rules
-		for {
-			cmd := exec.Command("iptables", "-D", "OUTPUT", "-p", "udp", "--dport", "53", "-m", "string", "--string", domain, "--algo", "bm", "-j", "DROP")
-			if cmd.Run() != nil {
-				break
-			}
-		}
-		for {
-			cmd := exec.Command("iptables", "-D", "OUTPUT", "-p", "tcp", "--dport", "53", "-m", "string", "--string", domain, "--algo", "bm", "-j", "DROP")
-			if cmd.Run() != nil {
-				break
-			}
-		}
-		// Remove HTTP/HTTPS rules
-		for {
-			cmd := exec.Command("iptables", "-D", "OUTPUT", "-p", "tcp", "--dport", "80", "-m", "string", "--string", domain, "--algo", "bm", "-j", "DROP")
-			if cmd.Run() != nil {
-				break
-			}
-		}
-		for {
-			cmd := exec.Command("iptables", "-D", "OUTPUT", "-p", "tcp", "--dport", "443", "-m", "string", "--string", domain, "--algo", "bm", "-j", "DROP")
-			if cmd.Run() != nil {
-				break
-			}
-		}
-		// Remove systemd-resolved rules
-		for {
-			cmd := exec.Command("iptables", "-D", "OUTPUT", "-d", "127.0.0.53", "-p", "udp", "--dport", "53", "-m", "string", "--string", domain, "--algo", "bm", "-j", "DROP")
-			if cmd.Run() != nil {
-				break
-			}
-		}
-		for {
-			cmd := exec.Command("iptables", "-D", "OUTPUT", "-d", "127.0.0.53", "-p", "tcp", "--dport", "53", "-m", "string", "--string", domain, "--algo", "bm", "-j", "DROP")
-			if cmd.Run() != nil {
-				break
-			}
-		}
-	}
-}
\ No newline at end of file
@@ -0,0 +1,503 @@
+package blocker
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gajzzs/keyphy/internal/resolver"
+)
+
+const testHosts = "127.0.0.1 localhost\n192.168.1.10 nas.lan\n"
+
+var testAddresses = map[string][]string{
+	"example.com":     {"93.184.216.34", "2606:2800:220:1:248:1893:25c8:1946"},
+	"www.example.com": {"93.184.216.34"},
+	"reddit.com":      {"151.101.1.140"},
+	"example.net":     {"93.184.216.34"},
+}
+
+type testBlocker struct {
+	*NetworkBlocker
+	fw      *FakeFirewall
+	hosts   string
+	root    string
+	lookups []string
+}
+
+// newTestBlocker returns a blocker on a FakeFirewall that keeps its hosts
+// file and browser policies in a temporary directory and resolves names
+// from testAddresses.
+func newTestBlocker(t *testing.T) *testBlocker {
+	t.Helper()
+	dir := t.TempDir()
+	// The blocker makes the files it writes immutable where it can
+	t.Cleanup(func() { exec.Command("chattr", "-R", "-i", dir).Run() })
+
+	tb := &testBlocker{
+		fw:    NewFakeFirewall(),
+		hosts: filepath.Join(dir, "hosts"),
+		root:  filepath.Join(dir, "root"),
+	}
+	if err := os.WriteFile(tb.hosts, []byte(testHosts), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(name string) ([]resolver.Address, error) {
+		tb.lookups = append(tb.lookups, name)
+		var addrs []resolver.Address
+		for _, ip := range testAddresses[name] {
+			addrs = append(addrs, resolver.Address{IP: net.ParseIP(ip), TTL: time.Hour})
+		}
+		if len(addrs) == 0 {
+			return nil, errors.New("no such host")
+		}
+		return addrs, nil
+	}
+	tb.NetworkBlocker = NewNetworkBlocker(tb.fw,
+		WithHostsFile(tb.hosts),
+		WithResolver(lookup),
+		WithPolicyRoot(tb.root),
+	)
+	// The built in resolver list would be looked up through the resolver
+	tb.SetEncryptedDNS(EncryptedDNS{})
+	return tb
+}
+
+func (tb *testBlocker) readHosts(t *testing.T) string {
+	t.Helper()
+	content, err := os.ReadFile(tb.hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+// destinations returns the addresses the firewall rejects traffic to.
+func (tb *testBlocker) destinations() []string {
+	seen := make(map[string]bool)
+	var dests []string
+	for _, rule := range tb.fw.List() {
+		if rule.Dest != "" && !seen[rule.Dest] {
+			seen[rule.Dest] = true
+			dests = append(dests, rule.Dest)
+		}
+	}
+	return dests
+}
+
+func TestBlockWebsite(t *testing.T) {
+	tb := newTestBlocker(t)
+	if err := tb.BlockWebsite("example.com", Owners{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"example.com", "www.example.com"}; !reflect.DeepEqual(tb.lookups, want) {
+		t.Errorf("looked up %v, want %v", tb.lookups, want)
+	}
+	dests := tb.destinations()
+	for _, ip := range []string{"93.184.216.34", "2606:2800:220:1:248:1893:25c8:1946"} {
+		if !containsString(dests, ip) {
+			t.Errorf("firewall does not block %s: %v", ip, dests)
+		}
+	}
+	if len(tb.fw.Calls) == 0 {
+		t.Fatal("no firewall changes were committed")
+	}
+	for _, call := range tb.fw.Calls {
+		if !strings.HasPrefix(call, "commit ") {
+			t.Errorf("unexpected firewall call %q", call)
+		}
+	}
+
+	hosts := tb.readHosts(t)
+	if !strings.HasPrefix(hosts, testHosts) {
+		t.Errorf("user entries were changed:\n%s", hosts)
+	}
+	entries := parseHostsSection(hosts)
+	if want := []string{"example.com", "www.example.com"}; !reflect.DeepEqual(entries["example.com"], want) {
+		t.Errorf("hosts entries = %v, want %v", entries["example.com"], want)
+	}
+
+	// Blocking again changes nothing
+	calls := len(tb.fw.Calls)
+	if err := tb.BlockWebsite("example.com", Owners{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(tb.fw.Calls) != calls {
+		t.Errorf("blocking twice committed again: %v", tb.fw.Calls[calls:])
+	}
+}
+
+func TestBlockWebsiteScoped(t *testing.T) {
+	tb := newTestBlocker(t)
+	owners := Owners{UIDs: []string{"1000"}}
+	if err := tb.BlockWebsite("example.com", owners); err != nil {
+		t.Fatal(err)
+	}
+	if hosts := tb.readHosts(t); hosts != testHosts {
+		t.Errorf("scoped block changed the hosts file:\n%s", hosts)
+	}
+	for _, rule := range tb.fw.List() {
+		if rule.Dest != "" && rule.UIDOwner != "1000" {
+			t.Errorf("rule %s is not limited to the user", rule)
+		}
+	}
+}
+
+func TestBlockWebsiteRegex(t *testing.T) {
+	tb := newTestBlocker(t)
+	if err := tb.BlockWebsite(`/(.+\.)?example\.com/`, Owners{}); err != nil {
+		t.Fatal(err)
+	}
+	if hosts := tb.readHosts(t); hosts != testHosts {
+		t.Errorf("regex rule was written to the hosts file:\n%s", hosts)
+	}
+	if len(tb.lookups) != 0 {
+		t.Errorf("regex rule was resolved: %v", tb.lookups)
+	}
+	if !tb.IsBlocked("cdn.example.com") || tb.IsBlocked("example.org") {
+		t.Error("regex rule does not match the expected hosts")
+	}
+}
+
+func TestUnblockWebsite(t *testing.T) {
+	tb := newTestBlocker(t)
+	for _, domain := range []string{"example.com", "reddit.com"} {
+		if err := tb.BlockWebsite(domain, Owners{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tb.UnblockWebsite("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if dests := tb.destinations(); containsString(dests, "93.184.216.34") || !containsString(dests, "151.101.1.140") {
+		t.Errorf("firewall blocks %v after unblocking example.com", dests)
+	}
+	entries := parseHostsSection(tb.readHosts(t))
+	if _, ok := entries["example.com"]; ok {
+		t.Error("example.com is still in the hosts file")
+	}
+	if _, ok := entries["reddit.com"]; !ok {
+		t.Error("reddit.com was removed from the hosts file")
+	}
+
+	if err := tb.UnblockWebsite("reddit.com"); err != nil {
+		t.Fatal(err)
+	}
+	if rules := tb.fw.List(); len(rules) != 0 {
+		t.Errorf("rules left after unblocking everything: %v", rules)
+	}
+	if hosts := tb.readHosts(t); hosts != testHosts {
+		t.Errorf("hosts file was not restored:\n%s", hosts)
+	}
+}
+
+func TestUnblockWebsiteSharedAddress(t *testing.T) {
+	tb := newTestBlocker(t)
+	for _, domain := range []string{"example.com", "example.net"} {
+		if err := tb.BlockWebsite(domain, Owners{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tb.UnblockWebsite("example.net"); err != nil {
+		t.Fatal(err)
+	}
+	if dests := tb.destinations(); !containsString(dests, "93.184.216.34") {
+		t.Errorf("unblocking example.net unblocked the address example.com still uses: %v", dests)
+	}
+
+	if err := tb.UnblockWebsite("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if rules := tb.fw.List(); len(rules) != 0 {
+		t.Errorf("rules left after unblocking everything: %v", rules)
+	}
+}
+
+func TestBlockWebsiteFirewallError(t *testing.T) {
+	tb := newTestBlocker(t)
+	tb.fw.Err = errors.New("commit failed")
+	if err := tb.BlockWebsite("example.com", Owners{}); err == nil {
+		t.Fatal("BlockWebsite succeeded although the firewall failed")
+	}
+	if len(tb.fw.List()) != 0 {
+		t.Errorf("rules recorded although the commit failed: %v", tb.fw.List())
+	}
+	if tb.IsBlocked("example.com") {
+		t.Error("example.com counts as blocked although the commit failed")
+	}
+	if hosts := tb.readHosts(t); hosts != testHosts {
+		t.Errorf("hosts file changed although the commit failed:\n%s", hosts)
+	}
+
+	tb.fw.Err = nil
+	if err := tb.BlockWebsites([]WebsiteBlock{{Domain: "example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	tb.fw.Err = errors.New("commit failed")
+	if err := tb.BlockWebsites([]WebsiteBlock{{Domain: "reddit.com"}, {Domain: "example.net"}}); err == nil {
+		t.Fatal("BlockWebsites succeeded although the firewall failed")
+	}
+	if tb.IsBlocked("reddit.com") || tb.IsBlocked("example.net") {
+		t.Error("sites count as blocked although the commit failed")
+	}
+}
+
+func TestBlockWebsiteHostsUnchanged(t *testing.T) {
+	tb := newTestBlocker(t)
+	if err := tb.BlockWebsite("example.com", Owners{}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(tb.hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Neither a new scoped rule nor blocking again has a hosts entry to change
+	if err := tb.BlockWebsite("reddit.com", Owners{UIDs: []string{"1000"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.BlockWebsite("example.com", Owners{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.BlockWebsites([]WebsiteBlock{{Domain: "example.com"}, {Domain: "example.net", Owners: Owners{UIDs: []string{"1000"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(tb.hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("the hosts file was rewritten although no entry changed")
+	}
+
+	// Scoping a global rule removes its entry
+	if err := tb.BlockWebsite("example.com", Owners{UIDs: []string{"1000"}}); err != nil {
+		t.Fatal(err)
+	}
+	if hosts := tb.readHosts(t); hosts != testHosts {
+		t.Errorf("scoped rule kept its hosts entry:\n%s", hosts)
+	}
+}
+
+func TestBrowserPolicies(t *testing.T) {
+	tb := newTestBlocker(t)
+	if err := tb.SetBrowserPolicies(true, BrowserPolicyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.BlockWebsite("example.com", Owners{}); err != nil {
+		t.Fatal(err)
+	}
+	chrome := filepath.Join(tb.root, chromePolicyDirs[0], chromePolicyName)
+	data, err := os.ReadFile(chrome)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `".example.com"`) {
+		t.Errorf("Chrome policy does not block example.com:\n%s", data)
+	}
+	firefox := filepath.Join(tb.root, firefoxPolicyFile)
+	if _, err := os.Stat(firefox); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tb.UnblockWebsite("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{chrome, firefox, firefox + firefoxBackupSuffix} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", path)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	tb := newTestBlocker(t)
+	if err := tb.BlockWebsite("example.com", Owners{}); err != nil {
+		t.Fatal(err)
+	}
+
+	drift, err := tb.Reconcile()
+	if err != nil || len(drift) != 0 {
+		t.Fatalf("Reconcile on an intact host = %v, %v", drift, err)
+	}
+
+	calls := len(tb.fw.Calls)
+	tb.fw.Drift = []string{"KEYPHY-OUT is missing 4 rules"}
+	exec.Command("chattr", "-i", tb.hosts).Run()
+	if err := os.WriteFile(tb.hosts, []byte(testHosts), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	drift, err = tb.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift) != 2 {
+		t.Errorf("Reconcile reported %v, want the firewall and hosts drift", drift)
+	}
+	if got := tb.fw.Calls[calls:]; len(got) != 1 || !strings.HasPrefix(got[0], "commit ") {
+		t.Errorf("Reconcile made firewall calls %v, want one commit", got)
+	}
+	if tb.fw.Drift != nil {
+		t.Error("firewall drift was not repaired")
+	}
+	if _, ok := parseHostsSection(tb.readHosts(t))["example.com"]; !ok {
+		t.Error("hosts entries were not restored")
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRefreshAddressesUsesResolvedAnswers(t *testing.T) {
+	tb := newTestBlocker(t)
+	if err := tb.BlockWebsite("example.com", Owners{}); err != nil {
+		t.Fatal(err)
+	}
+	if l := tb.PendingLookups(); len(l.names) != 0 {
+		t.Fatalf("fresh addresses are due again: %v", l.names)
+	}
+
+	tb.resolved["example.com"].nextResolve = time.Now().Add(-time.Second)
+	l := tb.PendingLookups()
+	tb.lookups = nil
+	l.Resolve()
+	if want := []string{"example.com", "www.example.com"}; !reflect.DeepEqual(tb.lookups, want) {
+		t.Errorf("Resolve looked up %v, want %v", tb.lookups, want)
+	}
+
+	tb.lookups = nil
+	if err := tb.RefreshAddresses(l); err != nil {
+		t.Fatal(err)
+	}
+	if len(tb.lookups) != 0 {
+		t.Errorf("RefreshAddresses looked up %v itself", tb.lookups)
+	}
+	if !tb.resolved["example.com"].nextResolve.After(time.Now()) {
+		t.Error("the next resolution was not scheduled")
+	}
+	if !containsString(tb.destinations(), "93.184.216.34") {
+		t.Error("refreshed addresses are not blocked")
+	}
+}
+
+func TestBlockWebsites(t *testing.T) {
+	single := newTestBlocker(t)
+	if err := single.BlockWebsites([]WebsiteBlock{{Domain: "example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tb := newTestBlocker(t)
+	err := tb.BlockWebsites([]WebsiteBlock{
+		{Domain: "example.com"},
+		{Domain: "*.reddit.com"},
+		{Domain: "news.org", Owners: Owners{UIDs: []string{"1000"}}},
+		{Domain: `/(.+\.)?tiktok\.com/`},
+		{Domain: "localhost"},
+	})
+	if err == nil {
+		t.Error("the invalid rule was not reported")
+	}
+	if len(tb.fw.Calls) != len(single.fw.Calls) {
+		t.Errorf("blocking 4 websites made calls %v, one website %v", tb.fw.Calls, single.fw.Calls)
+	}
+	if len(tb.lookups) != 0 {
+		t.Errorf("BlockWebsites looked up %v", tb.lookups)
+	}
+
+	entries := parseHostsSection(tb.readHosts(t))
+	want := map[string][]string{
+		"example.com":  {"example.com", "www.example.com"},
+		"*.reddit.com": {"reddit.com", "www.reddit.com", "m.reddit.com"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("hosts entries = %v, want %v", entries, want)
+	}
+	for _, host := range []string{"www.example.com", "a.reddit.com", "news.org", "www.tiktok.com"} {
+		if !tb.IsBlocked(host) {
+			t.Errorf("%s is not blocked", host)
+		}
+	}
+
+	// The addresses follow with the next refresh
+	l := tb.PendingLookups()
+	l.Resolve()
+	if err := tb.RefreshAddresses(l); err != nil {
+		t.Fatal(err)
+	}
+	if !containsString(tb.destinations(), "93.184.216.34") {
+		t.Error("addresses were not blocked after the refresh")
+	}
+}
+
+func TestAllowlistRootTraffic(t *testing.T) {
+	tb := newTestBlocker(t)
+	if err := tb.EnableAllowlist([]string{"example.com"}, []string{"9.9.9.9", "192.168.1.1:5353", "dns.example"}); err != nil {
+		t.Fatal(err)
+	}
+	var rootRules []Rule
+	for _, rule := range tb.fw.List() {
+		if rule.UIDOwner != "" {
+			rootRules = append(rootRules, rule)
+		}
+	}
+	// Upstreams on port 53 and hostnames need no rule of their own
+	want := []Rule{
+		{Priority: priorityAllowlist, Proto: "udp", Dest: "192.168.1.1", DPorts: []int{5353}, UIDOwner: "0", Action: Accept},
+		{Priority: priorityAllowlist, Proto: "tcp", Dest: "192.168.1.1", DPorts: []int{5353}, UIDOwner: "0", Action: Accept},
+	}
+	if !reflect.DeepEqual(rootRules, want) {
+		t.Errorf("root rules = %v, want %v", rootRules, want)
+	}
+	if !containsString(tb.destinations(), "93.184.216.34") {
+		t.Error("the allowed domain's address is not pinned")
+	}
+
+	if err := tb.DisableAllowlist(); err != nil {
+		t.Fatal(err)
+	}
+	if rules := tb.fw.List(); len(rules) != 0 {
+		t.Errorf("rules left after leaving allowlist mode: %v", rules)
+	}
+}
+
+func TestAllowlistOrder(t *testing.T) {
+	tb := newTestBlocker(t)
+	if err := tb.EnableAllowlist([]string{"reddit.com"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.EnableAllowlist([]string{"reddit.com", "example.com"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every accepted address must come before the final reject
+	ruleset := iptablesRuleset(tb.fw.List())
+	accept := strings.Index(ruleset, "-d 93.184.216.34 -j ACCEPT")
+	reject := strings.Index(ruleset, "-j REJECT")
+	if accept < 0 || reject < 0 {
+		t.Fatalf("ruleset lacks the accept or reject rule:\n%s", ruleset)
+	}
+	if accept > reject {
+		t.Errorf("newly allowed address is accepted after the reject:\n%s", ruleset)
+	}
+	denied := false
+	for _, rule := range tb.fw.List() {
+		if rule.Action != Accept {
+			denied = true
+		} else if denied {
+			t.Errorf("%s follows the allowlist reject", rule)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package blocker
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Owners limits a website rule to the traffic of some users, matched by
+// the UID or GID owning the socket. The zero value applies to everyone.
+// Scoped rules leave the hosts file, the DNS sinkhole and browser policies
+// alone, since those are shared by all users. Groups need a firewall that
+// matches supplementary groups, which nftables cannot.
+type Owners struct {
+	UIDs []string
+	GIDs []string
+}
+
+// Empty reports whether the rule applies to everyone.
+func (o Owners) Empty() bool {
+	return len(o.UIDs) == 0 && len(o.GIDs) == 0
+}
+
+func (o Owners) String() string {
+	var parts []string
+	if len(o.UIDs) > 0 {
+		parts = append(parts, "UIDs "+strings.Join(o.UIDs, ", "))
+	}
+	if len(o.GIDs) > 0 {
+		parts = append(parts, "GIDs "+strings.Join(o.GIDs, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// check reports an error if fw cannot enforce rules limited to o.
+func (o Owners) check(fw Firewall) error {
+	if len(o.GIDs) > 0 && !fw.GroupMatching() {
+		return fmt.Errorf("the %s backend cannot limit rules to the members of a group, use --user or the %s backend", fw.Name(), BackendIptables)
+	}
+	return nil
+}
+
+// scope repeats rules once for every owner. Rules are returned unchanged
+// when o is empty.
+func (o Owners) scope(rules []Rule) []Rule {
+	if o.Empty() {
+		return rules
+	}
+	var scoped []Rule
+	for _, uid := range o.UIDs {
+		for _, rule := range rules {
+			rule.UIDOwner = uid
+			scoped = append(scoped, rule)
+		}
+	}
+	for _, gid := range o.GIDs {
+		for _, rule := range rules {
+			rule.GIDOwner = gid
+			scoped = append(scoped, rule)
+		}
+	}
+	return scoped
+}
+
+// globalDomains returns the blocked website rules that apply to everyone.
+func (nb *NetworkBlocker) globalDomains() map[string]bool {
+	domains := make(map[string]bool)
+	for domain := range nb.blockedDomains {
+		if nb.owners[domain].Empty() {
+			domains[domain] = true
+		}
+	}
+	return domains
+}
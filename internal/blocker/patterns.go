@@ -0,0 +1,99 @@
+package blocker
+
+import (
+	"strings"
+
+	"github.com/gajzzs/keyphy/internal/matcher"
+)
+
+// A DNS query over UDP starts its question name right after the IP, UDP (8)
+// and DNS (12) headers: offset 40 behind an IPv4 header without options
+// (20) and 60 behind an IPv6 header without extension headers (40).
+// Anchoring the match there lets exact rules ignore subdomains.
+var udpDNSNameOffsets = map[string]int{FamilyIPv4: 40, FamilyIPv6: 60}
+
+// encodeDNSName converts a.b.c into the length-prefixed label form used
+// inside DNS packets, including the terminating root label.
+func encodeDNSName(name string) []byte {
+	var encoded []byte
+	for _, label := range strings.Split(name, ".") {
+		encoded = append(encoded, byte(len(label)))
+		encoded = append(encoded, label...)
+	}
+	return append(encoded, 0)
+}
+
+// encodeSNI matches the server_name entry of a TLS ClientHello: name type
+// host_name (0) followed by the two byte name length and the name.
+func encodeSNI(name string) []byte {
+	return append([]byte{0, byte(len(name) >> 8), byte(len(name))}, name...)
+}
+
+// exactNames returns the hostnames a non-wildcard rule covers.
+func exactNames(rule *matcher.Rule) []string {
+	switch rule.Kind() {
+	case matcher.Exact:
+		return []string{rule.Domain()}
+	case matcher.Plain:
+		return rule.HostsNames()
+	}
+	return nil
+}
+
+// payloadRules returns the rules that enforce a website rule by matching
+// names inside DNS, HTTPS and HTTP traffic. Regex rules cannot be expressed
+// as payload patterns and produce no rules.
+func payloadRules(rule *matcher.Rule) []Rule {
+	var rules []Rule
+	dropFamily := func(family, proto string, port int, payload Payload) {
+		rules = append(rules, Rule{
+			Priority: priorityBlock,
+			Family:   family,
+			Proto:    proto,
+			DPorts:   []int{port},
+			Payload:  &payload,
+			Action:   Drop,
+		})
+	}
+	drop := func(proto string, port int, payload Payload) {
+		dropFamily("", proto, port, payload)
+	}
+
+	switch rule.Kind() {
+	case matcher.Wildcard:
+		// Label encoding makes the name a suffix match on whole labels
+		name := encodeDNSName(rule.Domain())
+		drop("udp", 53, Payload{Pattern: name})
+		drop("tcp", 53, Payload{Pattern: name})
+		drop("tcp", 443, Payload{Pattern: encodeSNI(rule.Domain())})
+		drop("tcp", 443, Payload{Pattern: []byte("." + rule.Domain())})
+		drop("tcp", 80, Payload{Pattern: []byte("Host: " + rule.Domain() + "\r\n"), IgnoreCase: true})
+		drop("tcp", 80, Payload{Pattern: []byte("." + rule.Domain() + "\r\n"), IgnoreCase: true})
+	case matcher.Plain, matcher.Exact:
+		for _, host := range exactNames(rule) {
+			name := encodeDNSName(host)
+			for _, family := range []string{FamilyIPv4, FamilyIPv6} {
+				offset := udpDNSNameOffsets[family]
+				dropFamily(family, "udp", 53, Payload{Pattern: name, From: offset, To: offset + len(name)})
+			}
+			// TCP header length varies, so TCP queries cannot be anchored
+			drop("tcp", 53, Payload{Pattern: name})
+			drop("tcp", 443, Payload{Pattern: encodeSNI(host)})
+			drop("tcp", 80, Payload{Pattern: []byte("Host: " + host + "\r\n"), IgnoreCase: true})
+		}
+	}
+	return rules
+}
+
+// addressRules blocks web traffic to the given addresses, for backends
+// without payload matching.
+func addressRules(ips []string) []Rule {
+	var rules []Rule
+	for _, ip := range ips {
+		rules = append(rules,
+			Rule{Priority: priorityBlock, Proto: "tcp", Dest: ip, DPorts: []int{80, 443}, Action: Reject},
+			Rule{Priority: priorityBlock, Proto: "udp", Dest: ip, DPorts: []int{443}, Action: Drop},
+		)
+	}
+	return rules
+}
@@ -0,0 +1,42 @@
+package blocker
+
+// QUIC modes. Browsers fall back to TCP when UDP 443 is dropped, where the
+// hosts file, SNI and address rules apply.
+const (
+	// QUICBlockAll drops all outbound UDP 443 while websites are blocked.
+	QUICBlockAll = "all"
+	// QUICBlockSites only drops UDP 443 towards blocked sites' addresses,
+	// which the address rules always do.
+	QUICBlockSites = "sites"
+)
+
+var quicRule = Rule{Priority: priorityBlock, Proto: "udp", DPorts: []int{443}, Action: Drop}
+
+// SetQUICMode selects how QUIC is blocked and applies it right away.
+func (nb *NetworkBlocker) SetQUICMode(mode string) error {
+	if mode != QUICBlockSites {
+		mode = QUICBlockAll
+	}
+	nb.quicMode = mode
+	return nb.syncQUIC()
+}
+
+// syncQUIC drops all QUIC traffic while any website is blocked in
+// QUICBlockAll mode.
+func (nb *NetworkBlocker) syncQUIC() error {
+	want := nb.quicMode == QUICBlockAll && len(nb.globalDomains()) > 0
+	if want == nb.quicActive {
+		return nil
+	}
+	var err error
+	if want {
+		err = nb.fw.Add(quicRule)
+	} else {
+		err = nb.fw.Remove(quicRule)
+	}
+	if err != nil {
+		return err
+	}
+	nb.quicActive = want
+	return nil
+}
@@ -0,0 +1,41 @@
+package blocker
+
+// SNIQueue is the netfilter queue outbound TLS handshakes are sent to when
+// SNI inspection is enabled.
+const SNIQueue = 1053
+
+// sniFlowPackets covers the handshake, SYN and ACK included, with room for
+// a ClientHello split over several segments.
+const sniFlowPackets = 8
+
+// priorityInspect puts the queue after the block rules, since a queue
+// verdict ends evaluation of the chain.
+const priorityInspect = 50
+
+var sniRule = Rule{Priority: priorityInspect, Proto: "tcp", DPorts: []int{443}, FlowPackets: sniFlowPackets, Action: Queue, Queue: SNIQueue}
+
+// SetSNIInspection sends the start of outbound HTTPS connections to
+// SNIQueue while websites are blocked, where the daemon checks their server
+// name.
+func (nb *NetworkBlocker) SetSNIInspection(enabled bool) error {
+	nb.sniEnabled = enabled
+	return nb.syncSNI()
+}
+
+func (nb *NetworkBlocker) syncSNI() error {
+	want := nb.sniEnabled && len(nb.globalDomains()) > 0
+	if want == nb.sniActive {
+		return nil
+	}
+	var err error
+	if want {
+		err = nb.fw.Add(sniRule)
+	} else {
+		err = nb.fw.Remove(sniRule)
+	}
+	if err != nil {
+		return err
+	}
+	nb.sniActive = want
+	return nil
+}
@@ -0,0 +1,337 @@
+package blocklist
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/gajzzs/keyphy/internal/matcher"
+)
+
+// Formats lists the supported import and export formats.
+var Formats = []string{"hosts", "list", "json", "adblock"}
+
+// Result is the outcome of parsing a blocklist.
+type Result struct {
+	Domains []string // valid, normalized and deduplicated rules in input order
+	Invalid []string // entries that were rejected
+}
+
+// hostsIgnored are names commonly present in hosts files that must never be blocked.
+var hostsIgnored = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+}
+
+// Parse reads a blocklist in the given format.
+func Parse(r io.Reader, format string) (*Result, error) {
+	var entries []string
+	var err error
+
+	switch format {
+	case "hosts":
+		entries, err = parseLines(r, func(line string) []string {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				return nil
+			}
+			var names []string
+			for _, name := range fields[1:] {
+				if !hostsIgnored[strings.ToLower(name)] {
+					names = append(names, name)
+				}
+			}
+			return names
+		})
+	case "list":
+		entries, err = parseLines(r, func(line string) []string {
+			return []string{line}
+		})
+	case "adblock":
+		entries, err = parseLines(r, parseAdblockLine)
+	case "json":
+		entries, err = parseJSON(r)
+	default:
+		return nil, fmt.Errorf("unsupported format %s (use %s)", format, strings.Join(Formats, ", "))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{}
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		domain, ok := parseEntry(entry, format == "json")
+		if !ok {
+			result.Invalid = append(result.Invalid, entry)
+			continue
+		}
+		if !seen[domain] {
+			seen[domain] = true
+			result.Domains = append(result.Domains, domain)
+		}
+	}
+	return result, nil
+}
+
+// parseEntry validates one entry. JSON holds website rules as export
+// writes them, so wildcard, exact and regex rules are kept as given; every
+// other format holds plain hostnames.
+func parseEntry(entry string, rules bool) (string, bool) {
+	if rules {
+		if rule, err := matcher.Parse(entry); err == nil && rule.Kind() != matcher.Plain {
+			return strings.TrimSpace(entry), true
+		}
+	}
+	domain := Normalize(entry)
+	return domain, ValidDomain(domain)
+}
+
+// parseLines splits r into lines, drops blank lines and comments and passes
+// the rest to extract.
+func parseLines(r io.Reader, extract func(string) []string) ([]string, error) {
+	var entries []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		entries = append(entries, extract(line)...)
+	}
+	return entries, scanner.Err()
+}
+
+// parseAdblockLine accepts domain anchors such as "||example.com^". Options
+// after "$" are dropped, so conditional rules become full blocks. Exceptions,
+// cosmetic filters and path rules are skipped.
+func parseAdblockLine(line string) []string {
+	if strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") || strings.HasPrefix(line, "@@") || strings.Contains(line, "##") {
+		return nil
+	}
+	if !strings.HasPrefix(line, "||") {
+		return nil
+	}
+	rule := strings.TrimPrefix(line, "||")
+	if i := strings.Index(rule, "$"); i >= 0 {
+		rule = rule[:i]
+	}
+	rule = strings.TrimSuffix(rule, "^")
+	if strings.ContainsAny(rule, "/*^|") {
+		return nil
+	}
+	return []string{rule}
+}
+
+// parseJSON accepts either a plain array of domains or an object with a
+// "blocked_websites" array, as written by export and config.json.
+func parseJSON(r io.Reader) ([]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var domains []string
+	if err := json.Unmarshal(data, &domains); err == nil {
+		return domains, nil
+	}
+	var object struct {
+		BlockedWebsites []string `json:"blocked_websites"`
+	}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, fmt.Errorf("invalid JSON blocklist: %v", err)
+	}
+	return object.BlockedWebsites, nil
+}
+
+// Normalize lowercases a domain and strips a trailing dot. A leading
+// "www." is kept: blocking www.example.com must not block example.com.
+func Normalize(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	return strings.TrimSuffix(domain, ".")
+}
+
+// Uncovered returns the domains that rules do not block yet, in order. A
+// domain counts as blocked when the rules, or a domain before it, cover
+// every name it would sinkhole.
+func Uncovered(rules, domains []string) []string {
+	var known []*matcher.Rule
+	for _, raw := range rules {
+		if rule, err := matcher.Parse(raw); err == nil {
+			known = append(known, rule)
+		}
+	}
+	covers := func(name string) bool {
+		for _, rule := range known {
+			if rule.Matches(name) {
+				return true
+			}
+		}
+		return false
+	}
+	var uncovered []string
+	for _, domain := range domains {
+		rule, err := matcher.Parse(domain)
+		if err != nil {
+			continue
+		}
+		covered := true
+		for _, name := range rule.HostsNames() {
+			covered = covered && covers(name)
+		}
+		if len(rule.HostsNames()) == 0 {
+			// A regex covers names no list could enumerate
+			covered = false
+			for _, known := range known {
+				covered = covered || known.String() == rule.String()
+			}
+		}
+		if !covered {
+			uncovered = append(uncovered, domain)
+			known = append(known, rule)
+		}
+	}
+	return uncovered
+}
+
+// ValidDomain reports whether domain is a syntactically valid hostname with
+// at least two labels. IP addresses are rejected.
+func ValidDomain(domain string) bool {
+	if len(domain) == 0 || len(domain) > 253 || net.ParseIP(domain) != nil {
+		return false
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	// Top level domains are never all-numeric
+	return strings.Trim(labels[len(labels)-1], "0123456789") != ""
+}
+
+// Write exports website rules in the given format. Plain rules are
+// lowercased; wildcard and exact rules are expanded into the names they
+// sinkhole where the format only holds hostnames. Rules the format cannot
+// express, such as regular expressions outside JSON, are left out and
+// returned.
+func Write(w io.Writer, format string, rules []string) ([]string, error) {
+	var lines, skipped []string
+	seen := make(map[string]bool)
+	add := func(line string) {
+		if !seen[line] {
+			seen[line] = true
+			lines = append(lines, line)
+		}
+	}
+
+	var header string
+	switch format {
+	case "hosts", "list":
+		header = "# Exported by keyphy"
+	case "adblock":
+		header = "! Exported by keyphy"
+	case "json":
+	default:
+		return nil, fmt.Errorf("unsupported format %s (use %s)", format, strings.Join(Formats, ", "))
+	}
+
+	sorted := append([]string{}, rules...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sortKey(sorted[i]) < sortKey(sorted[j])
+	})
+	for _, raw := range sorted {
+		rule, err := matcher.Parse(raw)
+		if err != nil {
+			skipped = append(skipped, raw)
+			continue
+		}
+		if rule.Kind() == matcher.Plain {
+			switch format {
+			case "hosts":
+				for _, name := range rule.HostsNames() {
+					add("0.0.0.0 " + name)
+				}
+			case "adblock":
+				add("||" + rule.Domain() + "^")
+			default:
+				add(rule.Domain())
+			}
+			continue
+		}
+
+		switch format {
+		case "json":
+			add(strings.TrimSpace(raw))
+		case "adblock":
+			// ||domain^ covers every subdomain, which only wildcards mean
+			if rule.Kind() != matcher.Wildcard {
+				skipped = append(skipped, raw)
+				continue
+			}
+			add("||" + rule.Domain() + "^")
+		default:
+			names := rule.HostsNames()
+			if len(names) == 0 {
+				skipped = append(skipped, raw)
+				continue
+			}
+			for _, name := range names {
+				if format == "hosts" {
+					name = "0.0.0.0 " + name
+				}
+				add(name)
+			}
+		}
+	}
+	if format == "json" {
+		if lines == nil {
+			lines = []string{}
+		}
+		data, err := json.MarshalIndent(map[string][]string{"blocked_websites": lines}, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintln(w, string(data))
+		return skipped, nil
+	}
+	fmt.Fprintln(w, header)
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+	return skipped, nil
+}
+
+// sortKey orders rules by the domain they cover, whatever their form, with
+// www names next to their parent domain.
+func sortKey(raw string) string {
+	rule, err := matcher.Parse(raw)
+	if err != nil || rule.Kind() == matcher.Regex {
+		return raw
+	}
+	return strings.TrimPrefix(rule.Domain(), "www.")
+}
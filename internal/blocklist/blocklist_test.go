@@ -0,0 +1,121 @@
+package blocklist
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	rules := []string{"www.Example.com", "*.reddit.com", "=news.site.org", `/(.+\.)?tiktok\.com/`}
+	tests := []struct {
+		format  string
+		want    string
+		skipped []string
+	}{
+		{
+			format: "hosts",
+			want: "# Exported by keyphy\n" +
+				"0.0.0.0 www.example.com\n" +
+				"0.0.0.0 news.site.org\n" +
+				"0.0.0.0 reddit.com\n0.0.0.0 www.reddit.com\n0.0.0.0 m.reddit.com\n",
+			skipped: []string{`/(.+\.)?tiktok\.com/`},
+		},
+		{
+			format:  "list",
+			want:    "# Exported by keyphy\nwww.example.com\nnews.site.org\nreddit.com\nwww.reddit.com\nm.reddit.com\n",
+			skipped: []string{`/(.+\.)?tiktok\.com/`},
+		},
+		{
+			format:  "adblock",
+			want:    "! Exported by keyphy\n||www.example.com^\n||reddit.com^\n",
+			skipped: []string{`/(.+\.)?tiktok\.com/`, "=news.site.org"},
+		},
+		{
+			format: "json",
+			want: "{\n  \"blocked_websites\": [\n" +
+				"    \"/(.+\\\\.)?tiktok\\\\.com/\",\n" +
+				"    \"www.example.com\",\n" +
+				"    \"=news.site.org\",\n" +
+				"    \"*.reddit.com\"\n  ]\n}\n",
+		},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		skipped, err := Write(&buf, tt.format, rules)
+		if err != nil {
+			t.Fatalf("Write(%s) failed: %v", tt.format, err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("Write(%s) =\n%s\nwant\n%s", tt.format, buf.String(), tt.want)
+		}
+		if !reflect.DeepEqual(skipped, tt.skipped) {
+			t.Errorf("Write(%s) skipped %v, want %v", tt.format, skipped, tt.skipped)
+		}
+	}
+}
+
+func TestParseKeepsSubdomains(t *testing.T) {
+	result, err := Parse(strings.NewReader("www.Example.com\nexample.com.\nexample.com\n"), "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"www.example.com", "example.com"}; !reflect.DeepEqual(result.Domains, want) {
+		t.Errorf("Parse = %v, want %v", result.Domains, want)
+	}
+}
+
+func TestUncovered(t *testing.T) {
+	existing := []string{"example.com", "*.reddit.com", `/(.+\.)?tiktok\.com/`}
+	tests := []struct {
+		domain  string
+		covered bool
+	}{
+		{"example.com", true},
+		{"www.example.com", true},
+		{"cdn.example.com", false},
+		{"old.reddit.com", true},
+		{"=reddit.com", true},
+		{"reddit.com", true},
+		{"example.org", false},
+		{`/(.+\.)?tiktok\.com/`, true},
+		{`/tiktok\.com/`, false},
+	}
+	for _, tt := range tests {
+		got := Uncovered(existing, []string{tt.domain})
+		if covered := len(got) == 0; covered != tt.covered {
+			t.Errorf("Uncovered(%s) = %v, want covered %v", tt.domain, got, tt.covered)
+		}
+	}
+
+	// Domains earlier in the list cover later ones
+	got := Uncovered(nil, []string{"news.site.org", "www.news.site.org", "*.site.org", "mail.site.org"})
+	if want := []string{"news.site.org", "*.site.org"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Uncovered = %v, want %v", got, want)
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	rules := []string{`/(.+\.)?tiktok\.com/`, "www.example.com", "=news.site.org", "*.reddit.com"}
+	var buf bytes.Buffer
+	if _, err := Write(&buf, "json", rules); err != nil {
+		t.Fatal(err)
+	}
+	result, err := Parse(&buf, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Domains, rules) || len(result.Invalid) != 0 {
+		t.Errorf("round trip = %v (invalid %v), want %v", result.Domains, result.Invalid, rules)
+	}
+
+	// Only JSON carries rule forms
+	result, err = Parse(strings.NewReader("*.reddit.com\n=news.site.org\n"), "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Domains) != 0 || len(result.Invalid) != 2 {
+		t.Errorf("list accepted rule forms: %v", result.Domains)
+	}
+}
@@ -0,0 +1,426 @@
+// Package circumvent detects VPNs, proxies and Tor, which route traffic
+// around the website blocks.
+package circumvent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Finding kinds.
+const (
+	KindVPN           = "vpn_interface"
+	KindProxyProcess  = "proxy_process"
+	KindProxySettings = "proxy_settings"
+	KindTor           = "tor"
+)
+
+// Finding is one detected circumvention attempt.
+type Finding struct {
+	Kind string
+	// Name identifies what was found: an interface, a process name or a
+	// settings file.
+	Name   string
+	Detail string
+	// PID is set for processes.
+	PID int
+	// Interface is set for VPN interfaces.
+	Interface string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s %s: %s", f.Kind, f.Name, f.Detail)
+}
+
+// vpnInterfacePrefixes name interfaces created by VPN software. ppp and
+// tap are left out, since DSL modems and virtual machines use them too.
+var vpnInterfacePrefixes = []string{
+	"tun", "wg", "ipsec", "vti", "utun", "tailscale", "zt",
+	"nordlynx", "proton", "mullvad", "CloudflareWARP", "gpd", "cscotun",
+}
+
+// iffTun marks layer 3 tun devices in /sys/class/net/<name>/tun_flags.
+const iffTun = 0x0001
+
+// proxyProcesses are VPN clients, proxies and anonymity tools by process
+// name as shown in /proc/<pid>/comm, which is truncated to 15 bytes.
+var proxyProcesses = map[string]string{
+	"tor":             "Tor",
+	"obfs4proxy":      "Tor pluggable transport",
+	"lyrebird":        "Tor pluggable transport",
+	"snowflake-clien": "Tor pluggable transport",
+	"openvpn":         "OpenVPN",
+	"openconnect":     "OpenConnect VPN",
+	"vpnc":            "Cisco VPN client",
+	"wireguard-go":    "WireGuard",
+	"boringtun":       "WireGuard",
+	"tailscaled":      "Tailscale",
+	"zerotier-one":    "ZeroTier",
+	"nordvpnd":        "NordVPN",
+	"expressvpnd":     "ExpressVPN",
+	"mullvad-daemon":  "Mullvad VPN",
+	"protonvpn":       "Proton VPN",
+	"warp-svc":        "Cloudflare WARP",
+	"ss-local":        "Shadowsocks",
+	"sslocal":         "Shadowsocks",
+	"ss-redir":        "Shadowsocks",
+	"v2ray":           "V2Ray",
+	"xray":            "Xray",
+	"sing-box":        "sing-box",
+	"clash":           "Clash",
+	"clash-meta":      "Clash",
+	"mihomo":          "Clash",
+	"trojan":          "Trojan",
+	"trojan-go":       "Trojan",
+	"hysteria":        "Hysteria",
+	"naive":           "NaiveProxy",
+	"privoxy":         "Privoxy",
+	"tinyproxy":       "Tinyproxy",
+	"microsocks":      "SOCKS proxy",
+	"redsocks":        "SOCKS redirector",
+	"sshuttle":        "sshuttle",
+	"psiphon":         "Psiphon",
+	"lantern":         "Lantern",
+}
+
+// TorPorts are the default Tor relay, directory and local SOCKS ports.
+var TorPorts = []int{9001, 9030, 9050, 9051, 9150, 9151}
+
+// torSOCKSPorts are listened on by a local Tor client.
+var torSOCKSPorts = map[int]bool{9050: true, 9150: true}
+
+// torRelayPorts are connected to by a Tor client.
+var torRelayPorts = map[int]bool{9001: true, 9030: true}
+
+// proxySettingFiles hold system wide proxy settings. Per-user desktop
+// settings are found through proxyUserFiles.
+var proxySettingFiles = []string{"/etc/environment", "/etc/profile.d/proxy.sh", "/etc/apt/apt.conf.d/proxy.conf"}
+
+// proxyUserFiles are desktop proxy settings relative to a home directory:
+// KDE's and the dconf database holding GNOME's.
+var proxyUserFiles = []string{".config/kioslaverc", dconfUserFile}
+
+const dconfUserFile = ".config/dconf/user"
+
+// dconfProxyKeys are the GNOME proxy settings.
+var dconfProxyKeys = []string{
+	"/system/proxy/mode", "/system/proxy/autoconfig-url",
+	"/system/proxy/http/host", "/system/proxy/https/host", "/system/proxy/socks/host",
+}
+
+// Detector reports each finding once, when it first appears. Findings that
+// go away are forgotten, so they are reported again if they come back.
+type Detector struct {
+	seen     map[string]bool
+	settings map[string]string
+	procRoot string
+	// dconf caches GNOME settings by database mtime, since reading them
+	// runs dconf.
+	dconf map[string]dconfSettings
+}
+
+type dconfSettings struct {
+	modified time.Time
+	digest   string
+}
+
+func NewDetector() *Detector {
+	return &Detector{
+		seen:     make(map[string]bool),
+		procRoot: "/proc",
+		dconf:    make(map[string]dconfSettings),
+	}
+}
+
+// Scan returns the findings that appeared since the previous scan. The
+// first scan also records the proxy settings it compares later scans with.
+func (d *Detector) Scan() []Finding {
+	var current []Finding
+	current = append(current, vpnInterfaces()...)
+	current = append(current, d.proxyProcesses()...)
+	current = append(current, d.torSockets()...)
+
+	return append(d.newFindings(current), d.proxySettingChanges()...)
+}
+
+// newFindings returns the findings in current that the previous scan did
+// not see and remembers current for the next scan.
+func (d *Detector) newFindings(current []Finding) []Finding {
+	seen := make(map[string]bool)
+	var findings []Finding
+	for _, finding := range current {
+		key := finding.Kind + " " + finding.Name + " " + strconv.Itoa(finding.PID)
+		seen[key] = true
+		if !d.seen[key] {
+			findings = append(findings, finding)
+		}
+	}
+	d.seen = seen
+	return findings
+}
+
+func vpnInterfaces() []Finding {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var findings []Finding
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		detail := ""
+		for _, prefix := range vpnInterfacePrefixes {
+			if strings.HasPrefix(iface.Name, prefix) {
+				detail = "interface name of VPN software"
+				break
+			}
+		}
+		// tun devices expose their flags, WireGuard its type
+		if isTun(iface.Name) {
+			detail = "tun device"
+		} else if isWireGuard(iface.Name) {
+			detail = "WireGuard device"
+		}
+		if detail != "" {
+			findings = append(findings, Finding{Kind: KindVPN, Name: iface.Name, Detail: detail, Interface: iface.Name})
+		}
+	}
+	return findings
+}
+
+func isTun(name string) bool {
+	data, err := os.ReadFile(filepath.Join("/sys/class/net", name, "tun_flags"))
+	if err != nil {
+		return false
+	}
+	flags, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(string(data)), "0x"), 16, 32)
+	return err == nil && flags&iffTun != 0
+}
+
+func isWireGuard(name string) bool {
+	uevent, err := os.ReadFile(filepath.Join("/sys/class/net", name, "uevent"))
+	return err == nil && strings.Contains(string(uevent), "DEVTYPE=wireguard")
+}
+
+func (d *Detector) proxyProcesses() []Finding {
+	procs, _ := filepath.Glob(filepath.Join(d.procRoot, "[0-9]*"))
+	var findings []Finding
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(filepath.Base(proc))
+		if err != nil {
+			continue
+		}
+		comm, err := os.ReadFile(filepath.Join(proc, "comm"))
+		if err != nil {
+			continue
+		}
+		name := strings.TrimSpace(string(comm))
+		if tool, ok := proxyProcesses[name]; ok {
+			findings = append(findings, Finding{Kind: KindProxyProcess, Name: name, Detail: tool, PID: pid})
+			continue
+		}
+		if name == "ssh" {
+			if detail := sshTunnel(filepath.Join(proc, "cmdline")); detail != "" {
+				findings = append(findings, Finding{Kind: KindProxyProcess, Name: name, Detail: detail, PID: pid})
+			}
+		}
+	}
+	return findings
+}
+
+// sshValueFlags are the ssh options that take an argument.
+const sshValueFlags = "BbcDEeFIiJLlmOoPpQRSWw"
+
+// sshTunnel recognizes ssh started as a SOCKS proxy or tunnel device.
+// Like ssh, it reads options before and right after the destination; the
+// remote command that follows is not looked at.
+func sshTunnel(cmdlinePath string) string {
+	cmdline, err := os.ReadFile(cmdlinePath)
+	if err != nil {
+		return ""
+	}
+	args := strings.Split(strings.TrimSuffix(string(cmdline), "\x00"), "\x00")
+	destination := false
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			if destination {
+				break
+			}
+			destination = true
+			continue
+		}
+		// Flags may be bundled; the first one taking a value ends the bundle
+		for j, flag := range arg[1:] {
+			if !strings.ContainsRune(sshValueFlags, flag) {
+				continue
+			}
+			value := arg[j+2:]
+			if value == "" && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			option := strings.ToLower(value)
+			switch {
+			case flag == 'D', flag == 'o' && strings.HasPrefix(option, "dynamicforward"):
+				return "SSH dynamic port forwarding (SOCKS proxy)"
+			case flag == 'w', flag == 'o' && strings.HasPrefix(option, "tunnel") && !strings.HasSuffix(option, "no"):
+				return "SSH tunnel device"
+			}
+			break
+		}
+	}
+	return ""
+}
+
+// torSockets finds a local Tor SOCKS port and connections to Tor relays.
+func (d *Detector) torSockets() []Finding {
+	var findings []Finding
+	for _, file := range []string{"net/tcp", "net/tcp6"} {
+		f, err := os.Open(filepath.Join(d.procRoot, file))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // Skip header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 4 {
+				continue
+			}
+			localPort := procPort(fields[1])
+			remotePort := procPort(fields[2])
+			switch {
+			case fields[3] == "0A" && torSOCKSPorts[localPort]:
+				findings = append(findings, Finding{Kind: KindTor, Name: fmt.Sprintf("port %d", localPort), Detail: "Tor SOCKS port listening"})
+			case fields[3] == "01" && torRelayPorts[remotePort]:
+				findings = append(findings, Finding{Kind: KindTor, Name: fmt.Sprintf("port %d", remotePort), Detail: "connection to a Tor relay port"})
+			}
+		}
+		f.Close()
+	}
+	return findings
+}
+
+func procPort(field string) int {
+	_, portHex, ok := strings.Cut(field, ":")
+	if !ok {
+		return 0
+	}
+	port, _ := strconv.ParseUint(portHex, 16, 16)
+	return int(port)
+}
+
+// proxySettingChanges reports proxy setting files that changed since the
+// previous scan.
+func (d *Detector) proxySettingChanges() []Finding {
+	current := make(map[string]string)
+	for _, path := range proxySettingPaths() {
+		digest := proxySettings(path)
+		if strings.HasSuffix(path, dconfUserFile) {
+			digest = d.dconfProxySettings(path)
+		}
+		if digest != "" {
+			current[path] = digest
+		}
+	}
+	if d.settings == nil {
+		d.settings = current
+		return nil
+	}
+
+	var paths []string
+	for path := range current {
+		paths = append(paths, path)
+	}
+	for path := range d.settings {
+		if _, ok := current[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	var findings []Finding
+	for _, path := range paths {
+		if current[path] != d.settings[path] {
+			findings = append(findings, Finding{Kind: KindProxySettings, Name: path, Detail: "proxy settings changed"})
+		}
+	}
+	d.settings = current
+	return findings
+}
+
+func proxySettingPaths() []string {
+	paths := append([]string{}, proxySettingFiles...)
+	homes, _ := filepath.Glob("/home/*")
+	homes = append(homes, "/root")
+	for _, home := range homes {
+		for _, file := range proxyUserFiles {
+			paths = append(paths, filepath.Join(home, file))
+		}
+	}
+	return paths
+}
+
+// proxySettings returns a digest of the proxy related lines of a settings
+// file.
+func proxySettings(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	var relevant []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.Contains(strings.ToLower(line), "proxy") {
+			relevant = append(relevant, strings.TrimSpace(line))
+		}
+	}
+	return digest(relevant)
+}
+
+// dconfProxySettings returns a digest of the GNOME proxy settings in a
+// dconf database, reading it again only after it was modified.
+func (d *Detector) dconfProxySettings(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	if cached, ok := d.dconf[path]; ok && cached.modified.Equal(info.ModTime()) {
+		return cached.digest
+	}
+	var values []string
+	configHome := filepath.Dir(filepath.Dir(path))
+	for _, key := range dconfProxyKeys {
+		cmd := exec.Command("dconf", "read", key)
+		cmd.Env = append(os.Environ(), "XDG_CONFIG_HOME="+configHome)
+		if output, err := cmd.Output(); err == nil && len(bytes.TrimSpace(output)) > 0 {
+			values = append(values, key+"="+strings.TrimSpace(string(output)))
+		}
+	}
+	settings := dconfSettings{modified: info.ModTime(), digest: digest(values)}
+	d.dconf[path] = settings
+	return settings.digest
+}
+
+func digest(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
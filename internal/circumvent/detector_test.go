@@ -0,0 +1,196 @@
+package circumvent
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	socksProxy   = "SSH dynamic port forwarding (SOCKS proxy)"
+	tunnelDevice = "SSH tunnel device"
+)
+
+func TestSSHTunnel(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"dynamic forward", []string{"ssh", "-D", "1080", "host"}, socksProxy},
+		{"dynamic forward attached", []string{"ssh", "-D1080", "host"}, socksProxy},
+		{"bundled flags", []string{"ssh", "-NfD", "1080", "host"}, socksProxy},
+		{"option", []string{"ssh", "-o", "DynamicForward=1080", "host"}, socksProxy},
+		{"option attached", []string{"ssh", "-oDynamicForward 1080", "host"}, socksProxy},
+		{"after the destination", []string{"ssh", "host", "-D", "1080"}, socksProxy},
+		{"after other options", []string{"ssh", "-p", "2222", "-i", "key", "-D", "1080", "host"}, socksProxy},
+		{"tunnel device", []string{"ssh", "-w", "0:0", "host"}, tunnelDevice},
+		{"tunnel option", []string{"ssh", "-o", "Tunnel=point-to-point", "host"}, tunnelDevice},
+		{"tunnel disabled", []string{"ssh", "-o", "Tunnel=no", "host"}, ""},
+		{"local forward", []string{"ssh", "-L", "8080:localhost:80", "host"}, ""},
+		{"other option", []string{"ssh", "-o", "ServerAliveInterval=5", "host"}, ""},
+		{"flag as option value", []string{"ssh", "-l", "-D", "host"}, ""},
+		{"remote command", []string{"ssh", "host", "grep", "-w", "word", "file"}, ""},
+		{"after end of options", []string{"ssh", "--", "host", "-D", "1080"}, ""},
+		{"plain login", []string{"ssh", "host"}, ""},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "cmdline")
+			// The kernel ends every argument with a NUL
+			if err := os.WriteFile(path, []byte(strings.Join(tt.args, "\x00")+"\x00"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if got := sshTunnel(path); got != tt.want {
+				t.Errorf("sshTunnel(%q) = %q, want %q", tt.args, got, tt.want)
+			}
+		})
+	}
+
+	if got := sshTunnel(filepath.Join(dir, "missing")); got != "" {
+		t.Errorf("sshTunnel of an exited process = %q", got)
+	}
+}
+
+// fakeProc builds a /proc with the given processes, by PID, and net/tcp
+// lines.
+func fakeProc(t *testing.T, procs map[string][]string, tcp []string) string {
+	t.Helper()
+	root := t.TempDir()
+	for pid, cmdline := range procs {
+		dir := filepath.Join(root, pid)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		comm := filepath.Base(cmdline[0])
+		if len(comm) > 15 {
+			comm = comm[:15]
+		}
+		os.WriteFile(filepath.Join(dir, "comm"), []byte(comm+"\n"), 0644)
+		os.WriteFile(filepath.Join(dir, "cmdline"), []byte(strings.Join(cmdline, "\x00")+"\x00"), 0644)
+	}
+	os.MkdirAll(filepath.Join(root, "net"), 0755)
+	header := "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode"
+	os.WriteFile(filepath.Join(root, "net", "tcp"), []byte(strings.Join(append([]string{header}, tcp...), "\n")+"\n"), 0644)
+	return root
+}
+
+func TestProxyProcesses(t *testing.T) {
+	d := NewDetector()
+	d.procRoot = fakeProc(t, map[string][]string{
+		"100":  {"/usr/bin/tor", "-f", "torrc"},
+		"101":  {"/usr/bin/snowflake-client"},
+		"102":  {"ssh", "-D", "1080", "host"},
+		"103":  {"ssh", "host"},
+		"104":  {"/usr/bin/bash"},
+		"self": {"/usr/bin/openvpn"},
+	}, nil)
+
+	got := d.proxyProcesses()
+	want := []Finding{
+		{Kind: KindProxyProcess, Name: "tor", Detail: "Tor", PID: 100},
+		{Kind: KindProxyProcess, Name: "snowflake-clien", Detail: "Tor pluggable transport", PID: 101},
+		{Kind: KindProxyProcess, Name: "ssh", Detail: socksProxy, PID: 102},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("proxyProcesses = %v, want %v", got, want)
+	}
+}
+
+func TestTorSockets(t *testing.T) {
+	d := NewDetector()
+	d.procRoot = fakeProc(t, nil, []string{
+		// Listening on 127.0.0.1:9050
+		"   0: 0100007F:235A 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1",
+		// Established to a relay on port 9001
+		"   1: 0A00000A:C350 22D8B85D:2329 01 00000000:00000000 00:00000000 00000000  1000        0 2",
+		// Listening on 9001 is a relay of our own, not a client
+		"   2: 00000000:2329 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 3",
+		// A closed connection to a relay port
+		"   3: 0A00000A:C351 22D8B85D:2329 06 00000000:00000000 00:00000000 00000000  1000        0 4",
+		// HTTPS
+		"   4: 0A00000A:C352 22D8B85D:01BB 01 00000000:00000000 00:00000000 00000000  1000        0 5",
+		"   5: malformed",
+	})
+
+	got := d.torSockets()
+	want := []Finding{
+		{Kind: KindTor, Name: "port 9050", Detail: "Tor SOCKS port listening"},
+		{Kind: KindTor, Name: "port 9001", Detail: "connection to a Tor relay port"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("torSockets = %v, want %v", got, want)
+	}
+}
+
+func TestNewFindings(t *testing.T) {
+	vpn := Finding{Kind: KindVPN, Name: "wg0", Interface: "wg0"}
+	tor := Finding{Kind: KindProxyProcess, Name: "tor", PID: 100}
+	torRestarted := Finding{Kind: KindProxyProcess, Name: "tor", PID: 200}
+
+	d := NewDetector()
+	scans := []struct {
+		current []Finding
+		want    []Finding
+	}{
+		{[]Finding{vpn}, []Finding{vpn}},
+		{[]Finding{vpn, tor}, []Finding{tor}},
+		{[]Finding{vpn, tor}, nil},
+		// A restarted process is a new finding
+		{[]Finding{vpn, torRestarted}, []Finding{torRestarted}},
+		{nil, nil},
+		// Findings that went away are reported when they come back
+		{[]Finding{vpn}, []Finding{vpn}},
+	}
+	for i, scan := range scans {
+		if got := d.newFindings(scan.current); !reflect.DeepEqual(got, scan.want) {
+			t.Errorf("scan %d: newFindings = %v, want %v", i, got, scan.want)
+		}
+	}
+}
+
+func TestProxySettings(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "environment")
+	write := func(content string) string {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return proxySettings(path)
+	}
+
+	if got := write("PATH=/usr/bin\n"); got != "" {
+		t.Errorf("file without proxy settings has digest %q", got)
+	}
+	set := write("PATH=/usr/bin\nhttp_proxy=http://proxy:3128\n")
+	if set == "" {
+		t.Fatal("proxy setting was not seen")
+	}
+	if got := write("PATH=/usr/local/bin:/usr/bin\n  http_proxy=http://proxy:3128  \n"); got != set {
+		t.Error("digest changed with unrelated lines")
+	}
+	if got := write("PATH=/usr/bin\nHTTPS_PROXY=http://proxy:3128\nhttp_proxy=http://proxy:3128\n"); got == set {
+		t.Error("digest did not change with a new proxy setting")
+	}
+	if got := proxySettings(filepath.Join(dir, "missing")); got != "" {
+		t.Errorf("missing file has digest %q", got)
+	}
+}
+
+func TestProcPort(t *testing.T) {
+	tests := map[string]int{
+		"0100007F:235A":                         9050,
+		"00000000000000000000000001000000:1F90": 8080,
+		"0100007F":                              0,
+		"0100007F:XYZ":                          0,
+	}
+	for field, want := range tests {
+		if got := procPort(field); got != want {
+			t.Errorf("procPort(%s) = %d, want %d", field, got, want)
+		}
+	}
+}
@@ -3,20 +3,115 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"time"
 )
 
 type Config struct {
-	BlockedApps     []string `json:"blocked_apps"`
-	BlockedWebsites []string `json:"blocked_websites"`
-	BlockedPaths    []string `json:"blocked_paths"`
-	AuthDevice      string   `json:"auth_device"`
-	AuthKey         string   `json:"auth_key"`
-	AuthDeviceName  string   `json:"auth_device_name"`
-	AuthMountState  string   `json:"auth_mount_state"`
-	EnforceState    bool     `json:"enforce_state"`
+	BlockedApps     []string            `json:"blocked_apps"`
+	BlockedWebsites []string            `json:"blocked_websites"`
+	BlockedPaths    []string            `json:"blocked_paths"`
+	AuthDevice      string              `json:"auth_device"`
+	AuthKey         string              `json:"auth_key"`
+	AuthDeviceName  string              `json:"auth_device_name"`
+	AuthMountState  string              `json:"auth_mount_state"`
+	EnforceState    bool                `json:"enforce_state"`
+	Profiles        map[string][]string `json:"profiles,omitempty"`
+	Schedules       []Schedule          `json:"schedules,omitempty"`
+	Quotas          []Quota             `json:"quotas,omitempty"`
+	QuotaResetTime  string              `json:"quota_reset_time,omitempty"`
+	Metadata        map[string]RuleMeta `json:"metadata,omitempty"`
+	NetworkMode     string              `json:"network_mode,omitempty"`
+	AllowedWebsites []string            `json:"allowed_websites,omitempty"`
+	Resolver        Resolver            `json:"resolver"`
+	FirewallBackend string              `json:"firewall_backend,omitempty"`
+	AppBackend      string              `json:"app_backend,omitempty"`
+	EncryptedDNS    EncryptedDNS        `json:"encrypted_dns"`
+	QUIC            string              `json:"quic,omitempty"`
+	SNIInspection   bool                `json:"sni_inspection,omitempty"`
+	BrowserPolicy   BrowserPolicy       `json:"browser_policy"`
+	LandingPage     LandingPage         `json:"landing_page"`
+	Circumvention   Circumvention       `json:"circumvention"`
+}
+
+const (
+	NetworkModeBlocklist = "blocklist"
+	NetworkModeAllowlist = "allowlist"
+)
+
+// Resolver configures the built-in DNS sinkhole. While locked, the system
+// resolver is pointed at Listen and blocked names get Response instead of
+// being forwarded to Upstreams.
+type Resolver struct {
+	Enabled   bool     `json:"enabled"`
+	Listen    string   `json:"listen,omitempty"`
+	Upstreams []string `json:"upstreams,omitempty"`
+	Response  string   `json:"response,omitempty"`
+}
+
+// BrowserPolicy makes keyphy write managed Chrome, Chromium and Firefox
+// policies while websites are blocked.
+type BrowserPolicy struct {
+	Enabled         bool `json:"enabled"`
+	BlockIncognito  bool `json:"block_incognito,omitempty"`
+	BlockExtensions bool `json:"block_extensions,omitempty"`
+}
+
+// LandingPage makes the daemon serve a page explaining the block on a
+// loopback address that the hosts entries of blocked sites point to.
+type LandingPage struct {
+	Enabled bool   `json:"enabled"`
+	Listen  string `json:"listen,omitempty"`
+}
+
+// Circumvention decides what the daemon does when it detects a VPN, proxy
+// or Tor while locked. Every detection is audited unless Policy is off.
+type Circumvention struct {
+	Policy string `json:"policy,omitempty"`
+	// ExtendBy is how long the lock is held after a detection with the
+	// extend policy.
+	ExtendBy string `json:"extend_by,omitempty"`
+}
+
+// EncryptedDNS adds resolvers to the built-in encrypted DNS blocklist, or
+// replaces it when NoDefaults is set. Addresses are IPs or CIDRs, Hosts are
+// DoH hostnames.
+type EncryptedDNS struct {
+	Addresses  []string `json:"addresses,omitempty"`
+	Hosts      []string `json:"hosts,omitempty"`
+	NoDefaults bool     `json:"no_defaults,omitempty"`
+}
+
+const (
+	DefaultResolverListen = "127.0.0.153"
+	DefaultLandingListen  = "127.0.0.154"
+	ResolverNXDomain      = "nxdomain"
+	ResolverZeroAddress   = "zero"
+)
+
+// Circumvention policies; an empty policy means CircumventionReport.
+const (
+	CircumventionOff    = "off"
+	CircumventionReport = "report"
+	CircumventionBlock  = "block"
+	CircumventionExtend = "extend"
+
+	DefaultLockExtension = "30m"
+)
+
+// Schedule locks its targets automatically during a weekly time window.
+// A schedule without profile or items applies to every blocked item.
+type Schedule struct {
+	Name     string   `json:"name"`
+	Days     []string `json:"days,omitempty"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Timezone string   `json:"timezone,omitempty"`
+	Profile  string   `json:"profile,omitempty"`
+	Items    []string `json:"items,omitempty"`
 }
 
 var (
@@ -64,8 +159,10 @@ func InitConfig() error {
 		}
 		if err := json.Unmarshal(data, config); err != nil {
 			fmt.Println("Warning: Config file corrupted, creating new one")
+			loadFragments()
 			return SaveConfig()
 		}
+		loadFragments()
 		// Restore protection
 		ProtectConfigFile()
 		return nil
@@ -73,6 +170,7 @@ func InitConfig() error {
 		fmt.Println("Creating keyphy configuration file...")
 	}
 
+	loadFragments()
 	return SaveConfig()
 }
 
@@ -81,7 +179,8 @@ func GetConfig() *Config {
 }
 
 func SaveConfig() error {
-	data, err := json.MarshalIndent(config, "", "  ")
+	// Rules merged from conf.d fragments stay in their fragments
+	data, err := json.MarshalIndent(localConfig(), "", "  ")
 	if err != nil {
 		return err
 	}
@@ -97,54 +196,105 @@ func SaveConfig() error {
 	return nil
 }
 
-func AddBlockedApp(app string) error {
+func AddBlockedApp(app string, meta RuleMeta) error {
 	UnprotectConfigFile()
 	// Check for duplicates
 	for _, existing := range config.BlockedApps {
 		if existing == app {
+			if claimLocal("app", app) {
+				return SaveConfig()
+			}
 			fmt.Printf("'%s' is already in blocked applications list\n", app)
 			return nil
 		}
 	}
 	config.BlockedApps = append(config.BlockedApps, app)
+	setMeta(app, meta)
 	fmt.Printf("Added '%s' to blocked applications in config\n", app)
 	return SaveConfig()
 }
 
-func AddBlockedAppWithPath(app, path string) error {
+func AddBlockedAppWithPath(app, path string, meta RuleMeta) error {
 	UnprotectConfigFile()
 	appEntry := fmt.Sprintf("%s:%s", app, path)
 	// Check for duplicates
 	for _, existing := range config.BlockedApps {
 		if existing == appEntry || existing == path {
+			if claimLocal("app", existing) {
+				return SaveConfig()
+			}
 			fmt.Printf("'%s' is already in blocked applications list\n", appEntry)
 			return nil
 		}
 	}
 	config.BlockedApps = append(config.BlockedApps, appEntry)
+	setMeta(appEntry, meta)
 	fmt.Printf("Added '%s' with path '%s' to blocked applications in config\n", app, path)
 	return SaveConfig()
 }
 
-func AddBlockedWebsite(website string) error {
+func AddBlockedWebsite(website string, meta RuleMeta) error {
 	UnprotectConfigFile()
+	if contains(config.BlockedWebsites, website) {
+		if claimLocal("website", website) {
+			return SaveConfig()
+		}
+		fmt.Printf("'%s' is already in blocked websites list\n", website)
+		return nil
+	}
 	config.BlockedWebsites = append(config.BlockedWebsites, website)
+	setMeta(website, meta)
 	fmt.Printf("Added '%s' to blocked websites in config\n", website)
 	return SaveConfig()
 }
 
-func AddBlockedPath(path string) error {
+// AddBlockedWebsites adds several websites with a single config write.
+// Domains that are already blocked are skipped.
+func AddBlockedWebsites(websites []string, meta RuleMeta) error {
 	UnprotectConfigFile()
+	existing := make(map[string]bool)
+	for _, website := range config.BlockedWebsites {
+		existing[website] = true
+	}
+	added := 0
+	for _, website := range websites {
+		if !existing[website] {
+			existing[website] = true
+			config.BlockedWebsites = append(config.BlockedWebsites, website)
+			setMeta(website, meta)
+			added++
+		} else if claimLocal("website", website) {
+			added++
+		}
+	}
+	fmt.Printf("Added %d website(s) to blocked websites in config\n", added)
+	return SaveConfig()
+}
+
+func AddBlockedPath(path string, meta RuleMeta) error {
+	UnprotectConfigFile()
+	if contains(config.BlockedPaths, path) {
+		if claimLocal("path", path) {
+			return SaveConfig()
+		}
+		fmt.Printf("'%s' is already in blocked paths list\n", path)
+		return nil
+	}
 	config.BlockedPaths = append(config.BlockedPaths, path)
+	setMeta(path, meta)
 	fmt.Printf("Added '%s' to blocked paths in config\n", path)
 	return SaveConfig()
 }
 
 func RemoveBlocked(item string) error {
+	if source, managed := ManagedBy(item); managed {
+		return fmt.Errorf("'%s' is managed by %s and cannot be removed here", item, source)
+	}
 	UnprotectConfigFile()
 	config.BlockedApps = removeFromSlice(config.BlockedApps, item)
 	config.BlockedWebsites = removeFromSlice(config.BlockedWebsites, item)
 	config.BlockedPaths = removeFromSlice(config.BlockedPaths, item)
+	delete(config.Metadata, item)
 	return SaveConfig()
 }
 
@@ -157,6 +307,303 @@ func CleanDuplicates() error {
 	return SaveConfig()
 }
 
+// Quota allows an app or website for a daily time budget before it is blocked.
+// Days restricts the quota to certain days of the week, using the same day
+// specs as schedules.
+type Quota struct {
+	Kind  string   `json:"kind"`
+	Item  string   `json:"item"`
+	Limit string   `json:"limit"`
+	Days  []string `json:"days,omitempty"`
+}
+
+// Key identifies a quota by kind and item, since an app and a website of
+// the same name each have their own budget and usage.
+func (q Quota) Key() string {
+	return q.Kind + ":" + q.Item
+}
+
+func SetProfile(name string, items []string) error {
+	if IsManaged("profile", name) {
+		return fmt.Errorf("profile '%s' is managed by %s and cannot be changed here", name, Source("profile", name))
+	}
+	UnprotectConfigFile()
+	if config.Profiles == nil {
+		config.Profiles = make(map[string][]string)
+	}
+	config.Profiles[name] = removeDuplicates(items)
+	fmt.Printf("Profile '%s' now contains %d item(s)\n", name, len(config.Profiles[name]))
+	return SaveConfig()
+}
+
+func RemoveProfile(name string) error {
+	UnprotectConfigFile()
+	if _, exists := config.Profiles[name]; !exists {
+		return fmt.Errorf("profile '%s' not found", name)
+	}
+	for _, sched := range config.Schedules {
+		if sched.Profile == name {
+			return fmt.Errorf("profile '%s' is used by schedule '%s'", name, sched.Name)
+		}
+	}
+	if IsManaged("profile", name) {
+		return fmt.Errorf("profile '%s' is managed by %s and cannot be removed here", name, Source("profile", name))
+	}
+	delete(config.Profiles, name)
+	fmt.Printf("Removed profile '%s'\n", name)
+	return SaveConfig()
+}
+
+// ProfileItems returns the items of a profile, or nil if it does not exist.
+func ProfileItems(name string) []string {
+	return config.Profiles[name]
+}
+
+func AddSchedule(sched Schedule) error {
+	UnprotectConfigFile()
+	for _, existing := range config.Schedules {
+		if existing.Name == sched.Name {
+			return fmt.Errorf("schedule '%s' already exists", sched.Name)
+		}
+	}
+	if sched.Profile != "" {
+		if _, exists := config.Profiles[sched.Profile]; !exists {
+			return fmt.Errorf("profile '%s' not found", sched.Profile)
+		}
+	}
+	config.Schedules = append(config.Schedules, sched)
+	fmt.Printf("Added schedule '%s' to config\n", sched.Name)
+	return SaveConfig()
+}
+
+func RemoveSchedule(name string) error {
+	UnprotectConfigFile()
+	if IsManaged("schedule", name) {
+		return fmt.Errorf("schedule '%s' is managed by %s and cannot be removed here", name, Source("schedule", name))
+	}
+	for i, existing := range config.Schedules {
+		if existing.Name == name {
+			config.Schedules = append(config.Schedules[:i], config.Schedules[i+1:]...)
+			fmt.Printf("Removed schedule '%s' from config\n", name)
+			return SaveConfig()
+		}
+	}
+	return fmt.Errorf("schedule '%s' not found", name)
+}
+
+func AddQuota(quota Quota) error {
+	if IsManaged("quota", quota.Key()) {
+		return fmt.Errorf("%s quota for '%s' is managed by %s and cannot be changed here", quota.Kind, quota.Item, Source("quota", quota.Key()))
+	}
+	UnprotectConfigFile()
+	for i, existing := range config.Quotas {
+		if existing.Kind == quota.Kind && existing.Item == quota.Item {
+			config.Quotas[i] = quota
+			fmt.Printf("Updated %s quota for '%s' in config\n", quota.Kind, quota.Item)
+			return SaveConfig()
+		}
+	}
+	config.Quotas = append(config.Quotas, quota)
+	fmt.Printf("Added %s quota for '%s' to config\n", quota.Kind, quota.Item)
+	return SaveConfig()
+}
+
+func RemoveQuota(kind, item string) error {
+	key := Quota{Kind: kind, Item: item}.Key()
+	if IsManaged("quota", key) {
+		return fmt.Errorf("%s quota for '%s' is managed by %s and cannot be removed here", kind, item, Source("quota", key))
+	}
+	UnprotectConfigFile()
+	for i, existing := range config.Quotas {
+		if existing.Key() == key {
+			config.Quotas = append(config.Quotas[:i], config.Quotas[i+1:]...)
+			fmt.Printf("Removed %s quota for '%s' from config\n", kind, item)
+			return SaveConfig()
+		}
+	}
+	return fmt.Errorf("no %s quota configured for '%s'", kind, item)
+}
+
+func SetQuotaResetTime(resetTime string) error {
+	UnprotectConfigFile()
+	config.QuotaResetTime = resetTime
+	fmt.Printf("Quota counters now reset daily at %s\n", resetTime)
+	return SaveConfig()
+}
+
+func SetNetworkMode(mode string) error {
+	if mode != NetworkModeBlocklist && mode != NetworkModeAllowlist {
+		return fmt.Errorf("invalid network mode %s (use %s or %s)", mode, NetworkModeBlocklist, NetworkModeAllowlist)
+	}
+	UnprotectConfigFile()
+	config.NetworkMode = mode
+	fmt.Printf("Network mode set to %s\n", mode)
+	return SaveConfig()
+}
+
+func SetQUIC(mode string) error {
+	UnprotectConfigFile()
+	config.QUIC = mode
+	fmt.Printf("QUIC blocking set to %s\n", mode)
+	return SaveConfig()
+}
+
+func SetSNIInspection(enabled bool) error {
+	UnprotectConfigFile()
+	config.SNIInspection = enabled
+	if enabled {
+		fmt.Println("SNI inspection enabled")
+	} else {
+		fmt.Println("SNI inspection disabled")
+	}
+	return SaveConfig()
+}
+
+func SetBrowserPolicy(policy BrowserPolicy) error {
+	UnprotectConfigFile()
+	config.BrowserPolicy = policy
+	if policy.Enabled {
+		fmt.Println("Browser policies enabled")
+	} else {
+		fmt.Println("Browser policies disabled")
+	}
+	return SaveConfig()
+}
+
+func SetLandingPage(page LandingPage) error {
+	UnprotectConfigFile()
+	config.LandingPage = page
+	if page.Enabled {
+		fmt.Println("Landing page enabled")
+	} else {
+		fmt.Println("Landing page disabled")
+	}
+	return SaveConfig()
+}
+
+func SetCircumvention(policy Circumvention) error {
+	switch policy.Policy {
+	case CircumventionOff, CircumventionReport, CircumventionBlock, CircumventionExtend:
+	default:
+		return fmt.Errorf("invalid circumvention policy %s (use %s, %s, %s or %s)", policy.Policy,
+			CircumventionOff, CircumventionReport, CircumventionBlock, CircumventionExtend)
+	}
+	if policy.ExtendBy != "" {
+		if d, err := time.ParseDuration(policy.ExtendBy); err != nil || d <= 0 {
+			return fmt.Errorf("invalid lock extension %s", policy.ExtendBy)
+		}
+	}
+	UnprotectConfigFile()
+	config.Circumvention = policy
+	fmt.Printf("Circumvention policy set to %s\n", policy.Policy)
+	return SaveConfig()
+}
+
+func SetFirewallBackend(backend string) error {
+	UnprotectConfigFile()
+	config.FirewallBackend = backend
+	fmt.Printf("Firewall backend set to %s\n", backend)
+	return SaveConfig()
+}
+
+func SetAppBackend(backend string) error {
+	UnprotectConfigFile()
+	config.AppBackend = backend
+	fmt.Printf("App blocking backend set to %s\n", backend)
+	return SaveConfig()
+}
+
+func SetResolver(resolver Resolver) error {
+	if resolver.Response != "" && resolver.Response != ResolverNXDomain && resolver.Response != ResolverZeroAddress {
+		return fmt.Errorf("invalid resolver response %s (use %s or %s)", resolver.Response, ResolverNXDomain, ResolverZeroAddress)
+	}
+	UnprotectConfigFile()
+	config.Resolver = resolver
+	if resolver.Enabled {
+		fmt.Println("DNS sinkhole resolver enabled")
+	} else {
+		fmt.Println("DNS sinkhole resolver disabled")
+	}
+	return SaveConfig()
+}
+
+// AddEncryptedDNSServer adds an address, CIDR or hostname to the encrypted
+// DNS blocklist.
+func AddEncryptedDNSServer(server string) error {
+	UnprotectConfigFile()
+	list := &config.EncryptedDNS.Hosts
+	if isAddress(server) {
+		list = &config.EncryptedDNS.Addresses
+	}
+	if contains(*list, server) {
+		fmt.Printf("'%s' is already in the encrypted DNS blocklist\n", server)
+		return nil
+	}
+	*list = append(*list, server)
+	fmt.Printf("Added '%s' to the encrypted DNS blocklist\n", server)
+	return SaveConfig()
+}
+
+func RemoveEncryptedDNSServer(server string) error {
+	UnprotectConfigFile()
+	list := &config.EncryptedDNS.Hosts
+	if isAddress(server) {
+		list = &config.EncryptedDNS.Addresses
+	}
+	if !contains(*list, server) {
+		return fmt.Errorf("'%s' is not in the encrypted DNS blocklist", server)
+	}
+	*list = removeFromSlice(*list, server)
+	fmt.Printf("Removed '%s' from the encrypted DNS blocklist\n", server)
+	return SaveConfig()
+}
+
+func SetEncryptedDNSDefaults(enabled bool) error {
+	UnprotectConfigFile()
+	config.EncryptedDNS.NoDefaults = !enabled
+	if enabled {
+		fmt.Println("Built-in encrypted DNS blocklist enabled")
+	} else {
+		fmt.Println("Built-in encrypted DNS blocklist disabled, only configured servers are blocked")
+	}
+	return SaveConfig()
+}
+
+func isAddress(server string) bool {
+	if net.ParseIP(server) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(server)
+	return err == nil
+}
+
+func AddAllowedWebsite(website string) error {
+	UnprotectConfigFile()
+	if contains(config.AllowedWebsites, website) {
+		if claimLocal("allowed", website) {
+			return SaveConfig()
+		}
+		fmt.Printf("'%s' is already in allowed websites list\n", website)
+		return nil
+	}
+	config.AllowedWebsites = append(config.AllowedWebsites, website)
+	fmt.Printf("Added '%s' to allowed websites in config\n", website)
+	return SaveConfig()
+}
+
+func RemoveAllowedWebsite(website string) error {
+	if IsManaged("allowed", website) {
+		return fmt.Errorf("'%s' is managed by %s and cannot be removed here", website, Source("allowed", website))
+	}
+	UnprotectConfigFile()
+	if !contains(config.AllowedWebsites, website) {
+		return fmt.Errorf("'%s' is not in allowed websites list", website)
+	}
+	config.AllowedWebsites = removeFromSlice(config.AllowedWebsites, website)
+	fmt.Printf("Removed '%s' from allowed websites in config\n", website)
+	return SaveConfig()
+}
+
 func removeDuplicates(slice []string) []string {
 	seen := make(map[string]bool)
 	result := []string{}
@@ -171,12 +618,20 @@ func removeDuplicates(slice []string) []string {
 
 func ProtectConfigFile() {
 	// Make config file immutable to prevent tampering
-	exec.Command("chattr", "+i", ConfigFile).Run()
+	protectFile(ConfigFile)
 }
 
 func UnprotectConfigFile() {
 	// Remove immutable flag from config file
-	exec.Command("chattr", "-i", ConfigFile).Run()
+	unprotectFile(ConfigFile)
+}
+
+func protectFile(path string) {
+	exec.Command("chattr", "+i", path).Run()
+}
+
+func unprotectFile(path string) {
+	exec.Command("chattr", "-i", path).Run()
 }
 
 func removeFromSlice(slice []string, item string) []string {
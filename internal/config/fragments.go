@@ -0,0 +1,224 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FragmentDir holds drop-in policy fragments, typically deployed by
+// configuration management. Fragments use the config.json format but only
+// their rule lists, profiles, schedules and quotas are merged; auth settings
+// are always taken from config.json.
+var FragmentDir = filepath.Join(ConfigDir, "conf.d")
+
+// sources maps rules that came from a fragment to the fragment's path.
+// Rules from config.json are not tracked.
+var sources = make(map[string]string)
+
+func sourceKey(kind, name string) string {
+	return kind + "\x00" + name
+}
+
+// Fragments returns the fragment files in the order they are merged.
+func Fragments() []string {
+	files, _ := filepath.Glob(filepath.Join(FragmentDir, "*.json"))
+	// Glob returns matches in lexical order
+	return files
+}
+
+// Source returns the file a rule was loaded from. kind is one of "app",
+// "website", "path", "allowed", "profile", "schedule" or "quota"; quotas
+// are named by Quota.Key.
+func Source(kind, name string) string {
+	if source, ok := sources[sourceKey(kind, name)]; ok {
+		return source
+	}
+	return ConfigFile
+}
+
+// IsManaged reports whether a rule comes from a fragment and therefore
+// cannot be changed through config.json.
+func IsManaged(kind, name string) bool {
+	_, ok := sources[sourceKey(kind, name)]
+	return ok
+}
+
+// ManagedBy returns the fragment providing a blocked app, website or path.
+func ManagedBy(item string) (string, bool) {
+	for _, kind := range []string{"app", "website", "path"} {
+		if IsManaged(kind, item) {
+			return Source(kind, item), true
+		}
+	}
+	return "", false
+}
+
+// loadFragments merges every fragment into the loaded config. Rules that
+// already exist keep their original source.
+func loadFragments() {
+	sources = make(map[string]string)
+	for _, file := range Fragments() {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Printf("Warning: Failed to read config fragment %s: %v\n", file, err)
+			continue
+		}
+		var fragment Config
+		if err := json.Unmarshal(data, &fragment); err != nil {
+			fmt.Printf("Warning: Ignoring corrupted config fragment %s: %v\n", file, err)
+			continue
+		}
+		// Fragments get the same tamper protection as config.json
+		protectFile(file)
+
+		config.BlockedApps = mergeList(config.BlockedApps, fragment.BlockedApps, "app", file)
+		config.BlockedWebsites = mergeList(config.BlockedWebsites, fragment.BlockedWebsites, "website", file)
+		config.BlockedPaths = mergeList(config.BlockedPaths, fragment.BlockedPaths, "path", file)
+
+		config.AllowedWebsites = mergeList(config.AllowedWebsites, fragment.AllowedWebsites, "allowed", file)
+
+		for name, items := range fragment.Profiles {
+			if _, exists := config.Profiles[name]; exists {
+				continue
+			}
+			if config.Profiles == nil {
+				config.Profiles = make(map[string][]string)
+			}
+			config.Profiles[name] = items
+			sources[sourceKey("profile", name)] = file
+		}
+		for _, sched := range fragment.Schedules {
+			if !hasSchedule(sched.Name) {
+				config.Schedules = append(config.Schedules, sched)
+				sources[sourceKey("schedule", sched.Name)] = file
+			}
+		}
+		for item, meta := range fragment.Metadata {
+			if sources[sourceKey("app", item)] == file || sources[sourceKey("website", item)] == file || sources[sourceKey("path", item)] == file {
+				setMeta(item, meta)
+			}
+		}
+		for _, quota := range fragment.Quotas {
+			if !hasQuota(quota) {
+				config.Quotas = append(config.Quotas, quota)
+				sources[sourceKey("quota", quota.Key())] = file
+			}
+		}
+	}
+}
+
+func mergeList(list, additions []string, kind, file string) []string {
+	for _, item := range additions {
+		if !contains(list, item) {
+			list = append(list, item)
+			sources[sourceKey(kind, item)] = file
+		}
+	}
+	return list
+}
+
+func hasSchedule(name string) bool {
+	for _, sched := range config.Schedules {
+		if sched.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasQuota(quota Quota) bool {
+	for _, existing := range config.Quotas {
+		if existing.Key() == quota.Key() {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, item string) bool {
+	for _, existing := range list {
+		if existing == item {
+			return true
+		}
+	}
+	return false
+}
+
+// localConfig returns the parts of the effective config that belong in
+// config.json, leaving out everything merged from fragments.
+func localConfig() *Config {
+	local := *config
+	local.BlockedApps = filterManaged(config.BlockedApps, "app")
+	local.BlockedWebsites = filterManaged(config.BlockedWebsites, "website")
+	local.BlockedPaths = filterManaged(config.BlockedPaths, "path")
+	local.AllowedWebsites = filterManaged(config.AllowedWebsites, "allowed")
+
+	if config.Profiles != nil {
+		local.Profiles = make(map[string][]string)
+		for name, items := range config.Profiles {
+			if !IsManaged("profile", name) {
+				local.Profiles[name] = items
+			}
+		}
+	}
+	local.Schedules = nil
+	for _, sched := range config.Schedules {
+		if !IsManaged("schedule", sched.Name) {
+			local.Schedules = append(local.Schedules, sched)
+		}
+	}
+	local.Quotas = nil
+	for _, quota := range config.Quotas {
+		if !IsManaged("quota", quota.Key()) {
+			local.Quotas = append(local.Quotas, quota)
+		}
+	}
+	if config.Metadata != nil {
+		local.Metadata = make(map[string]RuleMeta)
+		for item, meta := range config.Metadata {
+			if _, managed := ManagedBy(item); !managed {
+				local.Metadata[item] = meta
+			}
+		}
+	}
+	return &local
+}
+
+// claimLocal makes an item a fragment provides a local rule as well, so it
+// stays in config.json if the fragment is removed. It reports whether the
+// item was managed.
+func claimLocal(kind, item string) bool {
+	source, managed := sources[sourceKey(kind, item)]
+	if managed {
+		delete(sources, sourceKey(kind, item))
+		fmt.Printf("'%s' is also provided by %s, keeping a local copy\n", item, source)
+	}
+	return managed
+}
+
+func filterManaged(list []string, kind string) []string {
+	filtered := []string{}
+	for _, item := range list {
+		if !IsManaged(kind, item) {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered
+}
+
+// ModSignature summarizes the modification state of config.json and all
+// fragments, so callers can detect changes to any of them.
+func ModSignature() (string, error) {
+	var parts []string
+	for _, file := range append([]string{ConfigFile}, Fragments()...) {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, fmt.Sprintf("%s:%d:%d", file, info.ModTime().UnixNano(), info.Size()))
+	}
+	return strings.Join(parts, "|"), nil
+}
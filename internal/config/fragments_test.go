@@ -0,0 +1,78 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLocalConfigKeepsClaimedDuplicates(t *testing.T) {
+	saved, savedSources := config, sources
+	defer func() { config, sources = saved, savedSources }()
+
+	const fragment = "/etc/keyphy/conf.d/10-school.json"
+	config = &Config{BlockedWebsites: []string{"local.com"}}
+	sources = make(map[string]string)
+	config.BlockedWebsites = mergeList(config.BlockedWebsites, []string{"local.com", "managed.com", "both.com"}, "website", fragment)
+
+	if IsManaged("website", "local.com") {
+		t.Error("a rule already in config.json was taken over by the fragment")
+	}
+	if got, want := localConfig().BlockedWebsites, []string{"local.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("local websites = %v, want %v", got, want)
+	}
+
+	// Adding a managed rule locally keeps it once the fragment is gone
+	if !claimLocal("website", "both.com") {
+		t.Error("claimLocal did not report the managed rule")
+	}
+	if claimLocal("website", "local.com") {
+		t.Error("claimLocal reported a local rule as managed")
+	}
+	if got, want := localConfig().BlockedWebsites, []string{"local.com", "both.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("local websites = %v, want %v", got, want)
+	}
+}
+
+func TestFragmentQuotasByKind(t *testing.T) {
+	saved, savedSources := config, sources
+	defer func() { config, sources = saved, savedSources }()
+
+	const fragment = "/etc/keyphy/conf.d/10-school.json"
+	app := Quota{Kind: "app", Item: "steam", Limit: "2h0m0s"}
+	website := Quota{Kind: "website", Item: "steam", Limit: "30m0s"}
+	config = &Config{Quotas: []Quota{app}}
+	sources = make(map[string]string)
+
+	// A fragment's website quota does not collide with the local app quota
+	for _, quota := range []Quota{app, website} {
+		if !hasQuota(quota) {
+			config.Quotas = append(config.Quotas, quota)
+			sources[sourceKey("quota", quota.Key())] = fragment
+		}
+	}
+	if got, want := config.Quotas, []Quota{app, website}; !reflect.DeepEqual(got, want) {
+		t.Errorf("merged quotas = %v, want %v", got, want)
+	}
+	if IsManaged("quota", app.Key()) || !IsManaged("quota", website.Key()) {
+		t.Error("quota provenance is not tracked per kind")
+	}
+	if got, want := localConfig().Quotas, []Quota{app}; !reflect.DeepEqual(got, want) {
+		t.Errorf("local quotas = %v, want %v", got, want)
+	}
+}
+func TestRemoveManagedAllowedWebsite(t *testing.T) {
+	saved, savedSources := config, sources
+	defer func() { config, sources = saved, savedSources }()
+
+	const fragment = "/etc/keyphy/conf.d/10-school.json"
+	config = &Config{}
+	sources = make(map[string]string)
+	config.AllowedWebsites = mergeList(config.AllowedWebsites, []string{"school.edu"}, "allowed", fragment)
+
+	if err := RemoveAllowedWebsite("school.edu"); err == nil {
+		t.Fatal("a managed allowlist entry was removed")
+	}
+	if got, want := config.AllowedWebsites, []string{"school.edu"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("allowed websites = %v, want %v", got, want)
+	}
+}
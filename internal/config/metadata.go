@@ -0,0 +1,104 @@
+package config
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+)
+
+// RuleMeta is optional information attached to a blocked app, website or
+// path. It is stored separately from the rule lists, keyed by the rule
+// string, so older configs keep working unchanged.
+type RuleMeta struct {
+	Note      string     `json:"note,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	CreatedBy int        `json:"created_by"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Tags      []string   `json:"tags,omitempty"`
+	// Ranges are CIDRs blocked together with a website's resolved addresses.
+	Ranges []string `json:"ranges,omitempty"`
+	// Users and Groups limit a website rule to those logins. Without them
+	// it applies to everyone.
+	Users  []string `json:"users,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// NewRuleMeta returns metadata stamped with the current time and the UID of
+// the user running keyphy. Under sudo the invoking user is recorded rather
+// than root.
+func NewRuleMeta(note string, tags []string, expiresAt *time.Time) RuleMeta {
+	uid := os.Getuid()
+	if sudoUID, err := strconv.Atoi(os.Getenv("SUDO_UID")); err == nil {
+		uid = sudoUID
+	}
+	return RuleMeta{
+		Note:      note,
+		CreatedAt: time.Now().Truncate(time.Second),
+		CreatedBy: uid,
+		ExpiresAt: expiresAt,
+		Tags:      removeDuplicates(tags),
+	}
+}
+
+// Expired reports whether the rule has an expiry that passed before now.
+func (m RuleMeta) Expired(now time.Time) bool {
+	return m.ExpiresAt != nil && !m.ExpiresAt.After(now)
+}
+
+// Scoped reports whether the rule is limited to some users or groups.
+func (m RuleMeta) Scoped() bool {
+	return len(m.Users) > 0 || len(m.Groups) > 0
+}
+
+// LookupUser accepts a login name or a numeric UID.
+func LookupUser(name string) (*user.User, error) {
+	if u, err := user.Lookup(name); err == nil {
+		return u, nil
+	}
+	return user.LookupId(name)
+}
+
+// LookupGroup accepts a group name or a numeric GID.
+func LookupGroup(name string) (*user.Group, error) {
+	if g, err := user.LookupGroup(name); err == nil {
+		return g, nil
+	}
+	return user.LookupGroupId(name)
+}
+
+// HasTag reports whether the rule carries the given tag.
+func (m RuleMeta) HasTag(tag string) bool {
+	return contains(m.Tags, tag)
+}
+
+// Meta returns the metadata of a rule, if any was recorded.
+func Meta(item string) (RuleMeta, bool) {
+	meta, ok := config.Metadata[item]
+	return meta, ok
+}
+
+// IsExpired reports whether a rule's expiry has passed.
+func IsExpired(item string, now time.Time) bool {
+	meta, ok := config.Metadata[item]
+	return ok && meta.Expired(now)
+}
+
+// ExpiredRules returns rules from config.json whose expiry has passed.
+// Expired fragment rules are ignored but cannot be removed by keyphy.
+func ExpiredRules(now time.Time) []string {
+	var expired []string
+	for item, meta := range config.Metadata {
+		if _, managed := ManagedBy(item); !managed && meta.Expired(now) {
+			expired = append(expired, item)
+		}
+	}
+	return expired
+}
+
+func setMeta(item string, meta RuleMeta) {
+	if config.Metadata == nil {
+		config.Metadata = make(map[string]RuleMeta)
+	}
+	config.Metadata[item] = meta
+}
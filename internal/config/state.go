@@ -0,0 +1,155 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// State is daemon runtime state that has to survive restarts. It lives next
+// to the config but is written by the daemon as well as the CLI.
+type State struct {
+	Unlocks []TimedUnlock `json:"unlocks"`
+	// LockedUntil holds every block in place, over timed unlocks too,
+	// after a circumvention attempt.
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	// Request names the unlocks the CLI last asked the daemon to load.
+	// The daemon echoes it in Handled once it did, with the reason in
+	// Rejected if it refused them.
+	Request  string `json:"request,omitempty"`
+	Handled  string `json:"handled,omitempty"`
+	Rejected string `json:"rejected,omitempty"`
+}
+
+// TimedUnlock lifts blocks until Expires. With neither Item nor Profile set
+// it covers every blocked item.
+type TimedUnlock struct {
+	Item    string    `json:"item,omitempty"`
+	Profile string    `json:"profile,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// Usage holds the time each quota item was in use during the current
+// period. Seconds is keyed by Quota.Key.
+type Usage struct {
+	PeriodStart time.Time        `json:"period_start"`
+	Seconds     map[string]int64 `json:"seconds"`
+}
+
+// SNIStats are the SNI inspection counters since the daemon started it.
+type SNIStats struct {
+	Since     time.Time         `json:"since"`
+	Inspected uint64            `json:"inspected"`
+	Blocked   uint64            `json:"blocked"`
+	Unparsed  uint64            `json:"unparsed"`
+	Overflows uint64            `json:"overflows"`
+	Rules     map[string]uint64 `json:"rules,omitempty"`
+}
+
+var (
+	StateFile    = filepath.Join(ConfigDir, "state.json")
+	UsageFile    = filepath.Join(ConfigDir, "usage.json")
+	SNIStatsFile = filepath.Join(ConfigDir, "sni.json")
+)
+
+// Target describes what the unlock covers in a form suitable for output.
+func (u TimedUnlock) Target() string {
+	switch {
+	case u.Item != "":
+		return u.Item
+	case u.Profile != "":
+		return "profile " + u.Profile
+	default:
+		return "all blocks"
+	}
+}
+
+// SameTarget reports whether two unlocks cover the same items.
+func (u TimedUnlock) SameTarget(other TimedUnlock) bool {
+	return u.Item == other.Item && u.Profile == other.Profile
+}
+
+func LoadState() (*State, error) {
+	state := &State{Unlocks: []TimedUnlock{}}
+	data, err := os.ReadFile(StateFile)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func SaveState(state *State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	unprotectFile(StateFile)
+	if err := os.WriteFile(StateFile, data, 0600); err != nil {
+		return err
+	}
+	protectFile(StateFile)
+	return nil
+}
+
+func LoadUsage() (*Usage, error) {
+	usage := &Usage{Seconds: make(map[string]int64)}
+	data, err := os.ReadFile(UsageFile)
+	if os.IsNotExist(err) {
+		return usage, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, usage); err != nil {
+		return nil, err
+	}
+	if usage.Seconds == nil {
+		usage.Seconds = make(map[string]int64)
+	}
+	return usage, nil
+}
+
+func SaveUsage(usage *Usage) error {
+	data, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	unprotectFile(UsageFile)
+	if err := os.WriteFile(UsageFile, data, 0600); err != nil {
+		return err
+	}
+	protectFile(UsageFile)
+	return nil
+}
+
+func LoadSNIStats() (*SNIStats, error) {
+	stats := &SNIStats{}
+	data, err := os.ReadFile(SNIStatsFile)
+	if os.IsNotExist(err) {
+		return stats, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func SaveSNIStats(stats *SNIStats) error {
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(SNIStatsFile, data, 0600)
+}
@@ -0,0 +1,302 @@
+// Package fanotify receives exec permission events for whole filesystems
+// and answers them, speaking the fanotify syscalls directly.
+package fanotify
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// fanotify API, see linux/fanotify.h.
+const (
+	initCloexec      = 0x1
+	initNonblock     = 0x2
+	initClassContent = 0x4
+
+	markAdd         = 0x1
+	markMount       = 0x10
+	markIgnoredMask = 0x20
+	markFilesystem  = 0x100
+
+	openExecPerm  = 0x40000
+	queueOverflow = 0x4000
+
+	allow = 0x1
+	deny  = 0x2
+
+	metadataVersion = 3
+	metadataLen     = 24
+	noFD            = -1
+
+	atFDCWD = -0x64
+)
+
+// pseudoFilesystems cannot hold executables a user could run.
+var pseudoFilesystems = map[string]bool{
+	"proc": true, "sysfs": true, "cgroup": true, "cgroup2": true, "devpts": true,
+	"mqueue": true, "debugfs": true, "tracefs": true, "securityfs": true,
+	"pstore": true, "bpf": true, "configfs": true, "fusectl": true,
+	"hugetlbfs": true, "autofs": true, "binfmt_misc": true, "efivarfs": true,
+	"nsfs": true, "rpc_pipefs": true, "devtmpfs": true,
+}
+
+// Handler decides whether pid may execute file, which is opened read only
+// and positioned at the start. It returns true to allow the execution.
+// Every execution on a watched filesystem waits for it, so it must be
+// quick. The process answering events must never start programs itself:
+// os/exec holds a scheduler slot until the child has executed, so with a
+// single CPU or during garbage collection the answer would never come.
+type Handler func(file *os.File, pid int) bool
+
+// Guard holds a fanotify group that asks for permission before files on
+// the watched filesystems are executed. Executions are allowed again by the
+// kernel as soon as the group is closed, including when the process dies.
+type Guard struct {
+	fd      int
+	file    *os.File
+	handler Handler
+	mu      sync.Mutex
+	marked  map[string]bool
+	err     error
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// Available reports whether exec permission events can be used, which
+// needs root and a kernel with fanotify access permissions (5.0 or later).
+// It only adds an ignore mask, so no execution waits for the probe.
+func Available() error {
+	fd, err := initGroup()
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if err := mark(fd, markIgnoredMask, "/"); err != nil {
+		return fmt.Errorf("exec permission events are not supported: %v", err)
+	}
+	return nil
+}
+
+// Open creates the fanotify group. Nothing is watched until MarkMounts.
+func Open(handler Handler) (*Guard, error) {
+	fd, err := initGroup()
+	if err != nil {
+		return nil, err
+	}
+	// A non-blocking descriptor lets the runtime poller wake Read on Close
+	return &Guard{
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "fanotify"),
+		handler: handler,
+		marked:  make(map[string]bool),
+	}, nil
+}
+
+func initGroup() (int, error) {
+	flags := initCloexec | initNonblock | initClassContent
+	eventFlags := syscall.O_RDONLY | syscall.O_LARGEFILE | syscall.O_CLOEXEC
+	fd, _, errno := syscall.Syscall(syscall.SYS_FANOTIFY_INIT, uintptr(flags), uintptr(eventFlags), 0)
+	if errno != 0 {
+		return -1, fmt.Errorf("fanotify_init failed: %v", errno)
+	}
+	return int(fd), nil
+}
+
+func mark(fd int, flags uint, path string) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	dirfd := atFDCWD
+	args := [6]uintptr{uintptr(fd), uintptr(markAdd | flags), openExecPerm, uintptr(dirfd), uintptr(unsafe.Pointer(p)), 0}
+	if unsafe.Sizeof(uintptr(0)) == 4 {
+		// The 64 bit mask takes two arguments on 32 bit systems
+		args = [6]uintptr{uintptr(fd), uintptr(markAdd | flags), openExecPerm, 0, uintptr(dirfd), uintptr(unsafe.Pointer(p))}
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_FANOTIFY_MARK, args[0], args[1], args[2], args[3], args[4], args[5])
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// MarkMounts watches every filesystem that is mounted and not yet watched,
+// so copies of a binary on new mounts are caught too. It fails only if
+// nothing could be watched.
+func (g *Guard) MarkMounts() error {
+	mounts, err := readMounts()
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.err != nil {
+		return g.err
+	}
+	if g.closed {
+		return os.ErrClosed
+	}
+	var lastErr error
+	for _, m := range mounts {
+		if g.marked[m.device] {
+			continue
+		}
+		// Filesystem marks cover every mount of it; some filesystems only
+		// accept mount marks
+		if err := mark(g.fd, markFilesystem, m.path); err != nil {
+			if err := mark(g.fd, markMount, m.path); err != nil {
+				lastErr = fmt.Errorf("failed to watch %s: %v", m.path, err)
+				continue
+			}
+		}
+		g.marked[m.device] = true
+	}
+	if len(g.marked) == 0 && lastErr != nil {
+		return lastErr
+	}
+	return nil
+}
+
+type mount struct {
+	device, path string
+}
+
+// readMounts lists the mounted filesystems that can hold executables, one
+// mount per device.
+func readMounts() ([]mount, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	seen := make(map[string]bool)
+	var mounts []mount
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// ID parent major:minor root mountpoint options ... - fstype source options
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || sep+1 >= len(fields) {
+			continue
+		}
+		device, fstype := fields[2], fields[sep+1]
+		if pseudoFilesystems[fstype] || seen[device] {
+			continue
+		}
+		seen[device] = true
+		mounts = append(mounts, mount{device, unescapeMount(fields[4])})
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMount decodes the octal escapes mountinfo uses for spaces and
+// other special characters.
+func unescapeMount(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			var c byte
+			if _, err := fmt.Sscanf(path[i+1:i+4], "%03o", &c); err == nil {
+				b.WriteByte(c)
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// Start answers permission events in the background until Close.
+func (g *Guard) Start() {
+	g.wg.Add(1)
+	go g.run()
+}
+
+func (g *Guard) run() {
+	defer g.wg.Done()
+	buf := make([]byte, 4096)
+	for {
+		n, err := g.file.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) {
+				return
+			}
+			if errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) {
+				continue
+			}
+			// Unanswered events would hang every execution, so closing
+			// the group hands them back to the kernel
+			g.mu.Lock()
+			g.err = fmt.Errorf("reading fanotify events failed: %v", err)
+			g.closed = true
+			g.file.Close()
+			g.mu.Unlock()
+			return
+		}
+		for offset := 0; offset+metadataLen <= n; {
+			event := buf[offset:n]
+			length := int(binary.NativeEndian.Uint32(event[0:4]))
+			if length < metadataLen || length > len(event) || event[4] != metadataVersion {
+				break
+			}
+			mask := binary.NativeEndian.Uint64(event[8:16])
+			fd := int(int32(binary.NativeEndian.Uint32(event[16:20])))
+			pid := int(int32(binary.NativeEndian.Uint32(event[20:24])))
+			offset += length
+			if mask&queueOverflow != 0 || fd == noFD {
+				continue
+			}
+			g.answer(fd, pid, mask)
+		}
+	}
+}
+
+// answer runs the handler for one event and always replies, since the
+// execution waits until it does. A panicking handler allows it.
+func (g *Guard) answer(fd, pid int, mask uint64) {
+	file := os.NewFile(uintptr(fd), "exec")
+	verdict := uint32(allow)
+	defer func() {
+		recover()
+		response := make([]byte, 8)
+		binary.NativeEndian.PutUint32(response[0:4], uint32(fd))
+		binary.NativeEndian.PutUint32(response[4:8], verdict)
+		g.file.Write(response)
+		file.Close()
+	}()
+	if mask&openExecPerm != 0 && !g.handler(file, pid) {
+		verdict = deny
+	}
+}
+
+// Err returns the error that stopped the guard, or nil while it runs.
+func (g *Guard) Err() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
+
+// Close stops watching. Pending and future executions are allowed.
+func (g *Guard) Close() error {
+	g.mu.Lock()
+	g.closed = true
+	err := g.file.Close()
+	g.mu.Unlock()
+	g.wg.Wait()
+	return err
+}
@@ -0,0 +1,173 @@
+// Package landing serves the page shown in place of blocked websites.
+// Hosts entries point blocked names at its loopback address, so browsers
+// show why a site is unreachable instead of a connection error.
+package landing
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gajzzs/keyphy/internal/matcher"
+)
+
+const (
+	readTimeout     = 10 * time.Second
+	shutdownTimeout = 2 * time.Second
+)
+
+// Server answers every HTTP request with a page naming the rule that
+// blocks the requested host. It listens on port 80 of a loopback address;
+// nothing listens on 443 there, so HTTPS connections are reset.
+type Server struct {
+	listen string
+
+	mu       sync.Mutex
+	matcher  *matcher.Matcher
+	ends     map[string]time.Time
+	attempts map[string]int
+
+	// OnRequest is called for every request for a blocked host.
+	OnRequest func(host, rule string)
+
+	http *http.Server
+	wg   sync.WaitGroup
+}
+
+// NewServer creates a server for the loopback address listen.
+func NewServer(listen string) (*Server, error) {
+	ip := net.ParseIP(listen)
+	if ip == nil || !ip.IsLoopback() {
+		return nil, fmt.Errorf("landing page address %s is not a loopback address", listen)
+	}
+	s := &Server{
+		listen:   listen,
+		ends:     make(map[string]time.Time),
+		attempts: make(map[string]int),
+	}
+	s.matcher, _ = matcher.New(nil)
+	return s, nil
+}
+
+func (s *Server) Listen() string {
+	return s.listen
+}
+
+// SetRules replaces the blocked website rules. ends holds the time a rule's
+// block is due to end, if it is known. Invalid rules are skipped and
+// returned.
+func (s *Server) SetRules(rules []string, ends map[string]time.Time) []error {
+	m, errs := matcher.New(rules)
+	s.mu.Lock()
+	s.matcher = m
+	s.ends = ends
+	s.mu.Unlock()
+	return errs
+}
+
+func (s *Server) Start() error {
+	addr := net.JoinHostPort(s.listen, "80")
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	s.http = &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: readTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      readTimeout,
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.http.Serve(listener)
+	}()
+	return nil
+}
+
+func (s *Server) Stop() {
+	if s.http == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if s.http.Shutdown(ctx) != nil {
+		s.http.Close()
+	}
+	s.wg.Wait()
+}
+
+type pageData struct {
+	Host     string
+	Rule     string
+	Ends     string
+	Attempts int
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+
+	data := pageData{Host: host}
+	s.mu.Lock()
+	rule, blocked := s.matcher.Match(host)
+	if blocked {
+		data.Rule = rule.String()
+		s.attempts[data.Rule]++
+		data.Attempts = s.attempts[data.Rule]
+		if end, ok := s.ends[data.Rule]; ok {
+			data.Ends = end.Local().Format("Mon Jan 2 15:04 MST")
+		}
+	}
+	s.mu.Unlock()
+	if blocked && s.OnRequest != nil {
+		s.OnRequest(host, data.Rule)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	status := http.StatusForbidden
+	if !blocked {
+		// The site was unblocked but the browser still uses the old address
+		status = http.StatusServiceUnavailable
+	}
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		page.Execute(w, data)
+	}
+}
+
+var page = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Blocked by keyphy</title>
+<style>
+body { font-family: sans-serif; max-width: 36em; margin: 4em auto; padding: 0 1em; color: #222; }
+h1 { font-size: 1.5em; }
+dt { font-weight: bold; margin-top: 0.8em; }
+code { background: #eee; padding: 0 0.2em; }
+</style>
+</head>
+<body>
+{{if .Rule}}
+<h1>{{.Host}} is blocked by keyphy</h1>
+<p>Your network is working. This site is unreachable because a keyphy rule blocks it.</p>
+<dl>
+<dt>Matching rule</dt><dd><code>{{.Rule}}</code></dd>
+<dt>Block ends</dt><dd>{{if .Ends}}{{.Ends}}{{else}}When it is unlocked with the auth device{{end}}</dd>
+<dt>Attempts</dt><dd>{{.Attempts}}</dd>
+</dl>
+{{else}}
+<h1>{{.Host}} is not blocked anymore</h1>
+<p>The block has been lifted. Reload the page, or restart the browser if it keeps showing this page.</p>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,191 @@
+package matcher
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Kind is the form of a domain rule.
+type Kind int
+
+const (
+	// Plain rules ("example.com") match the domain and its www subdomain.
+	Plain Kind = iota
+	// Wildcard rules ("*.example.com") match the domain and every subdomain.
+	Wildcard
+	// Exact rules ("=example.com") match only the domain itself.
+	Exact
+	// Regex rules ("/^(.+\.)?example\.(com|net)$/") match hostnames against
+	// an expression. They cannot be expanded into hosts entries or firewall
+	// patterns, so only name-aware layers enforce them.
+	Regex
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Wildcard:
+		return "wildcard"
+	case Exact:
+		return "exact"
+	case Regex:
+		return "regex"
+	}
+	return "plain"
+}
+
+// MaxRegexLength bounds regex rules. Go's RE2 engine runs in linear time,
+// so length is the only cost that needs limiting.
+const MaxRegexLength = 256
+
+// Rule is a parsed website rule.
+type Rule struct {
+	raw    string
+	kind   Kind
+	domain string
+	re     *regexp.Regexp
+}
+
+// Parse parses a website rule in one of the supported forms.
+func Parse(raw string) (*Rule, error) {
+	value := strings.TrimSpace(raw)
+	rule := &Rule{raw: raw}
+
+	switch {
+	case len(value) >= 2 && strings.HasPrefix(value, "/") && strings.HasSuffix(value, "/"):
+		expr := value[1 : len(value)-1]
+		if len(expr) > MaxRegexLength {
+			return nil, fmt.Errorf("regex rule longer than %d characters", MaxRegexLength)
+		}
+		// Always match whole hostnames, case-insensitively
+		re, err := regexp.Compile("(?i)^(?:" + strings.TrimSuffix(strings.TrimPrefix(expr, "^"), "$") + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex rule %s: %v", raw, err)
+		}
+		// Expressions like .* would cut off name resolution entirely
+		if re.MatchString("") || re.MatchString("localhost") {
+			return nil, fmt.Errorf("regex rule %s matches too broadly", raw)
+		}
+		rule.kind = Regex
+		rule.re = re
+		return rule, nil
+	case strings.HasPrefix(value, "*."):
+		rule.kind = Wildcard
+		value = value[2:]
+	case strings.HasPrefix(value, "="):
+		rule.kind = Exact
+		value = value[1:]
+	default:
+		rule.kind = Plain
+	}
+
+	domain := strings.TrimSuffix(strings.ToLower(value), ".")
+	if !validHostname(domain) {
+		return nil, fmt.Errorf("invalid domain rule %s", raw)
+	}
+	rule.domain = domain
+	return rule, nil
+}
+
+func validHostname(name string) bool {
+	if len(name) == 0 || len(name) > 253 || !strings.Contains(name, ".") {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// String returns the rule as it was written.
+func (r *Rule) String() string {
+	return r.raw
+}
+
+func (r *Rule) Kind() Kind {
+	return r.kind
+}
+
+// Domain returns the domain of non-regex rules, lowercased and without
+// the wildcard or exact prefix.
+func (r *Rule) Domain() string {
+	return r.domain
+}
+
+// Matches reports whether host is covered by the rule.
+func (r *Rule) Matches(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+	switch r.kind {
+	case Regex:
+		return r.re.MatchString(host)
+	case Wildcard:
+		return host == r.domain || strings.HasSuffix(host, "."+r.domain)
+	case Exact:
+		return host == r.domain
+	default:
+		return host == r.domain || host == "www."+r.domain
+	}
+}
+
+// HostsNames returns the names to write into /etc/hosts for the rule.
+// Hosts files cannot express wildcards, so wildcard rules list the most
+// common subdomains and rely on the DNS layer for the rest. Regex rules
+// have no hosts entries.
+func (r *Rule) HostsNames() []string {
+	switch r.kind {
+	case Regex:
+		return nil
+	case Exact:
+		return []string{r.domain}
+	case Wildcard:
+		return []string{r.domain, "www." + r.domain, "m." + r.domain}
+	default:
+		if strings.HasPrefix(r.domain, "www.") {
+			return []string{r.domain}
+		}
+		return []string{r.domain, "www." + r.domain}
+	}
+}
+
+// Matcher checks hostnames against a set of rules.
+type Matcher struct {
+	rules []*Rule
+}
+
+// New compiles rules into a matcher. Invalid rules are skipped and
+// reported in the returned errors.
+func New(rules []string) (*Matcher, []error) {
+	m := &Matcher{}
+	var errs []error
+	for _, raw := range rules {
+		rule, err := Parse(raw)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		m.rules = append(m.rules, rule)
+	}
+	return m, errs
+}
+
+// Match returns the first rule covering host.
+func (m *Matcher) Match(host string) (*Rule, bool) {
+	for _, rule := range m.rules {
+		if rule.Matches(host) {
+			return rule, true
+		}
+	}
+	return nil, false
+}
+
+// Rules returns the compiled rules in order.
+func (m *Matcher) Rules() []*Rule {
+	return m.rules
+}
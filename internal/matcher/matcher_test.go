@@ -0,0 +1,151 @@
+package matcher
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		raw    string
+		kind   Kind
+		domain string
+	}{
+		{"example.com", Plain, "example.com"},
+		{"  Example.COM.  ", Plain, "example.com"},
+		{"*.example.com", Wildcard, "example.com"},
+		{"*.Sub.Example.com", Wildcard, "sub.example.com"},
+		{"=example.com", Exact, "example.com"},
+		{"=WWW.Example.com", Exact, "www.example.com"},
+		{`/^(.+\.)?example\.(com|net)$/`, Regex, ""},
+		{`/example\.org/`, Regex, ""},
+	}
+	for _, tt := range tests {
+		rule, err := Parse(tt.raw)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", tt.raw, err)
+			continue
+		}
+		if rule.Kind() != tt.kind || rule.Domain() != tt.domain {
+			t.Errorf("Parse(%q) = %s %q, want %s %q", tt.raw, rule.Kind(), rule.Domain(), tt.kind, tt.domain)
+		}
+		if rule.String() != tt.raw {
+			t.Errorf("Parse(%q).String() = %q", tt.raw, rule.String())
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	tests := []string{
+		"",
+		"localhost",
+		"example..com",
+		"-example.com",
+		"exa mple.com",
+		"*.",
+		"=",
+		"//",
+		"/.*/",
+		"/.+/",
+		"/localhost/",
+		"/(local|remote)host/",
+		"/[a-z/",
+		"/" + strings.Repeat("a", MaxRegexLength+1) + "/",
+	}
+	for _, raw := range tests {
+		if rule, err := Parse(raw); err == nil {
+			t.Errorf("Parse(%q) = %s rule, want error", raw, rule.Kind())
+		}
+	}
+}
+
+func TestParseRegexLengthLimit(t *testing.T) {
+	expr := strings.Repeat("a", MaxRegexLength-len(`\.com`)) + `\.com`
+	if _, err := Parse("/" + expr + "/"); err != nil {
+		t.Errorf("regex of %d characters rejected: %v", len(expr), err)
+	}
+	if _, err := Parse("/" + expr + "a/"); err == nil {
+		t.Errorf("regex of %d characters accepted", len(expr)+1)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		rule string
+		host string
+		want bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "WWW.Example.Com.", true},
+		{"example.com", "mail.example.com", false},
+		{"example.com", "notexample.com", false},
+		{"www.example.com", "www.example.com", true},
+
+		{"*.example.com", "example.com", true},
+		{"*.example.com", "a.b.EXAMPLE.com", true},
+		{"*.example.com", "badexample.com", false},
+
+		{"=example.com", "Example.com", true},
+		{"=example.com", "www.example.com", false},
+
+		{`/example\.(com|net)/`, "example.net", true},
+		{`/example\.(com|net)/`, "EXAMPLE.COM", true},
+		// Expressions are anchored to the whole hostname
+		{`/example\.(com|net)/`, "www.example.com", false},
+		{`/example\.(com|net)/`, "example.com.evil.org", false},
+		{`/^example\.com$/`, "example.com", true},
+		{`/a|b\.com/`, "xa", false},
+		{`/a|b\.com/`, "a", true},
+	}
+	for _, tt := range tests {
+		rule, err := Parse(tt.rule)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", tt.rule, err)
+		}
+		if got := rule.Matches(tt.host); got != tt.want {
+			t.Errorf("%q.Matches(%q) = %v, want %v", tt.rule, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestHostsNames(t *testing.T) {
+	tests := []struct {
+		rule string
+		want []string
+	}{
+		{"example.com", []string{"example.com", "www.example.com"}},
+		{"www.example.com", []string{"www.example.com"}},
+		{"*.example.com", []string{"example.com", "www.example.com", "m.example.com"}},
+		{"=example.com", []string{"example.com"}},
+		{`/example\.com/`, nil},
+	}
+	for _, tt := range tests {
+		rule, err := Parse(tt.rule)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", tt.rule, err)
+		}
+		if got := rule.HostsNames(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q.HostsNames() = %v, want %v", tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	m, errs := New([]string{"=a.example.com", "invalid", "*.example.com"})
+	if len(errs) != 1 {
+		t.Errorf("New reported %d errors, want 1", len(errs))
+	}
+	if len(m.Rules()) != 2 {
+		t.Fatalf("New kept %d rules, want 2", len(m.Rules()))
+	}
+	if rule, ok := m.Match("A.example.com"); !ok || rule.String() != "=a.example.com" {
+		t.Errorf("Match returned %v, %v, want the first matching rule", rule, ok)
+	}
+	if rule, ok := m.Match("b.example.com"); !ok || rule.String() != "*.example.com" {
+		t.Errorf("Match returned %v, %v, want the wildcard rule", rule, ok)
+	}
+	if _, ok := m.Match("example.org"); ok {
+		t.Error("Match matched an unrelated host")
+	}
+}
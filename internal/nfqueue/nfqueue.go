@@ -0,0 +1,286 @@
+// Package nfqueue receives packets from a netfilter queue and returns
+// verdicts for them, speaking nfnetlink directly.
+package nfqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// nfnetlink queue protocol, see linux/netfilter/nfnetlink_queue.h.
+const (
+	nfnlSubsysQueue = 3
+
+	msgPacket  = 0
+	msgVerdict = 1
+	msgConfig  = 2
+
+	attrPacketHdr  = 1
+	attrVerdictHdr = 2
+	attrPayload    = 10
+
+	attrCfgCmd      = 1
+	attrCfgParams   = 2
+	attrCfgMaxLen   = 3
+	attrCfgMask     = 4
+	attrCfgFlags    = 5
+	cmdBind         = 1
+	cmdUnbind       = 2
+	cmdPFBind       = 3
+	cmdPFUnbind     = 4
+	copyPacket      = 2
+	cfgFlagFailOpen = 1
+
+	nfDrop   = 0
+	nfAccept = 1
+
+	nlaTypeMask = 0x3fff
+)
+
+const (
+	// maxQueueLen is how many packets the kernel holds for us. With
+	// fail-open set, packets arriving while it is full are accepted.
+	maxQueueLen = 1024
+	// copyRange is enough for a ClientHello in one full sized segment.
+	copyRange      = 0xffff
+	receiveBuffer  = 4 << 20
+	receiveTimeout = time.Second
+)
+
+// Handler decides the fate of a queued packet, which starts at the IP
+// header. It returns true to accept the packet.
+type Handler func(packet []byte) bool
+
+// Queue is a bound netfilter queue.
+type Queue struct {
+	num  uint16
+	fd   int
+	seq  uint32
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	overflows atomic.Uint64
+}
+
+// Open binds queue num. Packets are copied in full and the kernel accepts
+// packets itself when the queue is full or nobody is listening.
+func Open(num uint16) (*Queue, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_NETFILTER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket: %v", err)
+	}
+	q := &Queue{num: num, fd: fd, done: make(chan struct{})}
+	if err := q.setup(); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *Queue) setup() error {
+	if err := syscall.Bind(q.fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("failed to bind netlink socket: %v", err)
+	}
+	syscall.SetsockoptInt(q.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, receiveBuffer)
+	tv := syscall.NsecToTimeval(receiveTimeout.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(q.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return err
+	}
+
+	// Kernels before 3.8 need the address families bound explicitly;
+	// newer ones ignore these commands.
+	for _, pf := range []uint16{syscall.AF_INET, syscall.AF_INET6} {
+		q.request(msgConfig, 0, attribute(attrCfgCmd, configCmd(cmdPFUnbind, pf)))
+		q.request(msgConfig, 0, attribute(attrCfgCmd, configCmd(cmdPFBind, pf)))
+	}
+
+	if err := q.request(msgConfig, q.num, attribute(attrCfgCmd, configCmd(cmdBind, 0))); err != nil {
+		return fmt.Errorf("failed to bind queue %d: %v", q.num, err)
+	}
+	params := make([]byte, 5)
+	binary.BigEndian.PutUint32(params, copyRange)
+	params[4] = copyPacket
+	if err := q.request(msgConfig, q.num, attribute(attrCfgParams, params)); err != nil {
+		return fmt.Errorf("failed to set copy mode: %v", err)
+	}
+	if err := q.request(msgConfig, q.num, attribute(attrCfgMaxLen, bigEndian32(maxQueueLen))); err != nil {
+		return fmt.Errorf("failed to set queue length: %v", err)
+	}
+	flags := append(attribute(attrCfgFlags, bigEndian32(cfgFlagFailOpen)), attribute(attrCfgMask, bigEndian32(cfgFlagFailOpen))...)
+	if err := q.request(msgConfig, q.num, flags); err != nil {
+		return fmt.Errorf("failed to enable fail-open: %v", err)
+	}
+	return nil
+}
+
+// Start passes every queued packet to handler on a new goroutine until
+// Close is called.
+func (q *Queue) Start(handler Handler) {
+	q.wg.Add(1)
+	go q.run(handler)
+}
+
+func (q *Queue) run(handler Handler) {
+	defer q.wg.Done()
+
+	buf := make([]byte, copyRange+4096)
+	for {
+		select {
+		case <-q.done:
+			return
+		default:
+		}
+		n, _, err := syscall.Recvfrom(q.fd, buf, 0)
+		if err != nil {
+			if errors.Is(err, syscall.ENOBUFS) {
+				// We fell behind and the kernel dropped messages
+				q.overflows.Add(1)
+			}
+			continue
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, msg := range msgs {
+			if msg.Header.Type != nfnlSubsysQueue<<8|msgPacket || len(msg.Data) < 4 {
+				continue
+			}
+			id, payload, ok := parsePacket(msg.Data[4:])
+			if !ok {
+				continue
+			}
+			verdict := uint32(nfAccept)
+			if !handler(payload) {
+				verdict = nfDrop
+			}
+			q.verdict(id, verdict)
+		}
+	}
+}
+
+// Overflows returns how often the receive buffer overflowed. Packets lost
+// that way are accepted by the kernel.
+func (q *Queue) Overflows() uint64 {
+	return q.overflows.Load()
+}
+
+// Close stops the handler goroutine and unbinds the queue.
+func (q *Queue) Close() {
+	close(q.done)
+	q.wg.Wait()
+	q.request(msgConfig, q.num, attribute(attrCfgCmd, configCmd(cmdUnbind, 0)))
+	syscall.Close(q.fd)
+}
+
+func (q *Queue) verdict(id, verdict uint32) error {
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint32(hdr, verdict)
+	binary.BigEndian.PutUint32(hdr[4:], id)
+	return q.send(msgVerdict, q.num, attribute(attrVerdictHdr, hdr), 0)
+}
+
+// request sends a config message and waits for the kernel's ack.
+func (q *Queue) request(msgType, resID uint16, attrs []byte) error {
+	if err := q.send(msgType, resID, attrs, syscall.NLM_F_ACK); err != nil {
+		return err
+	}
+	seq := q.seq
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(q.fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			if msg.Header.Type == nfnlSubsysQueue<<8|msgPacket && len(msg.Data) >= 4 {
+				// Packets queued before Start must not wait forever
+				if id, _, ok := parsePacket(msg.Data[4:]); ok {
+					q.verdict(id, nfAccept)
+				}
+				continue
+			}
+			if msg.Header.Type != syscall.NLMSG_ERROR || msg.Header.Seq != seq || len(msg.Data) < 4 {
+				continue
+			}
+			if errno := int32(binary.NativeEndian.Uint32(msg.Data)); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+func (q *Queue) send(msgType, resID uint16, attrs []byte, flags uint16) error {
+	q.seq++
+	msg := make([]byte, syscall.NLMSG_HDRLEN+4, syscall.NLMSG_HDRLEN+4+len(attrs))
+	msg = append(msg, attrs...)
+	binary.NativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:], nfnlSubsysQueue<<8|msgType)
+	binary.NativeEndian.PutUint16(msg[6:], syscall.NLM_F_REQUEST|flags)
+	binary.NativeEndian.PutUint32(msg[8:], q.seq)
+	// nfgenmsg: family, version and the queue number
+	msg[16] = syscall.AF_UNSPEC
+	binary.BigEndian.PutUint16(msg[18:], resID)
+	return syscall.Sendto(q.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+}
+
+// parsePacket returns the packet id and payload of a packet message.
+func parsePacket(attrs []byte) (uint32, []byte, bool) {
+	var id uint32
+	var payload []byte
+	var hasID bool
+	for len(attrs) >= 4 {
+		length := int(binary.NativeEndian.Uint16(attrs))
+		if length < 4 || length > len(attrs) {
+			break
+		}
+		data := attrs[4:length]
+		switch binary.NativeEndian.Uint16(attrs[2:]) & nlaTypeMask {
+		case attrPacketHdr:
+			if len(data) >= 4 {
+				id = binary.BigEndian.Uint32(data)
+				hasID = true
+			}
+		case attrPayload:
+			payload = data
+		}
+		aligned := (length + 3) &^ 3
+		if aligned > len(attrs) {
+			break
+		}
+		attrs = attrs[aligned:]
+	}
+	return id, payload, hasID
+}
+
+func attribute(attrType uint16, data []byte) []byte {
+	length := 4 + len(data)
+	attr := make([]byte, (length+3)&^3)
+	binary.NativeEndian.PutUint16(attr, uint16(length))
+	binary.NativeEndian.PutUint16(attr[2:], attrType)
+	copy(attr[4:], data)
+	return attr
+}
+
+func configCmd(cmd uint8, pf uint16) []byte {
+	data := make([]byte, 4)
+	data[0] = cmd
+	binary.BigEndian.PutUint16(data[2:], pf)
+	return data
+}
+
+func bigEndian32(v uint32) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, v)
+	return data
+}
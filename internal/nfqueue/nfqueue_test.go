@@ -0,0 +1,55 @@
+package nfqueue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// packetHdr is the body of an NFQA_PACKET_HDR attribute: id, hw protocol
+// and hook.
+func packetHdr(id uint32) []byte {
+	hdr := bigEndian32(id)
+	return append(hdr, 0x08, 0x00, 3)
+}
+
+func TestParsePacket(t *testing.T) {
+	ipv4 := []byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 6, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2}
+	ipv6 := append([]byte{0x60, 0, 0, 0, 0, 0, 6, 64}, make([]byte, 32)...)
+	// The kernel sets NLA_F_NET_BYTEORDER on some attributes
+	flagged := attribute(attrPacketHdr|0x4000, packetHdr(9))
+	oversized := attribute(attrPayload, ipv4)
+	binary.NativeEndian.PutUint16(oversized, uint16(len(oversized)+4))
+
+	tests := []struct {
+		name    string
+		attrs   []byte
+		id      uint32
+		payload []byte
+		ok      bool
+	}{
+		{"ipv4", cat(attribute(attrPacketHdr, packetHdr(7)), attribute(attrPayload, ipv4)), 7, ipv4, true},
+		{"ipv6", cat(attribute(attrPacketHdr, packetHdr(8)), attribute(attrPayload, ipv6)), 8, ipv6, true},
+		{"unaligned payload first", cat(attribute(attrPayload, []byte{1, 2, 3}), attribute(attrPacketHdr, packetHdr(5))), 5, []byte{1, 2, 3}, true},
+		{"other attributes", cat(attribute(3, []byte{1}), attribute(attrPacketHdr, packetHdr(6))), 6, nil, true},
+		{"flagged type", flagged, 9, nil, true},
+		{"no id", attribute(attrPayload, ipv4), 0, ipv4, false},
+		{"short header", attribute(attrPacketHdr, []byte{0, 0, 1}), 0, nil, false},
+		{"oversized attribute", cat(attribute(attrPacketHdr, packetHdr(4)), oversized), 4, nil, true},
+		{"zero length attribute", cat([]byte{0, 0, 0, 0}, attribute(attrPacketHdr, packetHdr(3))), 0, nil, false},
+		{"truncated attribute header", []byte{8, 0}, 0, nil, false},
+		{"empty", nil, 0, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, payload, ok := parsePacket(tt.attrs)
+			if id != tt.id || !bytes.Equal(payload, tt.payload) || ok != tt.ok {
+				t.Errorf("parsePacket = %d, %x, %v, want %d, %x, %v", id, payload, ok, tt.id, tt.payload, tt.ok)
+			}
+		})
+	}
+}
+
+func cat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
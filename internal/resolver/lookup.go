@@ -0,0 +1,171 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gajzzs/keyphy/internal/config"
+)
+
+// BackupFile keeps the system resolv.conf while it points at the sinkhole.
+var BackupFile = filepath.Join(config.ConfigDir, "resolv.conf.orig")
+
+// maxCNAMEDepth bounds how many aliases a lookup follows.
+const maxCNAMEDepth = 8
+
+// Address is a resolved address together with how long it may be cached.
+type Address struct {
+	IP  net.IP
+	TTL time.Duration
+}
+
+// LookupAddresses asks the system's real upstream nameservers for the A and
+// AAAA records of name, following CNAME chains. Unlike net.LookupIP it
+// bypasses /etc/hosts and the sinkhole, so it sees the addresses keyphy's
+// own blocks hide from everyone else. Each TTL is the lowest along the
+// chain that produced the address.
+func LookupAddresses(name string) ([]Address, error) {
+	v4, err4 := lookup(name, typeA)
+	v6, err6 := lookup(name, typeAAAA)
+	if err4 != nil && err6 != nil {
+		return nil, err4
+	}
+	return append(v4, v6...), nil
+}
+
+func lookup(name string, qtype uint16) ([]Address, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	var chainTTL time.Duration = -1
+	for depth := 0; depth <= maxCNAMEDepth; depth++ {
+		records, err := query(name, qtype)
+		if err != nil {
+			return nil, err
+		}
+
+		// Recursive servers usually return the whole chain at once
+		target := name
+		for seen := 0; seen <= maxCNAMEDepth; seen++ {
+			alias, ok := findRecord(records, target, typeCNAME)
+			if !ok {
+				break
+			}
+			chainTTL = minTTL(chainTTL, alias.ttl)
+			if target, _, err = readName(alias.msg, alias.data); err != nil {
+				return nil, err
+			}
+		}
+
+		var addrs []Address
+		for _, record := range records {
+			if record.name == target && record.rrType == qtype && (record.length == net.IPv4len || record.length == net.IPv6len) {
+				ip := net.IP(append([]byte(nil), record.msg[record.data:record.data+record.length]...))
+				addrs = append(addrs, Address{IP: ip, TTL: minTTL(chainTTL, record.ttl)})
+			}
+		}
+		if len(addrs) > 0 || target == name {
+			return addrs, nil
+		}
+		// Only the alias came back; ask for its target
+		name = target
+	}
+	return nil, fmt.Errorf("CNAME chain for %s is too long", name)
+}
+
+func minTTL(a, b time.Duration) time.Duration {
+	if a < 0 || b < a {
+		return b
+	}
+	return a
+}
+
+func query(name string, qtype uint16) ([]record, error) {
+	msg := newQuery(name, qtype)
+	var lastErr error
+	for _, upstream := range SystemUpstreams(BackupFile) {
+		resp, err := exchange("udp", net.JoinHostPort(upstream, "53"), msg)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return parseAnswers(resp)
+	}
+	return nil, lastErr
+}
+
+func newQuery(name string, qtype uint16) []byte {
+	msg := make([]byte, headerLen, headerLen+len(name)+6)
+	binary.BigEndian.PutUint16(msg[0:2], uint16(rand.Intn(1<<16)))
+	// Recursion desired
+	binary.BigEndian.PutUint16(msg[2:4], 0x0100)
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(msg[len(msg)-4:], qtype)
+	binary.BigEndian.PutUint16(msg[len(msg)-2:], classIN)
+	return msg
+}
+
+// record is a resource record in the answer section of msg.
+type record struct {
+	msg    []byte
+	name   string
+	rrType uint16
+	ttl    time.Duration
+	data   int
+	length int
+}
+
+func findRecord(records []record, name string, rrType uint16) (record, bool) {
+	for _, r := range records {
+		if r.name == name && r.rrType == rrType {
+			return r, true
+		}
+	}
+	return record{}, false
+}
+
+// parseAnswers returns the answer records of a response.
+func parseAnswers(resp []byte) ([]record, error) {
+	if len(resp) < headerLen {
+		return nil, errMalformed
+	}
+	if rcode := binary.BigEndian.Uint16(resp[2:4]) & 0x000F; rcode != 0 {
+		return nil, fmt.Errorf("DNS lookup failed with rcode %d", rcode)
+	}
+	answers := int(binary.BigEndian.Uint16(resp[6:8]))
+	_, off, err := readName(resp, headerLen)
+	if err != nil {
+		return nil, err
+	}
+	off += 4
+
+	var records []record
+	for i := 0; i < answers; i++ {
+		name, end, err := readName(resp, off)
+		if err != nil || end+10 > len(resp) {
+			return nil, errMalformed
+		}
+		r := record{
+			msg:    resp,
+			name:   name,
+			rrType: binary.BigEndian.Uint16(resp[end : end+2]),
+			ttl:    time.Duration(binary.BigEndian.Uint32(resp[end+4:end+8])) * time.Second,
+			data:   end + 10,
+			length: int(binary.BigEndian.Uint16(resp[end+8 : end+10])),
+		}
+		if r.data+r.length > len(resp) {
+			return nil, errMalformed
+		}
+		records = append(records, r)
+		off = r.data + r.length
+	}
+	return records, nil
+}
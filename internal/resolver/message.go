@@ -0,0 +1,140 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+const (
+	headerLen = 12
+
+	typeA     = 1
+	typeCNAME = 5
+	typeAAAA  = 28
+	classIN   = 1
+
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+
+	// sinkholeTTL keeps blocked answers short lived so unlocking takes
+	// effect quickly in client caches.
+	sinkholeTTL = 60
+)
+
+var errMalformed = errors.New("malformed DNS message")
+
+// question is the first entry of a query's question section.
+type question struct {
+	name  string
+	qtype uint16
+	class uint16
+	// end is the offset just past the question in the message.
+	end int
+}
+
+// parseQuery reads the question of a standard query. Names are returned in
+// lower case without the trailing dot.
+func parseQuery(msg []byte) (*question, error) {
+	if len(msg) < headerLen {
+		return nil, errMalformed
+	}
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	if flags&0x8000 != 0 || binary.BigEndian.Uint16(msg[4:6]) != 1 {
+		return nil, errMalformed
+	}
+	name, end, err := readName(msg, headerLen)
+	if err != nil {
+		return nil, err
+	}
+	if end+4 > len(msg) {
+		return nil, errMalformed
+	}
+	return &question{
+		name:  name,
+		qtype: binary.BigEndian.Uint16(msg[end : end+2]),
+		class: binary.BigEndian.Uint16(msg[end+2 : end+4]),
+		end:   end + 4,
+	}, nil
+}
+
+// readName decodes a possibly compressed name starting at off and returns
+// it together with the offset after the name at its original position.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errMalformed
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")), end, nil
+		case length&0xC0 == 0xC0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:off+2]) & 0x3FFF)
+			jumps++
+		case length&0xC0 != 0:
+			return "", 0, errMalformed
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
+
+// errorResponse answers query with rcode and no records.
+func errorResponse(query []byte, q *question, rcode uint16) []byte {
+	resp := make([]byte, q.end)
+	copy(resp, query[:q.end])
+	// QR and RA set; opcode and RD are kept from the query
+	flags := binary.BigEndian.Uint16(query[2:4])&0x7900 | 0x8080 | rcode
+	binary.BigEndian.PutUint16(resp[2:4], flags)
+	binary.BigEndian.PutUint16(resp[4:6], 1)
+	// Drop the query's EDNS and other trailing records
+	for i := 6; i < headerLen; i++ {
+		resp[i] = 0
+	}
+	return resp
+}
+
+// sinkholeResponse answers query for a blocked name. With zero set, A and
+// AAAA queries get the unspecified address and other types an empty
+// answer; otherwise the name is reported as nonexistent.
+func sinkholeResponse(query []byte, q *question, zero bool) []byte {
+	if !zero {
+		return errorResponse(query, q, rcodeNXDomain)
+	}
+	var answer []byte
+	switch {
+	case q.class == classIN && q.qtype == typeA:
+		answer = make([]byte, 4)
+	case q.class == classIN && q.qtype == typeAAAA:
+		answer = make([]byte, 16)
+	}
+	resp := errorResponse(query, q, 0)
+	if answer == nil {
+		return resp
+	}
+	binary.BigEndian.PutUint16(resp[6:8], 1)
+	rr := make([]byte, 12, 12+len(answer))
+	// Pointer to the question name
+	binary.BigEndian.PutUint16(rr[0:2], 0xC000|headerLen)
+	binary.BigEndian.PutUint16(rr[2:4], q.qtype)
+	binary.BigEndian.PutUint16(rr[4:6], q.class)
+	binary.BigEndian.PutUint32(rr[6:10], sinkholeTTL)
+	binary.BigEndian.PutUint16(rr[10:12], uint16(len(answer)))
+	return append(append(resp, rr...), answer...)
+}
@@ -0,0 +1,196 @@
+package resolver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// ednsRecord is an OPT pseudo record as clients append to queries.
+var ednsRecord = []byte{0, 0, 41, 0x10, 0, 0, 0, 0, 0, 0, 0}
+
+func testQuery(name string, qtype uint16) []byte {
+	msg := newQuery(name, qtype)
+	binary.BigEndian.PutUint16(msg[0:2], 0x1234)
+	return msg
+}
+
+// withEDNS adds an OPT record to the additional section of query.
+func withEDNS(query []byte) []byte {
+	msg := append(append([]byte{}, query...), ednsRecord...)
+	binary.BigEndian.PutUint16(msg[10:12], 1)
+	return msg
+}
+
+func TestParseQuery(t *testing.T) {
+	response := testQuery("example.com", typeA)
+	response[2] |= 0x80
+	twoQuestions := testQuery("example.com", typeA)
+	binary.BigEndian.PutUint16(twoQuestions[4:6], 2)
+	// The question name is a pointer to itself
+	loop := append(testQuery("example.com", typeA)[:headerLen], 0xC0, headerLen, 0, 1, 0, 1)
+
+	tests := []struct {
+		name  string
+		msg   []byte
+		want  string
+		qtype uint16
+		err   bool
+	}{
+		{"a", testQuery("example.com", typeA), "example.com", typeA, false},
+		{"aaaa with edns", withEDNS(testQuery("www.Example.COM.", typeAAAA)), "www.example.com", typeAAAA, false},
+		{"response", response, "", 0, true},
+		{"two questions", twoQuestions, "", 0, true},
+		{"short header", testQuery("example.com", typeA)[:headerLen-1], "", 0, true},
+		{"truncated name", testQuery("example.com", typeA)[:headerLen+5], "", 0, true},
+		{"truncated type", testQuery("example.com", typeA)[:headerLen+13+2], "", 0, true},
+		{"pointer loop", loop, "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := parseQuery(tt.msg)
+			if tt.err {
+				if err == nil {
+					t.Errorf("parseQuery = %+v, want an error", q)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if q.name != tt.want || q.qtype != tt.qtype || q.class != classIN {
+				t.Errorf("parseQuery = %+v, want %s type %d", q, tt.want, tt.qtype)
+			}
+			if q.end != len(testQuery(tt.want, tt.qtype)) {
+				t.Errorf("question ends at %d, want %d", q.end, len(testQuery(tt.want, tt.qtype)))
+			}
+		})
+	}
+}
+
+func TestReadName(t *testing.T) {
+	// example.com at 0, www.<pointer to 0> at 13, a pointer to 13 at 19
+	msg := []byte{7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0}
+	msg = append(msg, 3, 'w', 'w', 'w', 0xC0, 0)
+	msg = append(msg, 0xC0, 13)
+
+	tests := []struct {
+		name string
+		msg  []byte
+		off  int
+		want string
+		end  int
+		err  bool
+	}{
+		{"plain", msg, 0, "example.com", 13, false},
+		{"label then pointer", msg, 13, "www.example.com", 19, false},
+		{"pointer to pointer", msg, 19, "www.example.com", 21, false},
+		{"pointer to itself", []byte{0xC0, 0}, 0, "", 0, true},
+		{"pointer cycle", []byte{0xC0, 2, 0xC0, 0}, 0, "", 0, true},
+		{"label cycle", []byte{1, 'a', 0xC0, 0}, 0, "", 0, true},
+		{"pointer past end", []byte{0xC0, 40}, 0, "", 0, true},
+		{"truncated pointer", []byte{0xC0}, 0, "", 0, true},
+		{"truncated label", []byte{5, 'a', 'b'}, 0, "", 0, true},
+		{"missing terminator", []byte{1, 'a'}, 0, "", 0, true},
+		{"reserved label type", []byte{0x40, 0}, 0, "", 0, true},
+		{"offset past end", msg, len(msg), "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, end, err := readName(tt.msg, tt.off)
+			if (err != nil) != tt.err || name != tt.want || end != tt.end {
+				t.Errorf("readName = %q, %d, %v, want %q, %d (error %v)", name, end, err, tt.want, tt.end, tt.err)
+			}
+		})
+	}
+}
+
+func TestSinkholeResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  []byte
+		zero   bool
+		rcode  uint16
+		answer []byte
+	}{
+		{"a", testQuery("example.com", typeA), true, 0, net.IPv4zero.To4()},
+		{"aaaa", testQuery("example.com", typeAAAA), true, 0, net.IPv6zero},
+		{"a with edns", withEDNS(testQuery("example.com", typeA)), true, 0, net.IPv4zero.To4()},
+		{"txt", testQuery("example.com", 16), true, 0, nil},
+		{"nxdomain", testQuery("example.com", typeA), false, rcodeNXDomain, nil},
+		{"nxdomain with edns", withEDNS(testQuery("example.com", typeAAAA)), false, rcodeNXDomain, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := parseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp := sinkholeResponse(tt.query, q, tt.zero)
+
+			if !bytes.Equal(resp[0:2], tt.query[0:2]) {
+				t.Error("response does not carry the query id")
+			}
+			// QR, RD from the query and RA
+			if flags := binary.BigEndian.Uint16(resp[2:4]); flags != 0x8180|tt.rcode {
+				t.Errorf("flags = %#04x, want %#04x", flags, 0x8180|tt.rcode)
+			}
+			if !bytes.Equal(resp[headerLen:q.end], tt.query[headerLen:q.end]) {
+				t.Error("question was not echoed")
+			}
+			if n := binary.BigEndian.Uint16(resp[10:12]); n != 0 {
+				t.Errorf("response has %d additional records", n)
+			}
+
+			if tt.rcode != 0 {
+				if _, err := parseAnswers(resp); err == nil {
+					t.Error("parseAnswers accepted an NXDOMAIN response")
+				}
+				return
+			}
+			records, err := parseAnswers(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.answer == nil {
+				if len(records) != 0 || len(resp) != q.end {
+					t.Errorf("unexpected answers %v", records)
+				}
+				return
+			}
+			if len(records) != 1 {
+				t.Fatalf("got %d answers, want 1", len(records))
+			}
+			r := records[0]
+			data := r.msg[r.data : r.data+r.length]
+			if r.name != "example.com" || r.rrType != q.qtype || r.ttl != sinkholeTTL*time.Second || !bytes.Equal(data, tt.answer) {
+				t.Errorf("answer = %s type %d ttl %s data %v", r.name, r.rrType, r.ttl, data)
+			}
+		})
+	}
+}
+
+func TestParseAnswers(t *testing.T) {
+	q, err := parseQuery(testQuery("example.com", typeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := sinkholeResponse(testQuery("example.com", typeA), q, true)
+
+	if _, err := parseAnswers(resp); err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(resp); n++ {
+		if _, err := parseAnswers(resp[:n]); err == nil {
+			t.Errorf("parseAnswers accepted %d of %d bytes", n, len(resp))
+		}
+	}
+	// An answer count beyond the records present
+	extra := append([]byte{}, resp...)
+	binary.BigEndian.PutUint16(extra[6:8], 2)
+	if _, err := parseAnswers(extra); err == nil {
+		t.Error("parseAnswers accepted a missing answer")
+	}
+}
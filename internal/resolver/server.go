@@ -0,0 +1,232 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gajzzs/keyphy/internal/matcher"
+)
+
+const (
+	maxMessageSize  = 65535
+	upstreamTimeout = 3 * time.Second
+	clientTimeout   = 10 * time.Second
+)
+
+// Server is a small DNS forwarder that sinkholes blocked names. It serves
+// UDP and TCP on port 53 of a loopback address.
+type Server struct {
+	listen    string
+	upstreams []string
+	zero      bool
+
+	mu      sync.RWMutex
+	matcher *matcher.Matcher
+
+	// OnBlock is called for every query answered from the sinkhole.
+	OnBlock func(name, rule string)
+
+	udp *net.UDPConn
+	tcp *net.TCPListener
+	wg  sync.WaitGroup
+}
+
+// NewServer creates a server listening on the loopback address listen that
+// forwards unblocked queries to upstreams in order. Upstreams without a port
+// use 53. With zero set, blocked names resolve to 0.0.0.0 and :: instead of
+// NXDOMAIN.
+func NewServer(listen string, upstreams []string, zero bool) (*Server, error) {
+	ip := net.ParseIP(listen)
+	if ip == nil || !ip.IsLoopback() {
+		return nil, fmt.Errorf("resolver address %s is not a loopback address", listen)
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream DNS servers configured")
+	}
+	s := &Server{listen: listen, zero: zero}
+	for _, upstream := range upstreams {
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			upstream = net.JoinHostPort(upstream, "53")
+		}
+		s.upstreams = append(s.upstreams, upstream)
+	}
+	s.matcher, _ = matcher.New(nil)
+	return s, nil
+}
+
+func (s *Server) Listen() string {
+	return s.listen
+}
+
+// SetRules replaces the set of blocked website rules. Invalid rules are
+// skipped and returned.
+func (s *Server) SetRules(rules []string) []error {
+	m, errs := matcher.New(rules)
+	s.mu.Lock()
+	s.matcher = m
+	s.mu.Unlock()
+	return errs
+}
+
+func (s *Server) Start() error {
+	addr := net.JoinHostPort(s.listen, "53")
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	s.udp, err = net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on udp %s: %v", addr, err)
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		s.udp.Close()
+		return err
+	}
+	s.tcp, err = net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		s.udp.Close()
+		return fmt.Errorf("failed to listen on tcp %s: %v", addr, err)
+	}
+
+	s.wg.Add(2)
+	go s.serveUDP()
+	go s.serveTCP()
+	return nil
+}
+
+func (s *Server) Stop() {
+	if s.udp != nil {
+		s.udp.Close()
+	}
+	if s.tcp != nil {
+		s.tcp.Close()
+	}
+	s.wg.Wait()
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, client, err := s.udp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := s.handle(query, "udp"); resp != nil {
+				s.udp.WriteToUDP(resp, client)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn answers length-prefixed queries until the client goes idle.
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(clientTimeout))
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		resp := s.handle(query, "tcp")
+		if resp == nil || writeTCPMessage(conn, resp) != nil {
+			return
+		}
+	}
+}
+
+// handle answers a single query, either from the sinkhole or by forwarding
+// it. Malformed queries are dropped by returning nil.
+func (s *Server) handle(query []byte, network string) []byte {
+	q, err := parseQuery(query)
+	if err != nil {
+		return nil
+	}
+
+	s.mu.RLock()
+	rule, blocked := s.matcher.Match(q.name)
+	s.mu.RUnlock()
+	if blocked {
+		if s.OnBlock != nil {
+			s.OnBlock(q.name, rule.String())
+		}
+		return sinkholeResponse(query, q, s.zero)
+	}
+
+	for _, upstream := range s.upstreams {
+		resp, err := exchange(network, upstream, query)
+		if err == nil {
+			return resp
+		}
+		log.Printf("DNS upstream %s failed: %v", upstream, err)
+	}
+	return errorResponse(query, q, rcodeServFail)
+}
+
+func exchange(network, upstream string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, upstream, upstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray datagrams that do not answer this query
+		if n >= headerLen && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	out := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(out, uint16(len(msg)))
+	_, err := w.Write(append(out, msg...))
+	return err
+}
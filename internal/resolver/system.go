@@ -0,0 +1,123 @@
+package resolver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	resolvConf        = "/etc/resolv.conf"
+	resolvedUpstreams = "/run/systemd/resolve/resolv.conf"
+	resolvedDropIn    = "/etc/systemd/resolved.conf.d/keyphy.conf"
+)
+
+// fallbackUpstreams are used when no usable system nameserver is found.
+var fallbackUpstreams = []string{"9.9.9.9", "149.112.112.112"}
+
+// usesResolved reports whether /etc/resolv.conf is managed by
+// systemd-resolved, in which case resolved is redirected instead.
+func usesResolved() bool {
+	target, err := filepath.EvalSymlinks(resolvConf)
+	return err == nil && strings.HasPrefix(target, "/run/systemd/resolve/")
+}
+
+// SystemUpstreams returns the nameservers the system used before keyphy
+// redirected it. Loopback stubs are skipped since they would end up
+// forwarding back to the sinkhole.
+func SystemUpstreams(backup string) []string {
+	sources := []string{backup, resolvConf}
+	if usesResolved() {
+		sources = []string{resolvedUpstreams}
+	}
+	for _, source := range sources {
+		if servers := readNameservers(source); len(servers) > 0 {
+			return servers
+		}
+	}
+	return fallbackUpstreams
+}
+
+func readNameservers(path string) []string {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if ip := net.ParseIP(fields[1]); ip != nil && !ip.IsLoopback() {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// Redirect points the system resolver at listen. The original resolv.conf
+// is saved to backup so Restore can put it back.
+func Redirect(listen, backup string) error {
+	if usesResolved() {
+		content := fmt.Sprintf("# Managed by keyphy\n[Resolve]\nDNS=%s\nDomains=~.\n", listen)
+		if current, err := os.ReadFile(resolvedDropIn); err == nil && string(current) == content {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(resolvedDropIn), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(resolvedDropIn, []byte(content), 0644); err != nil {
+			return err
+		}
+		return exec.Command("systemctl", "restart", "systemd-resolved").Run()
+	}
+
+	content := fmt.Sprintf("# Managed by keyphy\nnameserver %s\noptions edns0\n", listen)
+	current, err := os.ReadFile(resolvConf)
+	if err == nil && string(current) == content {
+		return nil
+	}
+	if _, err := os.Stat(backup); os.IsNotExist(err) {
+		if err := os.WriteFile(backup, current, 0644); err != nil {
+			return fmt.Errorf("failed to back up resolv.conf: %v", err)
+		}
+	}
+	exec.Command("chattr", "-i", resolvConf).Run()
+	// Replace symlinks from other managers with a plain file
+	os.Remove(resolvConf)
+	if err := os.WriteFile(resolvConf, []byte(content), 0644); err != nil {
+		return err
+	}
+	exec.Command("chattr", "+i", resolvConf).Run()
+	return nil
+}
+
+// Restore undoes Redirect. It is safe to call when nothing was redirected.
+func Restore(backup string) error {
+	if _, err := os.Stat(resolvedDropIn); err == nil {
+		if err := os.Remove(resolvedDropIn); err != nil {
+			return err
+		}
+		exec.Command("systemctl", "restart", "systemd-resolved").Run()
+	}
+
+	original, err := os.ReadFile(backup)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	exec.Command("chattr", "-i", resolvConf).Run()
+	if err := os.WriteFile(resolvConf, original, 0644); err != nil {
+		return err
+	}
+	return os.Remove(backup)
+}
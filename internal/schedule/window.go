@@ -0,0 +1,174 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Window is a weekly recurring time range, e.g. weekdays 09:00-17:00.
+// A window whose end is before its start runs past midnight.
+type Window struct {
+	days     [7]bool
+	start    int // minutes after midnight
+	end      int // minutes after midnight, 1440 means end of day
+	location *time.Location
+}
+
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Parse builds a window from day specs ("mon-fri", "sat,sun", "weekdays",
+// "weekends", "daily"), HH:MM start and end times and an optional IANA
+// timezone. Empty days means every day.
+func Parse(days []string, start, end, timezone string) (*Window, error) {
+	w := &Window{location: time.Local}
+
+	if timezone != "" {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone %s: %v", timezone, err)
+		}
+		w.location = loc
+	}
+
+	var err error
+	if w.start, err = parseClock(start); err != nil {
+		return nil, err
+	}
+	if w.end, err = parseClock(end); err != nil {
+		return nil, err
+	}
+	if w.start == 1440 {
+		return nil, fmt.Errorf("start time cannot be 24:00")
+	}
+
+	if len(days) == 0 {
+		days = []string{"daily"}
+	}
+	for _, spec := range days {
+		for _, part := range strings.Split(spec, ",") {
+			if err := w.addDays(strings.ToLower(strings.TrimSpace(part))); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return w, nil
+}
+
+func (w *Window) addDays(part string) error {
+	switch part {
+	case "", "*", "daily", "all":
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return nil
+	case "weekdays":
+		return w.addDays("mon-fri")
+	case "weekends":
+		w.days[time.Saturday] = true
+		w.days[time.Sunday] = true
+		return nil
+	}
+
+	if from, to, ok := strings.Cut(part, "-"); ok {
+		first, ok1 := dayNames[from]
+		last, ok2 := dayNames[to]
+		if !ok1 || !ok2 {
+			return fmt.Errorf("invalid day range %s", part)
+		}
+		// Ranges may wrap around the week, e.g. fri-mon
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+		return nil
+	}
+
+	day, ok := dayNames[part]
+	if !ok {
+		return fmt.Errorf("invalid day %s", part)
+	}
+	w.days[day] = true
+	return nil
+}
+
+func parseClock(value string) (int, error) {
+	hours, minutes, ok := strings.Cut(value, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid time %s, expected HH:MM", value)
+	}
+	h, err1 := strconv.Atoi(hours)
+	m, err2 := strconv.Atoi(minutes)
+	if err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %s, expected HH:MM", value)
+	}
+	return h*60 + m, nil
+}
+
+// ActiveAt reports whether t falls inside the window.
+func (w *Window) ActiveAt(t time.Time) bool {
+	local := t.In(w.location)
+	minute := local.Hour()*60 + local.Minute()
+	today := local.Weekday()
+	yesterday := (today + 6) % 7
+
+	// Equal start and end means the whole day
+	if w.start == w.end {
+		return w.days[today]
+	}
+	if w.start < w.end {
+		return w.days[today] && minute >= w.start && minute < w.end
+	}
+	// Overnight window: the evening part belongs to today, the morning part to yesterday
+	return (w.days[today] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+// NextTransition returns the next time after t at which the window opens or
+// closes. It returns false if the window never changes state.
+func (w *Window) NextTransition(t time.Time) (time.Time, bool) {
+	current := w.ActiveAt(t)
+	next := t.Truncate(time.Minute)
+	// Schedules repeat weekly, so looking a little over a week ahead is enough
+	for i := 0; i < 8*24*60; i++ {
+		next = next.Add(time.Minute)
+		if w.ActiveAt(next) != current {
+			return next, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// String formats the window as it would be written on the command line.
+func (w *Window) String() string {
+	var days []string
+	for _, name := range []string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"} {
+		if w.days[dayNames[name]] {
+			days = append(days, name)
+		}
+	}
+	dayList := strings.Join(days, ",")
+	switch dayList {
+	case "mon,tue,wed,thu,fri,sat,sun":
+		dayList = "daily"
+	case "mon,tue,wed,thu,fri":
+		dayList = "weekdays"
+	case "sat,sun":
+		dayList = "weekends"
+	}
+	formatted := fmt.Sprintf("%s %02d:%02d-%02d:%02d", dayList, w.start/60, w.start%60, w.end/60, w.end%60)
+	if w.location != time.Local {
+		formatted += " " + w.location.String()
+	}
+	return formatted
+}
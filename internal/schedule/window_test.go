@@ -0,0 +1,119 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+// monday is the first day of a week all test times are taken from.
+var monday = time.Date(2026, time.January, 5, 0, 0, 0, 0, time.UTC)
+
+// at returns the time clock ("HH:MM") on the given day of the test week,
+// where 0 is Monday. Days past 6 run into the next week.
+func at(day int, clock string) time.Time {
+	minutes, err := parseClock(clock)
+	if err != nil {
+		panic(err)
+	}
+	return monday.AddDate(0, 0, day).Add(time.Duration(minutes) * time.Minute)
+}
+
+func mustParse(t *testing.T, days, start, end string) *Window {
+	t.Helper()
+	w, err := Parse([]string{days}, start, end, "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestActiveAt(t *testing.T) {
+	tests := []struct {
+		name       string
+		days       string
+		start, end string
+		at         time.Time
+		want       bool
+	}{
+		{"opening minute", "weekdays", "09:00", "17:00", at(0, "09:00"), true},
+		{"before opening", "weekdays", "09:00", "17:00", at(0, "08:59"), false},
+		{"closing minute", "weekdays", "09:00", "17:00", at(0, "17:00"), false},
+		{"other day", "weekdays", "09:00", "17:00", at(5, "10:00"), false},
+		{"seconds before closing", "weekdays", "09:00", "17:00", at(4, "16:59").Add(59 * time.Second), true},
+
+		{"overnight evening", "mon", "22:00", "06:00", at(0, "23:00"), true},
+		{"overnight morning after", "mon", "22:00", "06:00", at(1, "05:59"), true},
+		{"overnight closing", "mon", "22:00", "06:00", at(1, "06:00"), false},
+		{"overnight evening of other day", "mon", "22:00", "06:00", at(1, "23:00"), false},
+		{"overnight morning of first day", "mon", "22:00", "06:00", at(0, "05:00"), false},
+		{"overnight into next week", "sun", "22:00", "06:00", at(7, "01:00"), true},
+
+		{"wrapping range friday", "fri-mon", "10:00", "12:00", at(4, "11:00"), true},
+		{"wrapping range sunday", "fri-mon", "10:00", "12:00", at(6, "11:00"), true},
+		{"wrapping range monday", "fri-mon", "10:00", "12:00", at(0, "11:00"), true},
+		{"wrapping range tuesday", "fri-mon", "10:00", "12:00", at(1, "11:00"), false},
+		{"wrapping range thursday", "fri-mon", "10:00", "12:00", at(3, "11:00"), false},
+
+		{"end of day last minute", "mon", "20:00", "24:00", at(0, "23:59"), true},
+		{"end of day midnight", "mon", "20:00", "24:00", at(1, "00:00"), false},
+
+		{"equal start and end at midnight", "sat", "08:00", "08:00", at(5, "00:00"), true},
+		{"equal start and end late", "sat", "08:00", "08:00", at(5, "23:59"), true},
+		{"equal start and end next day", "sat", "08:00", "08:00", at(6, "00:00"), false},
+		{"equal start and end day before", "sat", "08:00", "08:00", at(4, "23:59"), false},
+
+		// 11:00 at UTC+2 is 09:00 in the window's timezone
+		{"other timezone inside", "mon", "09:00", "17:00", at(0, "09:00").In(time.FixedZone("UTC+2", 2*3600)), true},
+		{"other timezone before", "mon", "09:00", "17:00", at(0, "08:59").In(time.FixedZone("UTC+2", 2*3600)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := mustParse(t, tt.days, tt.start, tt.end)
+			if got := w.ActiveAt(tt.at); got != tt.want {
+				t.Errorf("%s ActiveAt(%s) = %v, want %v", w, tt.at.Format("Mon 15:04"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextTransition(t *testing.T) {
+	tests := []struct {
+		name       string
+		days       string
+		start, end string
+		from       time.Time
+		want       time.Time
+	}{
+		{"closing", "weekdays", "09:00", "17:00", at(0, "10:30"), at(0, "17:00")},
+		{"over the weekend", "weekdays", "09:00", "17:00", at(4, "17:00"), at(7, "09:00")},
+		{"within the minute before", "weekdays", "09:00", "17:00", at(0, "08:59").Add(30 * time.Second), at(0, "09:00")},
+		{"at the opening", "weekdays", "09:00", "17:00", at(0, "09:00"), at(0, "17:00")},
+
+		{"overnight opening", "mon", "22:00", "06:00", at(0, "12:00"), at(0, "22:00")},
+		{"overnight closing", "mon", "22:00", "06:00", at(0, "23:00"), at(1, "06:00")},
+		{"overnight next week", "mon", "22:00", "06:00", at(1, "06:00"), at(7, "22:00")},
+
+		{"wrapping range", "fri-mon", "10:00", "12:00", at(0, "12:00"), at(4, "10:00")},
+		{"end of day", "mon", "20:00", "24:00", at(0, "21:00"), at(1, "00:00")},
+		{"equal start and end opening", "sat", "08:00", "08:00", at(2, "12:00"), at(5, "00:00")},
+		{"equal start and end closing", "sat", "08:00", "08:00", at(5, "12:00"), at(6, "00:00")},
+		{"consecutive whole days", "sat,sun", "00:00", "24:00", at(5, "12:00"), at(7, "00:00")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := mustParse(t, tt.days, tt.start, tt.end)
+			got, ok := w.NextTransition(tt.from)
+			if !ok || !got.Equal(tt.want) {
+				t.Errorf("%s NextTransition(%s) = %s, %v, want %s", w, tt.from.Format("Mon 15:04:05"), got.Format("Mon 01-02 15:04"), ok, tt.want.Format("Mon 01-02 15:04"))
+			}
+		})
+	}
+
+	// Windows covering the whole week never change state
+	for _, bounds := range [][2]string{{"00:00", "00:00"}, {"00:00", "24:00"}, {"12:00", "12:00"}} {
+		w := mustParse(t, "daily", bounds[0], bounds[1])
+		if next, ok := w.NextTransition(at(2, "12:00")); ok {
+			t.Errorf("%s NextTransition = %s, want none", w, next)
+		}
+	}
+}
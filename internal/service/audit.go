@@ -0,0 +1,45 @@
+package service
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// AuditLogFile receives one JSON object per line for security relevant
+// events, in addition to the regular daemon log.
+const AuditLogFile = "/var/log/keyphy/audit.log"
+
+type AuditEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Item   string    `json:"item,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+func auditEvent(event, item, detail string) {
+	log.Printf("AUDIT %s %s: %s", event, item, detail)
+
+	data, err := json.Marshal(AuditEvent{
+		Time:   time.Now(),
+		Event:  event,
+		Item:   item,
+		Detail: detail,
+	})
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(AuditLogFile), 0700); err != nil {
+		log.Printf("Failed to create audit log directory: %v", err)
+		return
+	}
+	file, err := os.OpenFile(AuditLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Failed to open audit log: %v", err)
+		return
+	}
+	defer file.Close()
+	file.Write(append(data, '\n'))
+}
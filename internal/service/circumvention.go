@@ -0,0 +1,149 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/gajzzs/keyphy/internal/circumvent"
+	"github.com/gajzzs/keyphy/internal/config"
+)
+
+const circumventionInterval = 10 * time.Second
+
+func (d *Daemon) monitorCircumvention() {
+	ticker := time.NewTicker(circumventionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			d.checkCircumvention(time.Now())
+		}
+	}
+}
+
+// checkCircumvention looks for VPNs, proxies and Tor while anything is
+// blocked and applies the configured policy to new findings. The scan runs
+// commands and reads /proc, so d.mu is only held around it.
+func (d *Daemon) checkCircumvention(now time.Time) {
+	d.mu.Lock()
+	cfg := config.GetConfig()
+	if cfg.Circumvention.Policy == config.CircumventionOff || len(d.enforced) == 0 {
+		// Whatever is still running is reported when the next lock starts
+		d.detector = circumvent.NewDetector()
+		d.clearCircumventionBlocks()
+		d.mu.Unlock()
+		return
+	}
+	detector := d.detector
+	d.mu.Unlock()
+
+	// Only this goroutine scans, so the detector is not shared
+	findings := detector.Scan()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cfg = config.GetConfig()
+	if detector != d.detector || cfg.Circumvention.Policy == config.CircumventionOff || len(d.enforced) == 0 {
+		// The lock ended or the backend changed during the scan; the
+		// next scan reports whatever is still there
+		return
+	}
+	for _, finding := range findings {
+		detail := finding.Detail
+		if finding.PID > 0 {
+			detail = fmt.Sprintf("%s, PID %d", detail, finding.PID)
+		}
+		auditEvent(finding.Kind, finding.Name, detail)
+	}
+	if len(findings) == 0 {
+		return
+	}
+
+	switch cfg.Circumvention.Policy {
+	case config.CircumventionBlock:
+		d.blockCircumvention(findings)
+	case config.CircumventionExtend:
+		d.extendLock(now, cfg.Circumvention.ExtendBy)
+	}
+}
+
+// blockCircumvention stops what was found: VPN interfaces and Tor ports are
+// blocked in the firewall and proxy processes are terminated. Changed proxy
+// settings can only be reported.
+func (d *Daemon) blockCircumvention(findings []circumvent.Finding) {
+	for _, finding := range findings {
+		switch finding.Kind {
+		case circumvent.KindVPN:
+			d.blockedIfaces[finding.Interface] = true
+		case circumvent.KindTor:
+			d.torBlocked = true
+		case circumvent.KindProxyProcess:
+			if err := d.appBlocker.BlockProcessLaunch(finding.PID); err != nil {
+				log.Printf("Failed to stop %s: %v", finding.Name, err)
+			}
+		}
+	}
+
+	var ifaces []string
+	for iface := range d.blockedIfaces {
+		ifaces = append(ifaces, iface)
+	}
+	sort.Strings(ifaces)
+	var ports []int
+	if d.torBlocked {
+		ports = circumvent.TorPorts
+	}
+	if err := d.networkBlocker.SetCircumventionBlocks(ifaces, ports); err != nil {
+		log.Printf("Failed to block circumvention: %v", err)
+	}
+}
+
+func (d *Daemon) clearCircumventionBlocks() {
+	if len(d.blockedIfaces) == 0 && !d.torBlocked {
+		return
+	}
+	d.blockedIfaces = make(map[string]bool)
+	d.torBlocked = false
+	if err := d.networkBlocker.SetCircumventionBlocks(nil, nil); err != nil {
+		log.Printf("Failed to remove circumvention blocks: %v", err)
+	}
+}
+
+// extendLock holds every block for at least extendBy from now, overriding
+// timed unlocks and closing schedule windows.
+func (d *Daemon) extendLock(now time.Time, extendBy string) {
+	duration, err := time.ParseDuration(extendBy)
+	if err != nil || duration <= 0 {
+		duration, _ = time.ParseDuration(config.DefaultLockExtension)
+	}
+	until := now.Add(duration).Truncate(time.Second)
+	if !until.After(d.lockedUntil) {
+		return
+	}
+	d.lockedUntil = until
+	auditEvent("lock_extended", "", "until "+until.Format(time.RFC3339))
+	d.saveUnlocks()
+	d.syncBlocks()
+}
+
+// lockExtended reports whether a lock extension is in effect.
+func (d *Daemon) lockExtended(now time.Time) bool {
+	return now.Before(d.lockedUntil)
+}
+
+// expireLockExtension ends a lock extension that ran out and reports
+// whether one did.
+func (d *Daemon) expireLockExtension(now time.Time) bool {
+	if d.lockedUntil.IsZero() || d.lockExtended(now) {
+		return false
+	}
+	log.Println("Lock extension ended")
+	d.lockedUntil = time.Time{}
+	d.saveUnlocks()
+	return true
+}
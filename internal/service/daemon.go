@@ -6,31 +6,76 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 	"os/exec"
 	"github.com/gajzzs/keyphy/internal/blocker"
+	"github.com/gajzzs/keyphy/internal/circumvent"
 	"github.com/gajzzs/keyphy/internal/config"
 	"github.com/gajzzs/keyphy/internal/crypto"
 	"github.com/gajzzs/keyphy/internal/device"
+	"github.com/gajzzs/keyphy/internal/landing"
+	"github.com/gajzzs/keyphy/internal/nfqueue"
+	"github.com/gajzzs/keyphy/internal/resolver"
+	"github.com/gajzzs/keyphy/internal/sni"
 )
 
+const (
+	kindApp     = "application"
+	kindWebsite = "website"
+	kindPath    = "path"
+)
+
+// blockItem is a single configured rule together with the blocker that owns it.
+type blockItem struct {
+	kind string
+	name string
+}
+
 type Daemon struct {
-	appBlocker     *blocker.AppBlocker
-	networkBlocker *blocker.NetworkBlocker
-	fileBlocker    *blocker.FileBlocker
-	running        bool
-	blocksActive   bool
-	ctx            context.Context
-	cancel         context.CancelFunc
+	appBlocker      *blocker.AppBlocker
+	networkBlocker  *blocker.NetworkBlocker
+	fileBlocker     *blocker.FileBlocker
+	running         bool
+	blocksActive    bool
+	enforced        map[blockItem]bool
+	schedules       []compiledSchedule
+	scheduleActive  map[string]bool
+	suppressed      map[string]bool
+	unlocks         []config.TimedUnlock
+	handled         string
+	rejected        string
+	usage           *config.Usage
+	configSignature string
+	dnsServer       *resolver.Server
+	dnsConfig       config.Resolver
+	sniQueue        *nfqueue.Queue
+	sniClassifier   *sni.Classifier
+	sniSince        time.Time
+	landingServer   *landing.Server
+	landingConfig   config.LandingPage
+	detector        *circumvent.Detector
+	blockedIfaces   map[string]bool
+	torBlocked      bool
+	lockedUntil     time.Time
+	repairTimes     []time.Time
+	tamperEscalated bool
+	mu              sync.Mutex
+	ctx             context.Context
+	cancel          context.CancelFunc
 }
 
 func NewDaemon() *Daemon {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Daemon{
 		appBlocker:     blocker.NewAppBlocker(),
-		networkBlocker: blocker.NewNetworkBlocker(),
 		fileBlocker:    blocker.NewFileBlocker(),
+		enforced:       make(map[blockItem]bool),
+		scheduleActive: make(map[string]bool),
+		suppressed:     make(map[string]bool),
+		detector:       circumvent.NewDetector(),
+		blockedIfaces:  make(map[string]bool),
 		ctx:            ctx,
 		cancel:         cancel,
 	}
@@ -50,16 +95,36 @@ func (d *Daemon) Start() error {
 	}
 
 	// Apply initial blocks
-	if err := d.applyBlocks(); err != nil {
-		return fmt.Errorf("failed to apply blocks: %v", err)
+	d.mu.Lock()
+	// The backend depends on the loaded config, so it is chosen here
+	d.networkBlocker = blocker.NewNetworkBlocker(blocker.NewFirewall(config.GetConfig().FirewallBackend))
+	log.Printf("Using %s firewall backend", d.networkBlocker.Backend())
+	d.appBlocker.OnDenied = func(app, path string, pid int) {
+		auditEvent("exec_denied", app, fmt.Sprintf("%s, PID %d", path, pid))
 	}
+	d.syncAppBackend()
+	d.loadUnlocks()
+	d.loadUsage()
+	d.resetUsageIfDue(time.Now())
+	d.updateSchedules(time.Now())
 	d.blocksActive = true
+	err := d.applyBlocks()
+	d.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to apply blocks: %v", err)
+	}
 
 	// Start monitoring goroutines
 	go d.monitorDevices()
 	go d.monitorNetwork()
 	go d.monitorProcesses()
 	go d.monitorConfigFile()
+	go d.monitorSchedules()
+	go d.monitorUnlocks()
+	go d.monitorUsage()
+	go d.monitorExpiry()
+	go d.monitorCircumvention()
+	go d.monitorDrift()
 	go d.handleSignals()
 	go d.selfProtection()
 
@@ -87,7 +152,11 @@ func (d *Daemon) Stop() error {
 	}
 
 	// Remove all blocks when stopping
-	return d.removeAllBlocks()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.removeAllBlocks()
+	d.appBlocker.StopExecGuard()
+	return err
 }
 
 func (d *Daemon) UnlockWithAuth() error {
@@ -96,10 +165,12 @@ func (d *Daemon) UnlockWithAuth() error {
 	}
 	
 	log.Println("Device authenticated, removing all blocks")
-	if err := d.removeAllBlocks(); err != nil {
-		return fmt.Errorf("failed to remove blocks: %v", err)
-	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	d.blocksActive = false
+	d.clearUnlocks()
+	d.suppressActiveSchedules()
+	d.syncBlocks()
 	
 	return nil
 }
@@ -110,10 +181,13 @@ func (d *Daemon) LockWithAuth() error {
 	}
 	
 	log.Println("Device authenticated, applying all blocks")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.blocksActive = true
+	d.clearUnlocks()
 	if err := d.applyBlocks(); err != nil {
 		return fmt.Errorf("failed to apply blocks: %v", err)
 	}
-	d.blocksActive = true
 	
 	return nil
 }
@@ -137,77 +211,323 @@ func (d *Daemon) validateDeviceAuth() bool {
 	return false
 }
 
-func (d *Daemon) applyBlocks() error {
-	cfg := config.GetConfig()
+// configuredItems returns all blocked items in cfg whose expiry has not passed.
+func configuredItems(cfg *config.Config) []blockItem {
+	var items []blockItem
+	now := time.Now()
+	add := func(kind string, names []string) {
+		for _, name := range names {
+			if !config.IsExpired(name, now) {
+				items = append(items, blockItem{kind, name})
+			}
+		}
+	}
+	add(kindApp, cfg.BlockedApps)
+	add(kindWebsite, cfg.BlockedWebsites)
+	add(kindPath, cfg.BlockedPaths)
+	return items
+}
 
-	log.Println("Applying blocking rules...")
-	// Block applications
-	for _, app := range cfg.BlockedApps {
-		log.Printf("Blocking application: %s", app)
-		if err := d.appBlocker.BlockApp(app); err != nil {
-			log.Printf("Failed to block app %s: %v", app, err)
-		} else {
-			log.Printf("Successfully blocked application: %s", app)
+// shouldEnforce decides whether a configured item is blocked right now.
+// A lock extended after a circumvention attempt wins over everything else,
+// then timed unlocks. The daemon lock covers all items;
+// open schedule windows lock their targets even while the daemon is unlocked.
+// Items with a quota for today are blocked exactly when the budget is used
+// up, whether or not the daemon is locked.
+func (d *Daemon) shouldEnforce(item blockItem, quotaOnly bool) bool {
+	now := time.Now()
+	if d.lockExtended(now) && !quotaOnly {
+		return true
+	}
+	if d.unlockedFor(item.name, now) {
+		return false
+	}
+	if quota, ok := d.activeQuota(item, now); ok {
+		return d.quotaExhausted(quota)
+	}
+	locked := d.blocksActive || d.scheduleForces(item.name)
+	return locked && !quotaOnly
+}
+
+func (d *Daemon) blockItem(item blockItem) error {
+	switch item.kind {
+	case kindApp:
+		return d.appBlocker.BlockApp(item.name)
+	case kindWebsite:
+		meta, _ := config.Meta(item.name)
+		owners, err := websiteOwners(meta)
+		if err != nil {
+			return err
 		}
+		return d.networkBlocker.BlockWebsite(item.name, owners, meta.Ranges...)
+	default:
+		return d.fileBlocker.BlockPath(item.name)
 	}
+}
 
-	// Block websites
-	for _, website := range cfg.BlockedWebsites {
-		log.Printf("Blocking website: %s", website)
-		if err := d.networkBlocker.BlockWebsite(website); err != nil {
-			log.Printf("Failed to block website %s: %v", website, err)
+// websiteOwners resolves the users and groups a website rule is limited to.
+// Unknown names are skipped, but a rule none of whose owners exist is not
+// applied rather than widened to everyone.
+func websiteOwners(meta config.RuleMeta) (blocker.Owners, error) {
+	var owners blocker.Owners
+	for _, name := range meta.Users {
+		if u, err := config.LookupUser(name); err != nil {
+			log.Printf("Ignoring unknown user %s: %v", name, err)
+		} else {
+			owners.UIDs = append(owners.UIDs, u.Uid)
+		}
+	}
+	for _, name := range meta.Groups {
+		if g, err := config.LookupGroup(name); err != nil {
+			log.Printf("Ignoring unknown group %s: %v", name, err)
 		} else {
-			log.Printf("Successfully blocked website: %s", website)
+			owners.GIDs = append(owners.GIDs, g.Gid)
 		}
 	}
+	if owners.Empty() && meta.Scoped() {
+		return owners, fmt.Errorf("none of the users or groups the rule is limited to exist")
+	}
+	return owners, nil
+}
+
+// globalWebsites returns the enforced website rules that apply to every
+// user, which are the ones shared mechanisms like the DNS sinkhole enforce.
+func (d *Daemon) globalWebsites() []string {
+	var rules []string
+	for item := range d.enforced {
+		if item.kind != kindWebsite {
+			continue
+		}
+		if meta, ok := config.Meta(item.name); ok && meta.Scoped() {
+			continue
+		}
+		rules = append(rules, item.name)
+	}
+	return rules
+}
 
-	// Block file paths
-	for _, path := range cfg.BlockedPaths {
-		log.Printf("Blocking path: %s", path)
-		if err := d.fileBlocker.BlockPath(path); err != nil {
-			log.Printf("Failed to block path %s: %v", path, err)
+func (d *Daemon) unblockItem(item blockItem) error {
+	switch item.kind {
+	case kindApp:
+		return d.appBlocker.UnblockApp(item.name)
+	case kindWebsite:
+		return d.networkBlocker.UnblockWebsite(item.name)
+	default:
+		return d.fileBlocker.UnblockPath(item.name)
+	}
+}
+
+func (d *Daemon) enforceItem(item blockItem) {
+	log.Printf("Blocking %s: %s", item.kind, item.name)
+	if err := d.blockItem(item); err != nil {
+		log.Printf("Failed to block %s %s: %v", item.kind, item.name, err)
+	} else {
+		log.Printf("Successfully blocked %s: %s", item.kind, item.name)
+	}
+	d.enforced[item] = true
+}
+
+// enforceWebsites blocks website items together, so a large import
+// commits the firewall and writes the hosts file once instead of once per
+// site. A single site is blocked on its own to have its addresses resolved
+// right away.
+func (d *Daemon) enforceWebsites(items []blockItem) {
+	if len(items) <= 1 {
+		for _, item := range items {
+			d.enforceItem(item)
+		}
+		return
+	}
+	log.Printf("Blocking %d websites", len(items))
+	var blocks []blocker.WebsiteBlock
+	for _, item := range items {
+		meta, _ := config.Meta(item.name)
+		owners, err := websiteOwners(meta)
+		if err != nil {
+			log.Printf("Failed to block %s %s: %v", item.kind, item.name, err)
 		} else {
-			log.Printf("Successfully blocked path: %s", path)
+			blocks = append(blocks, blocker.WebsiteBlock{Domain: item.name, Owners: owners, Ranges: meta.Ranges})
 		}
+		d.enforced[item] = true
+	}
+	if err := d.networkBlocker.BlockWebsites(blocks); err != nil {
+		log.Printf("Failed to block websites: %v", err)
+	} else {
+		log.Printf("Successfully blocked %d websites", len(blocks))
 	}
+}
 
-	log.Println("All blocking rules applied successfully")
-	return nil
+func (d *Daemon) releaseItem(item blockItem) {
+	log.Printf("Unblocking %s: %s", item.kind, item.name)
+	if err := d.unblockItem(item); err != nil {
+		log.Printf("Failed to unblock %s %s: %v", item.kind, item.name, err)
+	} else {
+		log.Printf("Successfully unblocked %s: %s", item.kind, item.name)
+	}
+	delete(d.enforced, item)
 }
 
-func (d *Daemon) removeAllBlocks() error {
+// reconcileItems brings every configured item in line with shouldEnforce.
+// With force set, items that are already enforced are blocked again, which
+// repairs blocks that were tampered with.
+func (d *Daemon) reconcileItems(force bool) {
 	cfg := config.GetConfig()
+	if err := d.networkBlocker.SetEncryptedDNS(encryptedDNSList(cfg)); err != nil {
+		log.Printf("Failed to update encrypted DNS blocklist: %v", err)
+	}
+	if err := d.networkBlocker.SetQUICMode(cfg.QUIC); err != nil {
+		log.Printf("Failed to update QUIC blocking: %v", err)
+	}
+	policy := blocker.BrowserPolicyOptions{BlockIncognito: cfg.BrowserPolicy.BlockIncognito, BlockExtensions: cfg.BrowserPolicy.BlockExtensions}
+	if err := d.networkBlocker.SetBrowserPolicies(cfg.BrowserPolicy.Enabled, policy); err != nil {
+		log.Printf("Failed to update browser policies: %v", err)
+	}
+	configured := make(map[blockItem]bool)
+	var websites []blockItem
+	check := func(item blockItem, quotaOnly bool) {
+		configured[item] = true
+		if d.shouldEnforce(item, quotaOnly) {
+			if item.kind == kindWebsite && (force || !d.enforced[item]) {
+				websites = append(websites, item)
+			} else if force || !d.enforced[item] {
+				d.enforceItem(item)
+			}
+		} else if d.enforced[item] {
+			d.releaseItem(item)
+		}
+	}
+	for _, item := range configuredItems(cfg) {
+		check(item, false)
+	}
+	for _, item := range quotaItems(cfg) {
+		check(item, true)
+	}
+	d.enforceWebsites(websites)
 
-	log.Println("Removing all blocking rules...")
-	// Unblock applications
-	for _, app := range cfg.BlockedApps {
-		log.Printf("Unblocking application: %s", app)
-		if err := d.appBlocker.UnblockApp(app); err != nil {
-			log.Printf("Failed to unblock app %s: %v", app, err)
-		} else {
-			log.Printf("Successfully unblocked application: %s", app)
+	// Items removed from the config no longer need their blocks
+	for item := range d.enforced {
+		if !configured[item] {
+			d.releaseItem(item)
 		}
 	}
 
-	// Unblock websites
-	for _, website := range cfg.BlockedWebsites {
-		log.Printf("Unblocking website: %s", website)
-		if err := d.networkBlocker.UnblockWebsite(website); err != nil {
-			log.Printf("Failed to unblock website %s: %v", website, err)
-		} else {
-			log.Printf("Successfully unblocked website: %s", website)
+	d.syncNetworkMode(cfg)
+	d.syncResolver(cfg)
+	d.syncSNI(cfg)
+	d.syncLanding(cfg)
+}
+
+// syncNetworkMode enables allowlist mode while the daemon is locked and the
+// config asks for it. A full timed unlock lifts it like every other block.
+func (d *Daemon) syncNetworkMode(cfg *config.Config) {
+	now := time.Now()
+	locked := d.lockExtended(now) || d.blocksActive && !d.unlockedFor("", now)
+	if cfg.NetworkMode == config.NetworkModeAllowlist && locked {
+		var upstreams []string
+		if cfg.Resolver.Enabled {
+			upstreams = resolverUpstreams(cfg.Resolver)
+		}
+		if err := d.networkBlocker.EnableAllowlist(cfg.AllowedWebsites, upstreams); err != nil {
+			log.Printf("Failed to enable allowlist mode: %v", err)
 		}
+		return
 	}
+	if d.networkBlocker.AllowlistActive() {
+		log.Println("Leaving allowlist mode")
+		d.networkBlocker.DisableAllowlist()
+	}
+}
 
-	// Unblock file paths
-	for _, path := range cfg.BlockedPaths {
-		log.Printf("Unblocking path: %s", path)
-		if err := d.fileBlocker.UnblockPath(path); err != nil {
-			log.Printf("Failed to unblock path %s: %v", path, err)
-		} else {
-			log.Printf("Successfully unblocked path: %s", path)
+// encryptedDNSList returns the encrypted DNS resolvers blocked by cfg.
+func encryptedDNSList(cfg *config.Config) blocker.EncryptedDNS {
+	extra := blocker.EncryptedDNS{Addresses: cfg.EncryptedDNS.Addresses, Hosts: cfg.EncryptedDNS.Hosts}
+	return blocker.MergeEncryptedDNS(extra, !cfg.EncryptedDNS.NoDefaults)
+}
+
+// syncFirewallBackend moves website blocks to a newly configured firewall
+// backend. The following applyBlocks installs them again.
+// Callers must hold d.mu.
+func (d *Daemon) syncFirewallBackend() {
+	backend, err := blocker.ResolveBackend(config.GetConfig().FirewallBackend)
+	if err != nil || backend == d.networkBlocker.Backend() {
+		return
+	}
+	log.Printf("Switching firewall backend from %s to %s", d.networkBlocker.Backend(), backend)
+	d.networkBlocker.UnblockAll()
+	for item := range d.enforced {
+		if item.kind == kindWebsite {
+			delete(d.enforced, item)
+		}
+	}
+	d.networkBlocker = blocker.NewNetworkBlocker(blocker.NewFirewall(backend))
+	// Detections are blocked again on the new backend
+	d.detector = circumvent.NewDetector()
+	d.blockedIfaces = make(map[string]bool)
+	d.torBlocked = false
+}
+
+// syncAppBackend starts or stops the fanotify exec guard to match the
+// configured app backend. Blocked apps are released first, so the following
+// applyBlocks blocks them again with the new backend.
+// Callers must hold d.mu.
+func (d *Daemon) syncAppBackend() {
+	backend, err := blocker.ResolveAppBackend(config.GetConfig().AppBackend)
+	if err != nil {
+		log.Printf("Warning: %v, falling back to wrappers", err)
+		backend = blocker.AppBackendWrapper
+	}
+	if backend == d.appBlocker.Backend() {
+		return
+	}
+	d.releaseApps()
+	if backend == blocker.AppBackendWrapper {
+		d.appBlocker.StopExecGuard()
+	} else if err := d.appBlocker.StartExecGuard(); err != nil {
+		log.Printf("Failed to start fanotify exec guard, falling back to wrappers: %v", err)
+	}
+	log.Printf("Using %s app blocking backend", d.appBlocker.Backend())
+}
+
+// releaseApps unblocks every enforced app, which also puts back binaries
+// replaced by wrappers.
+func (d *Daemon) releaseApps() {
+	for item := range d.enforced {
+		if item.kind == kindApp {
+			d.releaseItem(item)
 		}
 	}
+}
+
+// applyBlocks (re)applies every block that should currently be enforced.
+// Callers must hold d.mu.
+func (d *Daemon) applyBlocks() error {
+	log.Println("Applying blocking rules...")
+	d.reconcileItems(true)
+	log.Println("All blocking rules applied successfully")
+	return nil
+}
+
+// syncBlocks applies and removes blocks whose enforcement state changed.
+// Callers must hold d.mu.
+func (d *Daemon) syncBlocks() {
+	d.reconcileItems(false)
+}
+
+// removeAllBlocks lifts every configured block regardless of lock state.
+// Callers must hold d.mu.
+func (d *Daemon) removeAllBlocks() error {
+	log.Println("Removing all blocking rules...")
+	for _, item := range configuredItems(config.GetConfig()) {
+		d.releaseItem(item)
+	}
+	for item := range d.enforced {
+		d.releaseItem(item)
+	}
+	d.networkBlocker.DisableAllowlist()
+	d.stopResolver()
+	d.stopSNI()
+	d.stopLanding()
+	d.clearCircumventionBlocks()
 
 	log.Println("All blocking rules removed successfully")
 	return nil
@@ -235,11 +555,12 @@ func (d *Daemon) monitorDevices() {
 					} else {
 						log.Println("Auth device disconnected or authentication failed")
 						// Apply blocks when device is removed
+						d.mu.Lock()
+						d.blocksActive = true
 						if err := d.applyBlocks(); err != nil {
 							log.Printf("Failed to apply blocks after device disconnection: %v", err)
-						} else {
-							d.blocksActive = true
 						}
+						d.mu.Unlock()
 					}
 					lastDeviceState = currentDeviceState
 				}
@@ -257,13 +578,46 @@ func (d *Daemon) monitorNetwork() {
 		case <-d.ctx.Done():
 			return
 		case <-ticker.C:
-			if err := d.networkBlocker.MonitorNetworkTraffic(); err != nil {
+			d.mu.Lock()
+			flows, err := d.networkBlocker.MonitorNetworkTraffic()
+			if err != nil {
 				log.Printf("Network monitoring error: %v", err)
 			}
-			// Monitor hosts file integrity
-			if err := d.networkBlocker.VerifyHostsFile(); err != nil {
-				log.Printf("Hosts file verification failed: %v", err)
+			for _, flow := range flows {
+				if flow.Closed {
+					log.Printf("Closed connection %s", flow)
+				} else {
+					log.Printf("Connection %s could not be closed, its packets are dropped", flow)
+				}
+			}
+			if err := d.networkBlocker.VerifyBrowserPolicies(); err != nil {
+				log.Printf("Browser policy verification failed: %v", err)
+			}
+			networkBlocker := d.networkBlocker
+			lookups := networkBlocker.PendingLookups()
+			d.mu.Unlock()
+
+			// DNS can take seconds, so other monitors keep running meanwhile
+			lookups.Resolve()
+
+			d.mu.Lock()
+			// After a firewall backend change the next tick starts over
+			if d.networkBlocker == networkBlocker {
+				if err := networkBlocker.RefreshAddresses(lookups); err != nil {
+					log.Printf("Address refresh failed: %v", err)
+				}
+				if err := networkBlocker.RefreshAllowlist(lookups); err != nil {
+					log.Printf("Allowlist refresh failed: %v", err)
+				}
 			}
+			repairResolver := d.updateResolver(config.GetConfig())
+			d.saveSNIStats()
+			// Keeps the block end times on the landing page current
+			d.syncLanding(config.GetConfig())
+			d.mu.Unlock()
+
+			// Repairs resolv.conf if it was pointed away from the sinkhole
+			repairResolver()
 		}
 	}
 }
@@ -277,12 +631,24 @@ func (d *Daemon) monitorProcesses() {
 		case <-d.ctx.Done():
 			return
 		case <-ticker.C:
-			// Only monitor processes if blocks are active
-			if !d.blocksActive {
-				continue
+			d.mu.Lock()
+			if err := d.appBlocker.RefreshExecGuard(); err != nil {
+				log.Printf("Exec guard error: %v", err)
+				if d.appBlocker.Backend() == blocker.AppBackendWrapper {
+					// The guard stopped, so blocked apps need wrappers now
+					d.releaseApps()
+					d.syncBlocks()
+				}
 			}
-			cfg := config.GetConfig()
-			for _, app := range cfg.BlockedApps {
+			// Only monitor processes of apps that are currently blocked
+			var apps []string
+			for item := range d.enforced {
+				if item.kind == kindApp {
+					apps = append(apps, item.name)
+				}
+			}
+			d.mu.Unlock()
+			for _, app := range apps {
 				if pids, err := d.appBlocker.GetRunningProcesses(app); err == nil {
 					for _, pid := range pids {
 						if err := d.appBlocker.BlockProcessLaunch(pid); err != nil {
@@ -297,7 +663,7 @@ func (d *Daemon) monitorProcesses() {
 
 func (d *Daemon) handleSignals() {
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(sigChan, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
 
 	for {
 		select {
@@ -308,21 +674,31 @@ func (d *Daemon) handleSignals() {
 			case syscall.SIGUSR1:
 				log.Println("Received unlock signal")
 				log.Println("Removing blocks...")
-				if err := d.removeAllBlocks(); err != nil {
-					log.Printf("Failed to remove blocks: %v", err)
-				} else {
-					log.Println("Blocks removed successfully")
-					d.blocksActive = false
-				}
+				d.mu.Lock()
+				d.blocksActive = false
+				d.clearUnlocks()
+				d.suppressActiveSchedules()
+				d.syncBlocks()
+				d.mu.Unlock()
+				log.Println("Blocks removed successfully")
 			case syscall.SIGUSR2:
 				log.Println("Received lock signal")
 				log.Println("Applying blocks...")
+				d.mu.Lock()
+				d.blocksActive = true
+				d.clearUnlocks()
 				if err := d.applyBlocks(); err != nil {
 					log.Printf("Failed to apply blocks: %v", err)
 				} else {
 					log.Println("Blocks applied successfully")
-					d.blocksActive = true
 				}
+				d.mu.Unlock()
+			case syscall.SIGHUP:
+				log.Println("Received reload signal")
+				d.mu.Lock()
+				d.reloadUnlocks()
+				d.syncBlocks()
+				d.mu.Unlock()
 			case syscall.SIGTERM, syscall.SIGINT:
 				// Require auth device for termination
 				if !d.validateDeviceAuth() {
@@ -341,33 +717,38 @@ func (d *Daemon) monitorConfigFile() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 	
-	lastModTime := time.Time{}
-	configFile := "/etc/keyphy/config.json"
-	
-	// Get initial modification time
-	if stat, err := os.Stat(configFile); err == nil {
-		lastModTime = stat.ModTime()
-	}
+	// Track config.json together with all conf.d fragments
+	d.mu.Lock()
+	d.configSignature, _ = config.ModSignature()
+	d.mu.Unlock()
 	
 	for {
 		select {
 		case <-d.ctx.Done():
 			return
 		case <-ticker.C:
-			if stat, err := os.Stat(configFile); err == nil {
-				if !stat.ModTime().Equal(lastModTime) {
-					log.Println("WARNING: Config file modification detected!")
-					log.Printf("Previous: %v, Current: %v", lastModTime, stat.ModTime())
-					
-					// Reload config and reapply blocks
-					log.Println("Reloading configuration and reapplying blocks...")
-					config.InitConfig()
-					d.applyBlocks()
-					
-					lastModTime = stat.ModTime()
-				}
-			} else {
+			signature, err := config.ModSignature()
+			if err != nil {
 				log.Printf("Config file monitoring error: %v", err)
+				continue
+			}
+			d.mu.Lock()
+			lastSignature := d.configSignature
+			d.mu.Unlock()
+			if signature != lastSignature {
+				log.Println("WARNING: Config file or fragment modification detected!")
+				
+				// Reload config and reapply blocks
+				log.Println("Reloading configuration and reapplying blocks...")
+				config.InitConfig()
+				d.mu.Lock()
+				d.syncFirewallBackend()
+				d.syncAppBackend()
+				d.updateSchedules(time.Now())
+				d.applyBlocks()
+				// Loading protects new fragments, which changes their ctime but not mtime
+				d.configSignature, _ = config.ModSignature()
+				d.mu.Unlock()
 			}
 		}
 	}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gajzzs/keyphy/internal/config"
+)
+
+const (
+	driftInterval = 30 * time.Second
+	// driftEscalatedInterval is used while tampering continues.
+	driftEscalatedInterval = 5 * time.Second
+	// tamperThreshold repairs within tamperWindow count as tampering.
+	tamperWindow    = 10 * time.Minute
+	tamperThreshold = 3
+)
+
+func (d *Daemon) monitorDrift() {
+	timer := time.NewTimer(driftInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-timer.C:
+			d.mu.Lock()
+			d.checkDrift(time.Now())
+			interval := driftInterval
+			if d.tamperEscalated {
+				interval = driftEscalatedInterval
+			}
+			d.mu.Unlock()
+			timer.Reset(interval)
+		}
+	}
+}
+
+// checkDrift compares the installed firewall rules and hosts entries with
+// the host, reapplies what was removed and escalates when repairs keep
+// being needed. Callers must hold d.mu.
+func (d *Daemon) checkDrift(now time.Time) {
+	drift, err := d.networkBlocker.Reconcile()
+	for _, difference := range drift {
+		auditEvent("drift_repaired", d.networkBlocker.Backend(), difference)
+	}
+	if err != nil {
+		log.Printf("Failed to repair drift: %v", err)
+	}
+
+	var recent []time.Time
+	for _, t := range d.repairTimes {
+		if now.Sub(t) < tamperWindow {
+			recent = append(recent, t)
+		}
+	}
+	if len(drift) > 0 {
+		recent = append(recent, now)
+	}
+	d.repairTimes = recent
+
+	if len(recent) < tamperThreshold {
+		if d.tamperEscalated && len(recent) == 0 {
+			log.Printf("No tampering within %s, checking for drift every %s again", tamperWindow, driftInterval)
+			d.tamperEscalated = false
+		}
+		return
+	}
+	if len(drift) == 0 {
+		return
+	}
+	if !d.tamperEscalated {
+		d.tamperEscalated = true
+		auditEvent("tampering_escalated", "", fmt.Sprintf("%d repairs within %s, checking every %s", len(recent), tamperWindow, driftEscalatedInterval))
+	}
+	// Every further repair pushes the lock out when the policy asks for it
+	cfg := config.GetConfig()
+	if cfg.Circumvention.Policy == config.CircumventionExtend {
+		d.extendLock(now, cfg.Circumvention.ExtendBy)
+	}
+}
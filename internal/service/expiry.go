@@ -0,0 +1,48 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gajzzs/keyphy/internal/config"
+)
+
+// expireRules deletes rules from config.json whose expiry has passed.
+// Expired fragment rules are skipped by configuredItems instead, since only
+// their owner can remove them. Callers must hold d.mu.
+func (d *Daemon) expireRules(now time.Time) bool {
+	expired := config.ExpiredRules(now)
+	for _, item := range expired {
+		meta, _ := config.Meta(item)
+		if err := config.RemoveBlocked(item); err != nil {
+			log.Printf("Failed to remove expired rule %s: %v", item, err)
+			continue
+		}
+		auditEvent("rule_expired", item, fmt.Sprintf("expired at %s", meta.ExpiresAt.Format(time.RFC3339)))
+	}
+	if len(expired) == 0 {
+		return false
+	}
+	// Our own config write is not a tampering attempt
+	d.configSignature, _ = config.ModSignature()
+	return true
+}
+
+func (d *Daemon) monitorExpiry() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			d.mu.Lock()
+			if d.expireRules(time.Now()) {
+				d.syncBlocks()
+			}
+			d.mu.Unlock()
+		}
+	}
+}
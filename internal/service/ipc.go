@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/gajzzs/keyphy/internal/config"
 	"github.com/gajzzs/keyphy/internal/crypto"
@@ -15,6 +16,7 @@ import (
 const (
 	SIGUSR1 = syscall.SIGUSR1 // Unlock signal
 	SIGUSR2 = syscall.SIGUSR2 // Lock signal
+	SIGHUP  = syscall.SIGHUP  // Reload state signal
 )
 
 func SendUnlockSignal() error {
@@ -22,25 +24,7 @@ func SendUnlockSignal() error {
 	if !validateDeviceBeforeSignal() {
 		return fmt.Errorf("authentication device not connected or invalid")
 	}
-	
-	pid, err := readPidFile()
-	if err != nil {
-		return fmt.Errorf("daemon not running: %v", err)
-	}
-	
-	// Check if process is actually running
-	if !isProcessRunning(pid) {
-		// Clean up stale PID file
-		os.Remove(GetUniquePidFile())
-		return fmt.Errorf("daemon not running (stale PID file removed)")
-	}
-	
-	process, err := os.FindProcess(pid)
-	if err != nil {
-		return fmt.Errorf("failed to find daemon process: %v", err)
-	}
-	
-	return process.Signal(SIGUSR1)
+	return signalDaemon(SIGUSR1)
 }
 
 func SendLockSignal() error {
@@ -48,7 +32,80 @@ func SendLockSignal() error {
 	if !validateDeviceBeforeSignal() {
 		return fmt.Errorf("authentication device not connected or invalid")
 	}
-	
+	return signalDaemon(SIGUSR2)
+}
+
+// unlockAckTimeout bounds how long SendTimedUnlock waits for the daemon.
+const unlockAckTimeout = 10 * time.Second
+
+// SendTimedUnlock records an unlock that expires after duration, asks the
+// daemon to pick it up and waits until it has. An existing unlock for the
+// same target is replaced, so extending one needs the device just like
+// creating it.
+func SendTimedUnlock(item, profile string, duration time.Duration) error {
+	if !validateDeviceBeforeSignal() {
+		return fmt.Errorf("authentication device not connected or invalid")
+	}
+
+	state, err := config.LoadState()
+	if err != nil {
+		return fmt.Errorf("failed to read state: %v", err)
+	}
+
+	unlock := config.TimedUnlock{
+		Item:    item,
+		Profile: profile,
+		Expires: time.Now().Add(duration).Truncate(time.Second),
+	}
+	replaced := false
+	for i, existing := range state.Unlocks {
+		if existing.SameTarget(unlock) {
+			if existing.Expires.After(time.Now()) {
+				fmt.Printf("Replacing active unlock for %s (was %s remaining)\n", unlock.Target(), time.Until(existing.Expires).Round(time.Second))
+			}
+			state.Unlocks[i] = unlock
+			replaced = true
+		}
+	}
+	if !replaced {
+		state.Unlocks = append(state.Unlocks, unlock)
+	}
+
+	state.Request = fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano())
+	if err := config.SaveState(state); err != nil {
+		return fmt.Errorf("failed to save state: %v", err)
+	}
+	if err := signalDaemon(SIGHUP); err != nil {
+		return err
+	}
+	return waitForUnlock(state.Request, unlock)
+}
+
+// waitForUnlock polls the state file until the daemon handled request and
+// reports whether it kept unlock.
+func waitForUnlock(request string, unlock config.TimedUnlock) error {
+	deadline := time.Now().Add(unlockAckTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(200 * time.Millisecond)
+		state, err := config.LoadState()
+		if err != nil || state.Handled != request {
+			// Not handled yet, or caught while being written
+			continue
+		}
+		if state.Rejected != "" {
+			return fmt.Errorf("daemon rejected the unlock: %s", state.Rejected)
+		}
+		for _, accepted := range state.Unlocks {
+			if accepted.SameTarget(unlock) && accepted.Expires.Equal(unlock.Expires) {
+				return nil
+			}
+		}
+		return fmt.Errorf("daemon did not accept the unlock")
+	}
+	return fmt.Errorf("daemon did not confirm the unlock within %s", unlockAckTimeout)
+}
+
+func signalDaemon(sig os.Signal) error {
 	pid, err := readPidFile()
 	if err != nil {
 		return fmt.Errorf("daemon not running: %v", err)
@@ -66,7 +123,7 @@ func SendLockSignal() error {
 		return fmt.Errorf("failed to find daemon process: %v", err)
 	}
 	
-	return process.Signal(SIGUSR2)
+	return process.Signal(sig)
 }
 
 func validateDeviceBeforeSignal() bool {
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/gajzzs/keyphy/internal/config"
+	"github.com/gajzzs/keyphy/internal/landing"
+)
+
+// syncLanding runs the landing page server when it is enabled and hands it
+// the currently enforced website rules with the time their block ends.
+// Callers must hold d.mu.
+func (d *Daemon) syncLanding(cfg *config.Config) {
+	if !cfg.LandingPage.Enabled {
+		d.stopLanding()
+		return
+	}
+	if d.landingServer != nil && !reflect.DeepEqual(d.landingConfig, cfg.LandingPage) {
+		log.Println("Landing page settings changed, restarting server")
+		d.stopLanding()
+	}
+	if d.landingServer == nil && !d.startLanding(cfg.LandingPage) {
+		return
+	}
+
+	now := time.Now()
+	rules := d.globalWebsites()
+	ends := make(map[string]time.Time)
+	for _, rule := range rules {
+		if end, ok := d.blockEnd(blockItem{kindWebsite, rule}, now); ok {
+			ends[rule] = end
+		}
+	}
+	for _, err := range d.landingServer.SetRules(rules, ends) {
+		log.Printf("Landing page skipped rule: %v", err)
+	}
+	if err := d.networkBlocker.SetLandingAddress(d.landingServer.Listen()); err != nil {
+		log.Printf("Failed to point blocked sites at landing page: %v", err)
+	}
+}
+
+func (d *Daemon) startLanding(settings config.LandingPage) bool {
+	listen := settings.Listen
+	if listen == "" {
+		listen = config.DefaultLandingListen
+	}
+	server, err := landing.NewServer(listen)
+	if err != nil {
+		log.Printf("Failed to configure landing page: %v", err)
+		return false
+	}
+	server.OnRequest = func(host, rule string) {
+		log.Printf("Landing page: request for %s blocked by rule %s", host, rule)
+	}
+	if err := server.Start(); err != nil {
+		log.Printf("Failed to start landing page: %v", err)
+		return false
+	}
+	log.Printf("Landing page listening on %s", listen)
+	d.landingServer = server
+	d.landingConfig = settings
+	return true
+}
+
+// stopLanding points blocked sites back at the plain sinkhole before the
+// server goes away.
+func (d *Daemon) stopLanding() {
+	if err := d.networkBlocker.SetLandingAddress(""); err != nil {
+		log.Printf("Failed to remove landing page address: %v", err)
+	}
+	if d.landingServer == nil {
+		return
+	}
+	d.landingServer.Stop()
+	d.landingServer = nil
+	log.Println("Landing page stopped")
+}
+
+// blockEnd returns when an enforced item is due to be unblocked: at the
+// quota reset, when its schedule windows close while the daemon is
+// unlocked, or when the rule expires, whichever comes first. Blocks held
+// by the daemon lock have no known end.
+func (d *Daemon) blockEnd(item blockItem, now time.Time) (time.Time, bool) {
+	var end time.Time
+	earliest := func(t time.Time) {
+		if end.IsZero() || t.Before(end) {
+			end = t
+		}
+	}
+
+	cfg := config.GetConfig()
+	if _, ok := d.activeQuota(item, now); ok {
+		earliest(QuotaPeriodStart(cfg.QuotaResetTime, now).AddDate(0, 0, 1))
+	} else if !d.blocksActive {
+		var closes time.Time
+		for _, sched := range d.schedules {
+			if !d.scheduleActive[sched.Name] || d.suppressed[sched.Name] || !sched.covers(item.name) {
+				continue
+			}
+			if next, ok := sched.window.NextTransition(now); ok && next.After(closes) {
+				closes = next
+			}
+		}
+		if !closes.IsZero() {
+			earliest(closes)
+		}
+	}
+	if meta, ok := config.Meta(item.name); ok && meta.ExpiresAt != nil {
+		earliest(*meta.ExpiresAt)
+	}
+	return end, !end.IsZero()
+}
@@ -0,0 +1,187 @@
+package service
+
+import (
+	"log"
+	"time"
+
+	"github.com/gajzzs/keyphy/internal/blocker"
+	"github.com/gajzzs/keyphy/internal/config"
+	"github.com/gajzzs/keyphy/internal/schedule"
+)
+
+const usageInterval = 30 * time.Second
+
+// QuotaPeriodStart returns the most recent counter reset at or before now.
+// resetTime is HH:MM in local time and defaults to midnight.
+func QuotaPeriodStart(resetTime string, now time.Time) time.Time {
+	hour, minute := 0, 0
+	if resetTime != "" {
+		if clock, err := time.Parse("15:04", resetTime); err == nil {
+			hour, minute = clock.Hour(), clock.Minute()
+		}
+	}
+	start := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+	if start.After(now) {
+		start = start.AddDate(0, 0, -1)
+	}
+	return start
+}
+
+// QuotaAppliesOn reports whether the quota's day restriction includes t.
+func QuotaAppliesOn(quota config.Quota, t time.Time) bool {
+	window, err := schedule.Parse(quota.Days, "00:00", "24:00", "")
+	if err != nil {
+		return false
+	}
+	return window.ActiveAt(t)
+}
+
+// quotaItems returns quota rules that are not already hard-blocked items.
+func quotaItems(cfg *config.Config) []blockItem {
+	listed := make(map[blockItem]bool)
+	for _, item := range configuredItems(cfg) {
+		listed[item] = true
+	}
+
+	var items []blockItem
+	for _, quota := range cfg.Quotas {
+		item := quotaBlockItem(quota)
+		if !listed[item] {
+			items = append(items, item)
+			listed[item] = true
+		}
+	}
+	return items
+}
+
+func quotaBlockItem(quota config.Quota) blockItem {
+	if quota.Kind == "app" {
+		return blockItem{kindApp, quota.Item}
+	}
+	return blockItem{kindWebsite, quota.Item}
+}
+
+// activeQuota returns the quota governing item today, if any.
+func (d *Daemon) activeQuota(item blockItem, now time.Time) (config.Quota, bool) {
+	for _, quota := range config.GetConfig().Quotas {
+		if quotaBlockItem(quota) == item && QuotaAppliesOn(quota, now) {
+			return quota, true
+		}
+	}
+	return config.Quota{}, false
+}
+
+func (d *Daemon) quotaExhausted(quota config.Quota) bool {
+	limit, err := time.ParseDuration(quota.Limit)
+	if err != nil {
+		return false
+	}
+	return time.Duration(d.usage.Seconds[quota.Key()])*time.Second >= limit
+}
+
+func (d *Daemon) loadUsage() {
+	usage, err := config.LoadUsage()
+	if err != nil {
+		log.Printf("Failed to load usage counters: %v", err)
+		usage = &config.Usage{Seconds: make(map[string]int64)}
+	}
+	d.usage = usage
+}
+
+// resetUsageIfDue starts a new accounting period once the reset time passed.
+func (d *Daemon) resetUsageIfDue(now time.Time) bool {
+	start := QuotaPeriodStart(config.GetConfig().QuotaResetTime, now)
+	if d.usage.PeriodStart.Equal(start) {
+		return false
+	}
+	if !d.usage.PeriodStart.IsZero() {
+		log.Println("Resetting daily usage counters")
+	}
+	d.usage.PeriodStart = start
+	d.usage.Seconds = make(map[string]int64)
+	return true
+}
+
+// inUse reports whether a quota item is being used right now: a running
+// process for apps, an established connection for websites. Looking up a
+// site's addresses can take seconds, so it runs without d.mu and gets the
+// network blocker from the caller.
+func (d *Daemon) inUse(item blockItem, networkBlocker *blocker.NetworkBlocker) bool {
+	if item.kind == kindApp {
+		pids, err := d.appBlocker.GetRunningProcesses(item.name)
+		return err == nil && len(pids) > 0
+	}
+	active, err := networkBlocker.HasActiveConnections(item.name)
+	if err != nil {
+		log.Printf("Failed to check connections for %s: %v", item.name, err)
+	}
+	return active
+}
+
+// countsUsage reports whether time spent on the quota's item is counted:
+// the quota applies today, the item is not blocked and budget is left.
+func (d *Daemon) countsUsage(quota config.Quota, now time.Time) bool {
+	return QuotaAppliesOn(quota, now) && !d.enforced[quotaBlockItem(quota)] && !d.quotaExhausted(quota)
+}
+
+// usageCandidates returns the quota items whose use is counted now.
+func (d *Daemon) usageCandidates(now time.Time) []blockItem {
+	var items []blockItem
+	for _, quota := range config.GetConfig().Quotas {
+		if d.countsUsage(quota, now) {
+			items = append(items, quotaBlockItem(quota))
+		}
+	}
+	return items
+}
+
+// accountUsage adds elapsed time to every quota item found in use and
+// reports whether a budget ran out.
+func (d *Daemon) accountUsage(now time.Time, elapsed time.Duration, inUse map[blockItem]bool) bool {
+	exhausted := false
+	for _, quota := range config.GetConfig().Quotas {
+		if !d.countsUsage(quota, now) || !inUse[quotaBlockItem(quota)] {
+			continue
+		}
+		d.usage.Seconds[quota.Key()] += int64(elapsed / time.Second)
+		if d.quotaExhausted(quota) {
+			log.Printf("Daily quota of %s for %s used up, blocking", quota.Limit, quota.Item)
+			exhausted = true
+		}
+	}
+	return exhausted
+}
+
+func (d *Daemon) monitorUsage() {
+	ticker := time.NewTicker(usageInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now()
+			d.mu.Lock()
+			reset := d.resetUsageIfDue(now)
+			candidates := d.usageCandidates(now)
+			networkBlocker := d.networkBlocker
+			d.mu.Unlock()
+
+			inUse := make(map[blockItem]bool)
+			for _, item := range candidates {
+				inUse[item] = d.inUse(item, networkBlocker)
+			}
+
+			d.mu.Lock()
+			exhausted := d.accountUsage(now, usageInterval, inUse)
+			if err := config.SaveUsage(d.usage); err != nil {
+				log.Printf("Failed to save usage counters: %v", err)
+			}
+			if reset || exhausted {
+				d.syncBlocks()
+			}
+			d.mu.Unlock()
+		}
+	}
+}
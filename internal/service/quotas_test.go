@@ -0,0 +1,23 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gajzzs/keyphy/internal/config"
+)
+
+func TestQuotaUsageByKind(t *testing.T) {
+	app := config.Quota{Kind: "app", Item: "steam", Limit: "1h0m0s"}
+	website := config.Quota{Kind: "website", Item: "steam", Limit: "1h0m0s"}
+	d := &Daemon{usage: &config.Usage{Seconds: map[string]int64{
+		app.Key(): int64(time.Hour / time.Second),
+	}}}
+
+	if !d.quotaExhausted(app) {
+		t.Error("app quota is not used up")
+	}
+	if d.quotaExhausted(website) {
+		t.Error("website quota shares the app's usage")
+	}
+}
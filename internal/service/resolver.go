@@ -0,0 +1,104 @@
+package service
+
+import (
+	"log"
+	"reflect"
+
+	"github.com/gajzzs/keyphy/internal/config"
+	"github.com/gajzzs/keyphy/internal/resolver"
+)
+
+// syncResolver runs the DNS sinkhole when it is enabled, hands it the
+// currently enforced website rules and points the system resolver at it
+// while any of them are blocked. Callers must hold d.mu.
+func (d *Daemon) syncResolver(cfg *config.Config) {
+	d.updateResolver(cfg)()
+}
+
+// updateResolver is syncResolver without the change to the system resolver,
+// which it returns instead. That change can restart systemd-resolved, so
+// the monitor runs it after releasing d.mu. Callers must hold d.mu.
+func (d *Daemon) updateResolver(cfg *config.Config) func() {
+	if !cfg.Resolver.Enabled {
+		d.stopResolver()
+		return func() {}
+	}
+	if d.dnsServer != nil && !reflect.DeepEqual(d.dnsConfig, cfg.Resolver) {
+		log.Println("DNS sinkhole settings changed, restarting resolver")
+		d.stopResolver()
+	}
+	if d.dnsServer == nil && !d.startResolver(cfg.Resolver) {
+		return func() {}
+	}
+
+	// Everyone resolves through the sinkhole, so per-user rules stay out
+	rules := d.globalWebsites()
+	if len(rules) > 0 {
+		// DoH hostnames are sinkholed too, so browsers fall back to plain DNS
+		rules = append(rules, encryptedDNSList(cfg).Hosts...)
+	}
+	for _, err := range d.dnsServer.SetRules(rules) {
+		log.Printf("DNS sinkhole skipped rule: %v", err)
+	}
+
+	if len(rules) == 0 {
+		return func() {
+			if err := resolver.Restore(resolver.BackupFile); err != nil {
+				log.Printf("Failed to restore system resolver: %v", err)
+			}
+		}
+	}
+	listen := d.dnsServer.Listen()
+	return func() {
+		if err := resolver.Redirect(listen, resolver.BackupFile); err != nil {
+			log.Printf("Failed to point system resolver at DNS sinkhole: %v", err)
+		}
+	}
+}
+
+// resolverUpstreams returns the nameservers the DNS sinkhole forwards to.
+func resolverUpstreams(settings config.Resolver) []string {
+	if len(settings.Upstreams) > 0 {
+		return settings.Upstreams
+	}
+	return resolver.SystemUpstreams(resolver.BackupFile)
+}
+
+func (d *Daemon) startResolver(settings config.Resolver) bool {
+	listen := settings.Listen
+	if listen == "" {
+		listen = config.DefaultResolverListen
+	}
+	upstreams := resolverUpstreams(settings)
+
+	server, err := resolver.NewServer(listen, upstreams, settings.Response == config.ResolverZeroAddress)
+	if err != nil {
+		log.Printf("Failed to configure DNS sinkhole: %v", err)
+		return false
+	}
+	server.OnBlock = func(name, rule string) {
+		log.Printf("DNS sinkhole: %s blocked by rule %s", name, rule)
+	}
+	if err := server.Start(); err != nil {
+		log.Printf("Failed to start DNS sinkhole: %v", err)
+		return false
+	}
+	log.Printf("DNS sinkhole listening on %s, forwarding to %v", listen, upstreams)
+	d.dnsServer = server
+	d.dnsConfig = settings
+	return true
+}
+
+// stopResolver restores the system resolver before shutting the sinkhole
+// down so name resolution never points at a closed port.
+func (d *Daemon) stopResolver() {
+	if err := resolver.Restore(resolver.BackupFile); err != nil {
+		log.Printf("Failed to restore system resolver: %v", err)
+	}
+	if d.dnsServer == nil {
+		return
+	}
+	d.dnsServer.Stop()
+	d.dnsServer = nil
+	log.Println("DNS sinkhole stopped")
+}
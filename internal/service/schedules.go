@@ -0,0 +1,130 @@
+package service
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gajzzs/keyphy/internal/config"
+	"github.com/gajzzs/keyphy/internal/schedule"
+)
+
+type compiledSchedule struct {
+	config.Schedule
+	window *schedule.Window
+}
+
+// compileSchedules parses the schedules in cfg, skipping invalid entries.
+func compileSchedules(cfg *config.Config) []compiledSchedule {
+	var compiled []compiledSchedule
+	for _, sched := range cfg.Schedules {
+		window, err := schedule.Parse(sched.Days, sched.Start, sched.End, sched.Timezone)
+		if err != nil {
+			log.Printf("Ignoring invalid schedule %s: %v", sched.Name, err)
+			continue
+		}
+		compiled = append(compiled, compiledSchedule{Schedule: sched, window: window})
+	}
+	return compiled
+}
+
+// covers reports whether the schedule applies to the given blocked item.
+func (s compiledSchedule) covers(item string) bool {
+	if s.Profile == "" && len(s.Items) == 0 {
+		return true
+	}
+	targets := append([]string{}, s.Items...)
+	targets = append(targets, config.ProfileItems(s.Profile)...)
+	for _, target := range targets {
+		if itemMatches(target, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// itemMatches compares a rule target with a configured item, treating
+// "name:path" app entries as matching either part.
+func itemMatches(target, item string) bool {
+	if target == item {
+		return true
+	}
+	if name, path, ok := strings.Cut(item, ":"); ok {
+		return target == name || target == path
+	}
+	return false
+}
+
+func (d *Daemon) monitorSchedules() {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			d.mu.Lock()
+			if d.updateSchedules(time.Now()) {
+				d.syncBlocks()
+			}
+			d.mu.Unlock()
+		}
+	}
+}
+
+// updateSchedules re-evaluates every schedule and reports whether any window
+// opened or closed since the last evaluation.
+func (d *Daemon) updateSchedules(now time.Time) bool {
+	d.schedules = compileSchedules(config.GetConfig())
+	changed := false
+	seen := make(map[string]bool)
+
+	for _, sched := range d.schedules {
+		seen[sched.Name] = true
+		active := sched.window.ActiveAt(now)
+		if active == d.scheduleActive[sched.Name] {
+			continue
+		}
+		d.scheduleActive[sched.Name] = active
+		// A device unlock only lasts until the window it interrupted ends
+		delete(d.suppressed, sched.Name)
+		changed = true
+		if active {
+			log.Printf("Schedule %s started, locking its targets", sched.Name)
+		} else {
+			log.Printf("Schedule %s ended", sched.Name)
+		}
+	}
+
+	// Forget schedules that were removed from the config
+	for name := range d.scheduleActive {
+		if !seen[name] {
+			delete(d.scheduleActive, name)
+			delete(d.suppressed, name)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// scheduleForces reports whether an open, unsuppressed schedule window
+// requires the item to be blocked.
+func (d *Daemon) scheduleForces(item string) bool {
+	for _, sched := range d.schedules {
+		if d.scheduleActive[sched.Name] && !d.suppressed[sched.Name] && sched.covers(item) {
+			return true
+		}
+	}
+	return false
+}
+
+// suppressActiveSchedules keeps currently open windows from relocking after a
+// device-authenticated unlock. Suppression ends when the window closes.
+func (d *Daemon) suppressActiveSchedules() {
+	for name, active := range d.scheduleActive {
+		if active {
+			d.suppressed[name] = true
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"log"
+	"time"
+
+	"github.com/gajzzs/keyphy/internal/blocker"
+	"github.com/gajzzs/keyphy/internal/config"
+	"github.com/gajzzs/keyphy/internal/nfqueue"
+	"github.com/gajzzs/keyphy/internal/sni"
+)
+
+// syncSNI runs the SNI classifier when inspection is enabled and hands it
+// the currently enforced website rules. Callers must hold d.mu.
+func (d *Daemon) syncSNI(cfg *config.Config) {
+	if !cfg.SNIInspection {
+		d.stopSNI()
+		return
+	}
+	if d.sniQueue == nil && !d.startSNI() {
+		return
+	}
+
+	for _, err := range d.sniClassifier.SetRules(d.globalWebsites()) {
+		log.Printf("SNI inspection skipped rule: %v", err)
+	}
+	if err := d.networkBlocker.SetSNIInspection(true); err != nil {
+		log.Printf("Failed to queue HTTPS handshakes for SNI inspection: %v", err)
+	}
+}
+
+func (d *Daemon) startSNI() bool {
+	queue, err := nfqueue.Open(blocker.SNIQueue)
+	if err != nil {
+		log.Printf("Failed to start SNI inspection: %v", err)
+		return false
+	}
+	classifier := sni.NewClassifier()
+	classifier.OnBlock = func(host, rule string) {
+		log.Printf("SNI inspection: TLS handshake to %s blocked by rule %s", host, rule)
+	}
+	queue.Start(classifier.Verdict)
+
+	log.Printf("SNI inspection listening on netfilter queue %d", blocker.SNIQueue)
+	d.sniQueue = queue
+	d.sniClassifier = classifier
+	d.sniSince = time.Now()
+	return true
+}
+
+// stopSNI removes the queue rule before closing the queue. Packets still
+// queued then are accepted by the kernel.
+func (d *Daemon) stopSNI() {
+	if err := d.networkBlocker.SetSNIInspection(false); err != nil {
+		log.Printf("Failed to remove SNI inspection rule: %v", err)
+	}
+	if d.sniQueue == nil {
+		return
+	}
+	d.saveSNIStats()
+	d.sniQueue.Close()
+	d.sniQueue = nil
+	d.sniClassifier = nil
+	log.Println("SNI inspection stopped")
+}
+
+// saveSNIStats writes the classifier counters for keyphy network show.
+func (d *Daemon) saveSNIStats() {
+	if d.sniClassifier == nil {
+		return
+	}
+	stats := d.sniClassifier.Stats()
+	err := config.SaveSNIStats(&config.SNIStats{
+		Since:     d.sniSince,
+		Inspected: stats.Inspected,
+		Blocked:   stats.Blocked,
+		Unparsed:  stats.Unparsed,
+		Overflows: d.sniQueue.Overflows(),
+		Rules:     stats.Rules,
+	})
+	if err != nil {
+		log.Printf("Failed to save SNI inspection counters: %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"log"
+	"time"
+
+	"github.com/gajzzs/keyphy/internal/config"
+)
+
+// loadUnlocks restores timed unlocks saved before a restart.
+func (d *Daemon) loadUnlocks() {
+	state, err := config.LoadState()
+	if err != nil {
+		log.Printf("Failed to load state: %v", err)
+		return
+	}
+	d.unlocks = state.Unlocks
+	if state.LockedUntil != nil {
+		d.lockedUntil = *state.LockedUntil
+		log.Printf("Restored lock extension until %s", d.lockedUntil.Format(time.RFC3339))
+	}
+	for _, unlock := range d.unlocks {
+		log.Printf("Restored timed unlock for %s until %s", unlock.Target(), unlock.Expires.Format(time.RFC3339))
+	}
+}
+
+// reloadUnlocks picks up unlocks written by the CLI. New or extended unlocks
+// need the auth device to be present; otherwise the previous state is kept.
+func (d *Daemon) reloadUnlocks() {
+	state, err := config.LoadState()
+	if err != nil {
+		log.Printf("Failed to reload state: %v", err)
+		return
+	}
+
+	now := time.Now()
+	var accepted []config.TimedUnlock
+	needsAuth := false
+	for _, unlock := range state.Unlocks {
+		if !unlock.Expires.After(now) {
+			continue
+		}
+		if previous, ok := d.findUnlock(unlock); !ok || unlock.Expires.After(previous.Expires) {
+			needsAuth = true
+		}
+		accepted = append(accepted, unlock)
+	}
+
+	d.handled, d.rejected = state.Request, ""
+	if needsAuth && !d.validateDeviceAuth() {
+		log.Println("Timed unlock rejected - auth device required")
+		d.rejected = "auth device required"
+		d.saveUnlocks()
+		return
+	}
+
+	for _, unlock := range accepted {
+		if _, ok := d.findUnlock(unlock); !ok {
+			log.Printf("Timed unlock for %s until %s", unlock.Target(), unlock.Expires.Format(time.RFC3339))
+		}
+		// Blocks come back when a full unlock expires, even if the daemon was unlocked before
+		if unlock.Item == "" && unlock.Profile == "" {
+			d.blocksActive = true
+		}
+	}
+	d.unlocks = accepted
+	d.saveUnlocks()
+}
+
+func (d *Daemon) findUnlock(target config.TimedUnlock) (config.TimedUnlock, bool) {
+	for _, unlock := range d.unlocks {
+		if unlock.SameTarget(target) {
+			return unlock, true
+		}
+	}
+	return config.TimedUnlock{}, false
+}
+
+func (d *Daemon) saveUnlocks() {
+	state := &config.State{Unlocks: d.unlocks, Handled: d.handled, Rejected: d.rejected}
+	if !d.lockedUntil.IsZero() {
+		state.LockedUntil = &d.lockedUntil
+	}
+	if err := config.SaveState(state); err != nil {
+		log.Printf("Failed to save state: %v", err)
+	}
+}
+
+// clearUnlocks drops all timed unlocks and lock extensions, used when an
+// explicit lock or unlock replaces them.
+func (d *Daemon) clearUnlocks() {
+	if len(d.unlocks) == 0 && d.lockedUntil.IsZero() {
+		return
+	}
+	d.unlocks = nil
+	d.lockedUntil = time.Time{}
+	d.saveUnlocks()
+}
+
+// expireUnlocks removes unlocks that ran out and reports whether any did.
+func (d *Daemon) expireUnlocks(now time.Time) bool {
+	var remaining []config.TimedUnlock
+	for _, unlock := range d.unlocks {
+		if unlock.Expires.After(now) {
+			remaining = append(remaining, unlock)
+		} else {
+			log.Printf("Timed unlock for %s expired, reapplying blocks", unlock.Target())
+		}
+	}
+	if len(remaining) == len(d.unlocks) {
+		return false
+	}
+	d.unlocks = remaining
+	d.saveUnlocks()
+	return true
+}
+
+// unlockedFor reports whether an active timed unlock covers the item.
+func (d *Daemon) unlockedFor(item string, now time.Time) bool {
+	for _, unlock := range d.unlocks {
+		if !unlock.Expires.After(now) {
+			continue
+		}
+		switch {
+		case unlock.Item != "":
+			if itemMatches(unlock.Item, item) {
+				return true
+			}
+		case unlock.Profile != "":
+			for _, target := range config.ProfileItems(unlock.Profile) {
+				if itemMatches(target, item) {
+					return true
+				}
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Daemon) monitorUnlocks() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			d.mu.Lock()
+			now := time.Now()
+			expired := d.expireUnlocks(now)
+			if d.expireLockExtension(now) {
+				expired = true
+			}
+			if expired {
+				d.syncBlocks()
+			}
+			d.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package sni
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/gajzzs/keyphy/internal/matcher"
+)
+
+const (
+	protoTCP = 6
+	// flowTimeout drops partial ClientHellos that never complete.
+	flowTimeout = 10 * time.Second
+	// blockedTimeout keeps dropping retransmissions of a blocked handshake.
+	blockedTimeout = 2 * time.Minute
+	maxFlows       = 4096
+)
+
+// Stats counts classified handshakes.
+type Stats struct {
+	Inspected uint64
+	Blocked   uint64
+	// Unparsed counts TLS flows whose server name could not be read.
+	Unparsed uint64
+	// Rules counts blocked handshakes per website rule.
+	Rules map[string]uint64
+}
+
+// flow holds the start of a TCP stream until its ClientHello is complete,
+// and remembers blocked streams so their retransmissions are dropped too.
+type flow struct {
+	data    []byte
+	nextSeq uint32
+	started time.Time
+	blocked bool
+}
+
+// Classifier decides on outbound TCP segments by the server name of the
+// ClientHello they carry. Segments that are not part of a TLS handshake are
+// always accepted, and a ClientHello split over several segments is
+// reassembled: the earlier segments pass and the one completing the name
+// gets the verdict.
+type Classifier struct {
+	mu      sync.Mutex
+	matcher *matcher.Matcher
+	flows   map[string]*flow
+	stats   Stats
+
+	// OnBlock is called for every handshake that is dropped.
+	OnBlock func(host, rule string)
+}
+
+func NewClassifier() *Classifier {
+	c := &Classifier{flows: make(map[string]*flow), stats: Stats{Rules: make(map[string]uint64)}}
+	c.matcher, _ = matcher.New(nil)
+	return c
+}
+
+// SetRules replaces the blocked website rules. Invalid rules are skipped
+// and returned.
+func (c *Classifier) SetRules(rules []string) []error {
+	m, errs := matcher.New(rules)
+	c.mu.Lock()
+	c.matcher = m
+	c.mu.Unlock()
+	return errs
+}
+
+// Stats returns a copy of the counters.
+func (c *Classifier) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Rules = make(map[string]uint64, len(c.stats.Rules))
+	for rule, n := range c.stats.Rules {
+		stats.Rules[rule] = n
+	}
+	return stats
+}
+
+// Verdict returns whether packet, starting at its IP header, may pass.
+func (c *Classifier) Verdict(packet []byte) bool {
+	key, seq, payload, ok := tcpSegment(packet)
+	if !ok || len(payload) == 0 {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+
+	f, buffered := c.flows[key]
+	if buffered && f.blocked {
+		return false
+	}
+	if !buffered {
+		if payload[0] != recordHandshake {
+			return true
+		}
+		f = &flow{started: now, nextSeq: seq}
+	}
+	if seq != f.nextSeq {
+		// Retransmissions and out of order segments pass untouched
+		return true
+	}
+	f.data = append(f.data, payload...)
+	f.nextSeq = seq + uint32(len(payload))
+
+	host, err := ServerName(f.data)
+	if err == ErrIncomplete && len(f.data) < recordHeaderLen+maxRecordLen {
+		if !buffered {
+			c.expireFlows(now)
+			if len(c.flows) >= maxFlows {
+				// Too busy to reassemble, fail open
+				return true
+			}
+			c.flows[key] = f
+		}
+		return true
+	}
+	delete(c.flows, key)
+	f.data = nil
+
+	c.stats.Inspected++
+	if err != nil {
+		c.stats.Unparsed++
+		return true
+	}
+	rule, blocked := c.matcher.Match(host)
+	if !blocked {
+		return true
+	}
+	f.blocked = true
+	f.started = now
+	if len(c.flows) >= maxFlows {
+		c.expireFlows(now)
+	}
+	c.flows[key] = f
+	c.stats.Blocked++
+	c.stats.Rules[rule.String()]++
+	if c.OnBlock != nil {
+		c.OnBlock(host, rule.String())
+	}
+	return false
+}
+
+func (c *Classifier) expireFlows(now time.Time) {
+	for key, f := range c.flows {
+		timeout := flowTimeout
+		if f.blocked {
+			timeout = blockedTimeout
+		}
+		if now.Sub(f.started) > timeout {
+			delete(c.flows, key)
+		}
+	}
+}
+
+// tcpSegment extracts the flow key, sequence number and payload of an IPv4
+// or IPv6 TCP packet. IPv6 packets with extension headers are skipped.
+func tcpSegment(packet []byte) (string, uint32, []byte, bool) {
+	if len(packet) < 20 {
+		return "", 0, nil, false
+	}
+	var addrs, tcp []byte
+	switch packet[0] >> 4 {
+	case 4:
+		ihl := int(packet[0]&0x0f) * 4
+		if packet[9] != protoTCP || ihl < 20 || len(packet) < ihl {
+			return "", 0, nil, false
+		}
+		total := int(binary.BigEndian.Uint16(packet[2:]))
+		if total >= ihl && total < len(packet) {
+			packet = packet[:total]
+		}
+		addrs, tcp = packet[12:20], packet[ihl:]
+	case 6:
+		if len(packet) < 40 || packet[6] != protoTCP {
+			return "", 0, nil, false
+		}
+		if total := 40 + int(binary.BigEndian.Uint16(packet[4:])); total < len(packet) {
+			packet = packet[:total]
+		}
+		addrs, tcp = packet[8:40], packet[40:]
+	default:
+		return "", 0, nil, false
+	}
+	if len(tcp) < 20 {
+		return "", 0, nil, false
+	}
+	offset := int(tcp[12]>>4) * 4
+	if offset < 20 || len(tcp) < offset {
+		return "", 0, nil, false
+	}
+	key := string(addrs) + string(tcp[:4])
+	return key, binary.BigEndian.Uint32(tcp[4:]), tcp[offset:], true
+}
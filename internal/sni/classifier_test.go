@@ -0,0 +1,153 @@
+package sni
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// tcpHeader returns a TCP header from port 40000 to 443 without options.
+func tcpHeader(seq uint32) []byte {
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp, 40000)
+	binary.BigEndian.PutUint16(tcp[2:], 443)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	tcp[12] = 5 << 4
+	return tcp
+}
+
+func ipv4Packet(proto byte, seq uint32, payload []byte) []byte {
+	segment := append(tcpHeader(seq), payload...)
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+len(segment)))
+	ip[9] = proto
+	copy(ip[12:], []byte{192, 168, 1, 10})
+	copy(ip[16:], []byte{93, 184, 216, 34})
+	return append(ip, segment...)
+}
+
+func ipv6Packet(next byte, seq uint32, payload []byte) []byte {
+	segment := append(tcpHeader(seq), payload...)
+	ip := make([]byte, 40)
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(segment)))
+	ip[6] = next
+	ip[23] = 1
+	ip[39] = 2
+	return append(ip, segment...)
+}
+
+func TestTCPSegment(t *testing.T) {
+	payload := []byte("hello")
+	padded := append(ipv4Packet(protoTCP, 7, payload), 0, 0, 0)
+	badOffset := ipv4Packet(protoTCP, 7, payload)
+	badOffset[20+12] = 15 << 4
+
+	tests := []struct {
+		name    string
+		packet  []byte
+		ok      bool
+		seq     uint32
+		payload []byte
+	}{
+		{"ipv4", ipv4Packet(protoTCP, 7, payload), true, 7, payload},
+		{"ipv4 with padding", padded, true, 7, payload},
+		{"ipv4 without payload", ipv4Packet(protoTCP, 7, nil), true, 7, nil},
+		{"ipv6", ipv6Packet(protoTCP, 9, payload), true, 9, payload},
+		{"udp", ipv4Packet(17, 7, payload), false, 0, nil},
+		{"ipv6 extension header", ipv6Packet(0, 9, payload), false, 0, nil},
+		{"bad data offset", badOffset, false, 0, nil},
+		{"truncated ipv4", ipv4Packet(protoTCP, 7, nil)[:30], false, 0, nil},
+		{"truncated ipv6", ipv6Packet(protoTCP, 9, nil)[:39], false, 0, nil},
+		{"short", []byte{0x45, 0}, false, 0, nil},
+		{"unknown version", append([]byte{0x20}, make([]byte, 40)...), false, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, seq, payload, ok := tcpSegment(tt.packet)
+			if ok != tt.ok || seq != tt.seq || !bytes.Equal(payload, tt.payload) {
+				t.Errorf("tcpSegment = %d, %q, %v, want %d, %q, %v", seq, payload, ok, tt.seq, tt.payload, tt.ok)
+			}
+		})
+	}
+
+	// Flows are told apart by address and port
+	key4, _, _, _ := tcpSegment(ipv4Packet(protoTCP, 1, nil))
+	key6, _, _, _ := tcpSegment(ipv6Packet(protoTCP, 1, nil))
+	if key4 == key6 {
+		t.Error("IPv4 and IPv6 flows share a key")
+	}
+}
+
+func TestVerdict(t *testing.T) {
+	blocked := record(helloBody(vector(2, serverNameExt("www.example.com"))))
+	allowed := record(helloBody(vector(2, serverNameExt("example.org"))))
+	split := len(blocked) / 2
+
+	tests := []struct {
+		name    string
+		packets [][]byte
+		want    []bool
+	}{
+		{"blocked ipv4", [][]byte{ipv4Packet(protoTCP, 1, blocked)}, []bool{false}},
+		{"blocked ipv6", [][]byte{ipv6Packet(protoTCP, 1, blocked)}, []bool{false}},
+		{"allowed", [][]byte{ipv4Packet(protoTCP, 1, allowed)}, []bool{true}},
+		{"not tls", [][]byte{ipv4Packet(protoTCP, 1, []byte("GET / HTTP/1.1\r\n"))}, []bool{true}},
+		{"no payload", [][]byte{ipv4Packet(protoTCP, 1, nil)}, []bool{true}},
+		{"not tcp", [][]byte{ipv4Packet(17, 1, blocked)}, []bool{true}},
+		{"no server name", [][]byte{ipv4Packet(protoTCP, 1, record(helloBody(nil)))}, []bool{true}},
+		{
+			"split hello",
+			[][]byte{
+				ipv4Packet(protoTCP, 1, blocked[:split]),
+				ipv4Packet(protoTCP, uint32(1+split), blocked[split:]),
+			},
+			[]bool{true, false},
+		},
+		{
+			"retransmission of a blocked hello",
+			[][]byte{ipv4Packet(protoTCP, 1, blocked), ipv4Packet(protoTCP, 1, blocked)},
+			[]bool{false, false},
+		},
+		{
+			"out of order segment",
+			[][]byte{
+				ipv4Packet(protoTCP, 1, blocked[:split]),
+				ipv4Packet(protoTCP, 1000, blocked[split:]),
+			},
+			[]bool{true, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClassifier()
+			c.SetRules([]string{"example.com"})
+			var hosts []string
+			c.OnBlock = func(host, rule string) {
+				hosts = append(hosts, host)
+			}
+			for i, packet := range tt.packets {
+				if got := c.Verdict(packet); got != tt.want[i] {
+					t.Errorf("packet %d: Verdict = %v, want %v", i, got, tt.want[i])
+				}
+			}
+			if len(hosts) > 0 && hosts[0] != "www.example.com" {
+				t.Errorf("OnBlock reported %v", hosts)
+			}
+		})
+	}
+}
+
+func TestVerdictStats(t *testing.T) {
+	c := NewClassifier()
+	c.SetRules([]string{"example.com"})
+	c.Verdict(ipv4Packet(protoTCP, 1, record(helloBody(vector(2, serverNameExt("example.com"))))))
+	c.Verdict(ipv6Packet(protoTCP, 1, record(helloBody(vector(2, serverNameExt("example.org"))))))
+	c.Verdict(ipv6Packet(protoTCP, 5, record(helloBody(nil))))
+
+	stats := c.Stats()
+	if stats.Inspected != 3 || stats.Blocked != 1 || stats.Unparsed != 1 || stats.Rules["example.com"] != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
@@ -0,0 +1,139 @@
+// Package sni classifies outbound TLS connections by the server name in
+// their ClientHello.
+package sni
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+const (
+	recordHandshake  = 22
+	handshakeHello   = 1
+	extServerName    = 0
+	nameTypeHostname = 0
+	recordHeaderLen  = 5
+	// maxRecordLen bounds how much of a flow is buffered while waiting for
+	// the rest of the ClientHello.
+	maxRecordLen = 16384 + 2048
+)
+
+var (
+	// ErrIncomplete means more of the stream is needed to find the name.
+	ErrIncomplete = errors.New("incomplete ClientHello")
+	// ErrNotClientHello means the stream does not start with a ClientHello.
+	ErrNotClientHello = errors.New("not a TLS ClientHello")
+	// ErrNoServerName means the ClientHello carries no server name.
+	ErrNoServerName = errors.New("no server name in ClientHello")
+)
+
+// ServerName returns the lowercased server name from the start of a TLS
+// stream.
+func ServerName(stream []byte) (string, error) {
+	if len(stream) < recordHeaderLen {
+		return "", ErrIncomplete
+	}
+	if stream[0] != recordHandshake || stream[1] != 3 {
+		return "", ErrNotClientHello
+	}
+	length := int(binary.BigEndian.Uint16(stream[3:]))
+	if length > maxRecordLen {
+		return "", ErrNotClientHello
+	}
+	if len(stream) < recordHeaderLen+length {
+		return "", ErrIncomplete
+	}
+	hs := stream[recordHeaderLen : recordHeaderLen+length]
+	if len(hs) < 4 || hs[0] != handshakeHello {
+		return "", ErrNotClientHello
+	}
+	// A ClientHello spanning several records is parsed as far as the
+	// first one goes
+	body := hs[4:]
+	if n := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3]); n < len(body) {
+		body = body[:n]
+	}
+
+	r := reader(body)
+	// Version and random
+	if !r.skip(2 + 32) {
+		return "", ErrNoServerName
+	}
+	if !r.skipVector(1) || !r.skipVector(2) || !r.skipVector(1) {
+		return "", ErrNoServerName
+	}
+	exts, ok := r.vector(2)
+	if !ok {
+		// Scan what there is of a truncated extension list
+		if !r.skip(2) {
+			return "", ErrNoServerName
+		}
+		exts = r
+	}
+	for len(exts) >= 4 {
+		extType := binary.BigEndian.Uint16(exts)
+		extLen := int(binary.BigEndian.Uint16(exts[2:]))
+		if len(exts) < 4+extLen {
+			break
+		}
+		if extType == extServerName {
+			return parseServerName(exts[4 : 4+extLen])
+		}
+		exts = exts[4+extLen:]
+	}
+	return "", ErrNoServerName
+}
+
+func parseServerName(ext []byte) (string, error) {
+	r := reader(ext)
+	list, ok := r.vector(2)
+	if !ok {
+		return "", ErrNoServerName
+	}
+	for len(list) >= 3 {
+		nameType := list[0]
+		nameLen := int(binary.BigEndian.Uint16(list[1:]))
+		if len(list) < 3+nameLen {
+			break
+		}
+		if nameType == nameTypeHostname && nameLen > 0 {
+			return strings.TrimSuffix(strings.ToLower(string(list[3:3+nameLen])), "."), nil
+		}
+		list = list[3+nameLen:]
+	}
+	return "", ErrNoServerName
+}
+
+// reader consumes a byte slice from the front.
+type reader []byte
+
+func (r *reader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+// vector reads a vector with a lenBytes long length prefix.
+func (r *reader) vector(lenBytes int) (reader, bool) {
+	if len(*r) < lenBytes {
+		return nil, false
+	}
+	n := 0
+	for _, b := range (*r)[:lenBytes] {
+		n = n<<8 | int(b)
+	}
+	if len(*r) < lenBytes+n {
+		return nil, false
+	}
+	v := (*r)[lenBytes : lenBytes+n]
+	*r = (*r)[lenBytes+n:]
+	return v, true
+}
+
+func (r *reader) skipVector(lenBytes int) bool {
+	_, ok := r.vector(lenBytes)
+	return ok
+}
@@ -0,0 +1,121 @@
+package sni
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// vector prefixes data with its length in lenBytes bytes.
+func vector(lenBytes int, data []byte) []byte {
+	out := make([]byte, lenBytes, lenBytes+len(data))
+	n := len(data)
+	for i := lenBytes - 1; i >= 0; i-- {
+		out[i] = byte(n)
+		n >>= 8
+	}
+	return append(out, data...)
+}
+
+func extension(extType uint16, data []byte) []byte {
+	out := binary.BigEndian.AppendUint16(nil, extType)
+	return append(out, vector(2, data)...)
+}
+
+func serverNameExt(names ...string) []byte {
+	var list []byte
+	for _, name := range names {
+		list = append(list, nameTypeHostname)
+		list = append(list, vector(2, []byte(name))...)
+	}
+	return extension(extServerName, vector(2, list))
+}
+
+// helloBody returns a ClientHello body with the given extension list.
+func helloBody(exts []byte) []byte {
+	body := []byte{3, 3}
+	body = append(body, make([]byte, 32)...)
+	body = append(body, vector(1, nil)...)                // session id
+	body = append(body, vector(2, []byte{0x13, 0x01})...) // cipher suites
+	body = append(body, vector(1, []byte{0})...)          // compression
+	return append(body, exts...)
+}
+
+// record wraps a ClientHello body in its handshake and record headers.
+func record(body []byte) []byte {
+	hs := append([]byte{handshakeHello}, vector(3, body)...)
+	return append([]byte{recordHandshake, 3, 1}, vector(2, hs)...)
+}
+
+// captureClientHello returns the first record crypto/tls sends for name.
+func captureClientHello(t *testing.T, name string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		conn := tls.Client(client, &tls.Config{ServerName: name})
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Handshake()
+		client.Close()
+	}()
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, recordHeaderLen)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	rest := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	if _, err := io.ReadFull(server, rest); err != nil {
+		t.Fatal(err)
+	}
+	return append(header, rest...)
+}
+
+func TestServerName(t *testing.T) {
+	full := record(helloBody(vector(2, append(extension(23, nil), serverNameExt("Example.COM.")...))))
+	// The extension list claims more than the record holds
+	truncatedList := record(helloBody(append([]byte{0x01, 0x00}, serverNameExt("example.org")...)))
+	truncatedName := record(helloBody(vector(2, extension(extServerName, []byte{0x00, 0x20, 0x00, 0x00, 0x05, 'a'}))))
+
+	tests := []struct {
+		name   string
+		stream []byte
+		want   string
+		err    error
+	}{
+		{"crypto/tls", captureClientHello(t, "www.example.com"), "www.example.com", nil},
+		{"case and trailing dot", full, "example.com", nil},
+		{"several names", record(helloBody(vector(2, serverNameExt("", "example.net")))), "example.net", nil},
+		{"trailing data", append(append([]byte{}, full...), 0x17, 3, 3), "example.com", nil},
+		{"empty", nil, "", ErrIncomplete},
+		{"record header only", full[:recordHeaderLen], "", ErrIncomplete},
+		{"truncated record", full[:len(full)-1], "", ErrIncomplete},
+		{"truncated extension list", truncatedList, "example.org", nil},
+		{"truncated name", truncatedName, "", ErrNoServerName},
+		{"no extensions", record(helloBody(nil)), "", ErrNoServerName},
+		{"no server name", record(helloBody(vector(2, extension(23, nil)))), "", ErrNoServerName},
+		{"short body", record([]byte{3, 3, 0}), "", ErrNoServerName},
+		{"http", []byte("GET / HTTP/1.1\r\n\r\n"), "", ErrNotClientHello},
+		{"server hello", append([]byte{recordHandshake, 3, 3, 0, 4}, 2, 0, 0, 0), "", ErrNotClientHello},
+		{"oversized record", []byte{recordHandshake, 3, 1, 0xff, 0xff}, "", ErrNotClientHello},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ServerName(tt.stream)
+			if got != tt.want || err != tt.err {
+				t.Errorf("ServerName = %q, %v, want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestServerNameEveryPrefix(t *testing.T) {
+	stream := captureClientHello(t, "example.com")
+	for n := 0; n < len(stream); n++ {
+		if _, err := ServerName(stream[:n]); err != ErrIncomplete {
+			t.Fatalf("ServerName of %d of %d bytes = %v, want ErrIncomplete", n, len(stream), err)
+		}
+	}
+}